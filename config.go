@@ -0,0 +1,495 @@
+package main
+
+// Configuration. Every setting has a built in default, and can be overridden - lowest to highest
+// precedence - by a YAML or TOML config file (-config, or ENDPOINT_CONFIG), an environment variable,
+// and a command line flag. The environment variable for a flag is its name in upper snake case with
+// an ENDPOINT_ prefix, so -mysql-dsn is ENDPOINT_MYSQL_DSN. The result is validated as a whole at
+// startup, and every problem is reported at once.
+// go get -u gopkg.in/yaml.v3
+// go get -u github.com/BurntSushi/toml
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+	"gopkg.in/yaml.v3"
+)
+
+// Config - all of the server's settings.
+type Config struct {
+	Store                  string            `yaml:"store" toml:"store"`
+	StoreTimeout           time.Duration     `yaml:"storeTimeout" toml:"storeTimeout"`
+	StoreOperationTimeouts OperationTimeouts `yaml:"storeOperationTimeouts" toml:"storeOperationTimeouts"`
+	Listen                 string            `yaml:"listen" toml:"listen"`
+	PasswordHash           string            `yaml:"passwordHash" toml:"passwordHash"`
+	UniqueEmails           bool              `yaml:"uniqueEmails" toml:"uniqueEmails"`
+	RequireSession         bool              `yaml:"requireSession" toml:"requireSession"`
+	SessionTTL             time.Duration     `yaml:"sessionTTL" toml:"sessionTTL"`
+	Token                  TokenConfig       `yaml:"token" toml:"token"`
+	MySQL                  MySQLConfig       `yaml:"mysql" toml:"mysql"`
+	SQLite                 SQLiteConfig      `yaml:"sqlite" toml:"sqlite"`
+	Memory                 MemoryConfig      `yaml:"memory" toml:"memory"`
+	Postgres               PostgresConfig    `yaml:"postgres" toml:"postgres"`
+	HTTP                   HTTPConfig        `yaml:"http" toml:"http"`
+	Log                    LogConfig         `yaml:"log" toml:"log"`
+	Tracing                TracingConfig     `yaml:"tracing" toml:"tracing"`
+}
+
+// TokenConfig - JWT settings, see token.go. An empty Algorithm leaves the token service off.
+type TokenConfig struct {
+	Algorithm  string        `yaml:"alg" toml:"alg"`
+	KeyFile    string        `yaml:"key" toml:"key"`
+	Issuer     string        `yaml:"issuer" toml:"issuer"`
+	AccessTTL  time.Duration `yaml:"accessTTL" toml:"accessTTL"`
+	RefreshTTL time.Duration `yaml:"refreshTTL" toml:"refreshTTL"`
+}
+
+// MySQLConfig - where the mySQL store lives. A DSN, if given, is used as is instead of the
+// individual connection settings.
+type MySQLConfig struct {
+	DSN                string `yaml:"dsn" toml:"dsn"`
+	User               string `yaml:"user" toml:"user"`
+	Password           string `yaml:"password" toml:"password"`
+	Address            string `yaml:"address" toml:"address"`
+	Database           string `yaml:"database" toml:"database"`
+	UsersTable         string `yaml:"usersTable" toml:"usersTable"`
+	SessionsTable      string `yaml:"sessionsTable" toml:"sessionsTable"`
+	RefreshTokensTable string `yaml:"refreshTokensTable" toml:"refreshTokensTable"`
+	MigrationsTable    string `yaml:"migrationsTable" toml:"migrationsTable"`
+}
+
+// SQLiteConfig - where the SQLite store lives. The DSN is a file name, a file: URI, or :memory: for
+// a database that goes when the process does.
+type SQLiteConfig struct {
+	DSN                string `yaml:"dsn" toml:"dsn"`
+	UsersTable         string `yaml:"usersTable" toml:"usersTable"`
+	SessionsTable      string `yaml:"sessionsTable" toml:"sessionsTable"`
+	RefreshTokensTable string `yaml:"refreshTokensTable" toml:"refreshTokensTable"`
+	MigrationsTable    string `yaml:"migrationsTable" toml:"migrationsTable"`
+}
+
+// PostgresConfig - where the PostgreSQL store lives. The DSN is a postgres:// URL or key=value
+// connection string.
+type PostgresConfig struct {
+	DSN                string `yaml:"dsn" toml:"dsn"`
+	UsersTable         string `yaml:"usersTable" toml:"usersTable"`
+	SessionsTable      string `yaml:"sessionsTable" toml:"sessionsTable"`
+	RefreshTokensTable string `yaml:"refreshTokensTable" toml:"refreshTokensTable"`
+	MigrationsTable    string `yaml:"migrationsTable" toml:"migrationsTable"`
+}
+
+// MemoryConfig - where the memory store keeps its users between runs, see
+// user_model_memorydb_journal.go. An empty DataDir keeps nothing.
+type MemoryConfig struct {
+	DataDir       string `yaml:"dataDir" toml:"dataDir"`
+	SnapshotEvery int    `yaml:"snapshotEvery" toml:"snapshotEvery"`
+}
+
+// HTTPConfig - server timeouts. 0 means no timeout, except for ShutdownTimeout - how long in-flight
+// requests get to finish once we are told to stop - which must be positive.
+type HTTPConfig struct {
+	ReadTimeout       time.Duration `yaml:"readTimeout" toml:"readTimeout"`
+	ReadHeaderTimeout time.Duration `yaml:"readHeaderTimeout" toml:"readHeaderTimeout"`
+	WriteTimeout      time.Duration `yaml:"writeTimeout" toml:"writeTimeout"`
+	IdleTimeout       time.Duration `yaml:"idleTimeout" toml:"idleTimeout"`
+	ShutdownTimeout   time.Duration `yaml:"shutdownTimeout" toml:"shutdownTimeout"`
+	MaxBodyBytes      int64         `yaml:"maxBodyBytes" toml:"maxBodyBytes"`
+}
+
+// LogConfig - see logging.go. Output is stderr, stdout or a file name.
+type LogConfig struct {
+	Level  string `yaml:"level" toml:"level"`
+	Format string `yaml:"format" toml:"format"`
+	Output string `yaml:"output" toml:"output"`
+}
+
+// TracingConfig - see tracing.go. Endpoint and Insecure are for the otlp exporter, File for file.
+type TracingConfig struct {
+	Exporter    string  `yaml:"exporter" toml:"exporter"`
+	Endpoint    string  `yaml:"endpoint" toml:"endpoint"`
+	Insecure    bool    `yaml:"insecure" toml:"insecure"`
+	File        string  `yaml:"file" toml:"file"`
+	SampleRatio float64 `yaml:"sampleRatio" toml:"sampleRatio"`
+	ServiceName string  `yaml:"serviceName" toml:"serviceName"`
+}
+
+// defaultConfig - the settings we ran with before any of this was configurable.
+func defaultConfig() Config {
+	return Config{
+		Store:        storeMySQL,
+		StoreTimeout: 5 * time.Second,
+		Listen:       ":8080",
+		PasswordHash: hashBcrypt,
+		SessionTTL:   24 * time.Hour,
+		Token: TokenConfig{
+			Issuer:     "endpoint",
+			AccessTTL:  15 * time.Minute,
+			RefreshTTL: 30 * 24 * time.Hour,
+		},
+		MySQL: MySQLConfig{
+			User:               "root",
+			Address:            "127.0.0.1:3306",
+			Database:           "entrypoint",
+			UsersTable:         "usersTest",
+			SessionsTable:      "userSessions",
+			RefreshTokensTable: "userRefreshTokens",
+			MigrationsTable:    defaultMigrationsTable,
+		},
+		SQLite: SQLiteConfig{
+			DSN:                "endpoint.db",
+			UsersTable:         "usersTest",
+			SessionsTable:      "userSessions",
+			RefreshTokensTable: "userRefreshTokens",
+			MigrationsTable:    defaultMigrationsTable,
+		},
+		Postgres: PostgresConfig{
+			DSN:                "postgres://postgres@127.0.0.1:5432/entrypoint?sslmode=disable",
+			UsersTable:         "usersTest",
+			SessionsTable:      "userSessions",
+			RefreshTokensTable: "userRefreshTokens",
+			MigrationsTable:    defaultMigrationsTable,
+		},
+		Memory: MemoryConfig{
+			SnapshotEvery: 1000,
+		},
+		HTTP: HTTPConfig{
+			ReadTimeout:       15 * time.Second,
+			ReadHeaderTimeout: 5 * time.Second,
+			WriteTimeout:      15 * time.Second,
+			IdleTimeout:       60 * time.Second,
+			ShutdownTimeout:   30 * time.Second,
+			MaxBodyBytes:      1 << 20,
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: logFormatJSON,
+			Output: logOutputStderr,
+		},
+		Tracing: TracingConfig{
+			Exporter:    traceExporterNone,
+			SampleRatio: 1,
+			ServiceName: "endpoint",
+		},
+	}
+}
+
+// bindFlags registers a flag for every setting, defaulting to and writing into config.
+func (config *Config) bindFlags(flags *flag.FlagSet) {
+	flags.StringVar(&config.Store, "store", config.Store, "user store backend: mysql, postgres, sqlite or memory")
+	flags.DurationVar(&config.StoreTimeout, "store-timeout", config.StoreTimeout, "deadline for each store operation, 0 for none")
+	flags.Var(&config.StoreOperationTimeouts, "store-operation-timeouts", "deadlines for particular store operations, overriding -store-timeout, e.g. GetAllUsers=10s,CreateUser=2s")
+	flags.StringVar(&config.Listen, "listen", config.Listen, "address to serve on")
+	flags.StringVar(&config.PasswordHash, "password-hash", config.PasswordHash, "algorithm for new password hashes: bcrypt or argon2id")
+	flags.BoolVar(&config.UniqueEmails, "unique-emails", config.UniqueEmails, "refuse a user whose email, ignoring case, another user already has")
+	flags.BoolVar(&config.RequireSession, "require-session", config.RequireSession, "require a session token from /user/login on the other /user/* routes")
+	flags.DurationVar(&config.SessionTTL, "session-ttl", config.SessionTTL, "how long a login session lasts")
+
+	flags.StringVar(&config.Token.Algorithm, "token-alg", config.Token.Algorithm, "enable JWT issuing with this signing algorithm: HS256, RS256 or EdDSA")
+	flags.StringVar(&config.Token.KeyFile, "token-key", config.Token.KeyFile, "HS256 secret or PEM private key file for -token-alg (ephemeral key if empty)")
+	flags.StringVar(&config.Token.Issuer, "token-issuer", config.Token.Issuer, "issuer claim for access tokens")
+	flags.DurationVar(&config.Token.AccessTTL, "token-access-ttl", config.Token.AccessTTL, "access token lifetime")
+	flags.DurationVar(&config.Token.RefreshTTL, "token-refresh-ttl", config.Token.RefreshTTL, "refresh token lifetime")
+
+	flags.StringVar(&config.MySQL.DSN, "mysql-dsn", config.MySQL.DSN, "mySQL data source name, overrides the other -mysql connection flags")
+	flags.StringVar(&config.MySQL.User, "mysql-user", config.MySQL.User, "mySQL user")
+	flags.StringVar(&config.MySQL.Password, "mysql-password", config.MySQL.Password, "mySQL password")
+	flags.StringVar(&config.MySQL.Address, "mysql-address", config.MySQL.Address, "mySQL host:port")
+	flags.StringVar(&config.MySQL.Database, "mysql-database", config.MySQL.Database, "mySQL database")
+	flags.StringVar(&config.MySQL.UsersTable, "mysql-users-table", config.MySQL.UsersTable, "mySQL users table")
+	flags.StringVar(&config.MySQL.SessionsTable, "mysql-sessions-table", config.MySQL.SessionsTable, "mySQL sessions table")
+	flags.StringVar(&config.MySQL.RefreshTokensTable, "mysql-refresh-tokens-table", config.MySQL.RefreshTokensTable, "mySQL refresh tokens table")
+	flags.StringVar(&config.MySQL.MigrationsTable, "mysql-migrations-table", config.MySQL.MigrationsTable, "mySQL table recording applied schema migrations")
+
+	flags.StringVar(&config.SQLite.DSN, "sqlite-dsn", config.SQLite.DSN, "SQLite database file, or :memory:")
+	flags.StringVar(&config.SQLite.UsersTable, "sqlite-users-table", config.SQLite.UsersTable, "SQLite users table")
+	flags.StringVar(&config.SQLite.SessionsTable, "sqlite-sessions-table", config.SQLite.SessionsTable, "SQLite sessions table")
+	flags.StringVar(&config.SQLite.RefreshTokensTable, "sqlite-refresh-tokens-table", config.SQLite.RefreshTokensTable, "SQLite refresh tokens table")
+	flags.StringVar(&config.SQLite.MigrationsTable, "sqlite-migrations-table", config.SQLite.MigrationsTable, "SQLite table recording applied schema migrations")
+
+	flags.StringVar(&config.Postgres.DSN, "postgres-dsn", config.Postgres.DSN, "PostgreSQL connection URL or key=value string")
+	flags.StringVar(&config.Postgres.UsersTable, "postgres-users-table", config.Postgres.UsersTable, "PostgreSQL users table")
+	flags.StringVar(&config.Postgres.SessionsTable, "postgres-sessions-table", config.Postgres.SessionsTable, "PostgreSQL sessions table")
+	flags.StringVar(&config.Postgres.RefreshTokensTable, "postgres-refresh-tokens-table", config.Postgres.RefreshTokensTable, "PostgreSQL refresh tokens table")
+	flags.StringVar(&config.Postgres.MigrationsTable, "postgres-migrations-table", config.Postgres.MigrationsTable, "PostgreSQL table recording applied schema migrations")
+
+	flags.StringVar(&config.Memory.DataDir, "memory-data-dir", config.Memory.DataDir, "directory the memory store journals its users to, so they survive a restart; empty keeps nothing")
+	flags.IntVar(&config.Memory.SnapshotEvery, "memory-snapshot-every", config.Memory.SnapshotEvery, "changes journaled between memory store snapshots")
+
+	flags.DurationVar(&config.HTTP.ReadTimeout, "http-read-timeout", config.HTTP.ReadTimeout, "time allowed to read a whole request")
+	flags.DurationVar(&config.HTTP.ReadHeaderTimeout, "http-read-header-timeout", config.HTTP.ReadHeaderTimeout, "time allowed to read request headers")
+	flags.DurationVar(&config.HTTP.WriteTimeout, "http-write-timeout", config.HTTP.WriteTimeout, "time allowed to write a response")
+	flags.DurationVar(&config.HTTP.IdleTimeout, "http-idle-timeout", config.HTTP.IdleTimeout, "how long an idle keep-alive connection is kept open")
+	flags.DurationVar(&config.HTTP.ShutdownTimeout, "http-shutdown-timeout", config.HTTP.ShutdownTimeout, "how long in-flight requests get to finish on SIGINT/SIGTERM")
+	flags.Int64Var(&config.HTTP.MaxBodyBytes, "http-max-body-bytes", config.HTTP.MaxBodyBytes, "largest request body accepted, in bytes")
+
+	flags.StringVar(&config.Log.Level, "log-level", config.Log.Level, "least severe level logged: debug, info, warn or error")
+	flags.StringVar(&config.Log.Format, "log-format", config.Log.Format, "log line format: json or text")
+	flags.StringVar(&config.Log.Output, "log-output", config.Log.Output, "where to log: stderr, stdout or a file name")
+
+	flags.StringVar(&config.Tracing.Exporter, "trace-exporter", config.Tracing.Exporter, "where to send trace spans: none, otlp, stdout or file")
+	flags.StringVar(&config.Tracing.Endpoint, "trace-endpoint", config.Tracing.Endpoint, "OTLP/HTTP collector host:port (default from OTEL_EXPORTER_OTLP_ENDPOINT, else localhost:4318)")
+	flags.BoolVar(&config.Tracing.Insecure, "trace-insecure", config.Tracing.Insecure, "send OTLP spans over plain HTTP")
+	flags.StringVar(&config.Tracing.File, "trace-file", config.Tracing.File, "file the file exporter appends spans to")
+	flags.Float64Var(&config.Tracing.SampleRatio, "trace-sample-ratio", config.Tracing.SampleRatio, "fraction of new traces to record, 0 to 1")
+	flags.StringVar(&config.Tracing.ServiceName, "trace-service-name", config.Tracing.ServiceName, "service name spans are reported under")
+}
+
+// envName returns the environment variable that overrides the named flag.
+func envName(flagName string) string {
+	return "ENDPOINT_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// loadConfig builds the configuration from defaults, config file, environment and args, in
+// increasing order of precedence, and validates it. It returns the args left after the flags.
+func loadConfig(args []string) (Config, []string, error) {
+	// first pass over the command line, just to find out which flags were given and what the config
+	// file is. The values are applied last, once the file and environment have been read.
+	commandLine := defaultConfig()
+	flags := flag.NewFlagSet("endpoint", flag.ContinueOnError)
+	configFile := flags.String("config", "", "YAML or TOML config file (env ENDPOINT_CONFIG)")
+	commandLine.bindFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return commandLine, nil, err
+	}
+	given := make(map[string]string)
+	flags.Visit(func(f *flag.Flag) { given[f.Name] = f.Value.String() })
+
+	config := defaultConfig()
+	if *configFile == "" {
+		*configFile = os.Getenv(envName("config"))
+	}
+	if *configFile != "" {
+		if err := config.loadFile(*configFile); err != nil {
+			return config, nil, err
+		}
+	}
+
+	settings := flag.NewFlagSet("endpoint", flag.ContinueOnError)
+	config.bindFlags(settings)
+	var problems []string
+	settings.VisitAll(func(f *flag.Flag) {
+		if value, isSet := os.LookupEnv(envName(f.Name)); isSet {
+			if err := settings.Set(f.Name, value); err != nil {
+				problems = append(problems, fmt.Sprintf("%v: %v", envName(f.Name), err))
+			}
+		}
+	})
+	for name, value := range given {
+		if name != "config" {
+			settings.Set(name, value) // already parsed once, so cannot fail
+		}
+	}
+
+	problems = append(problems, config.validate()...)
+	if len(problems) > 0 {
+		return config, nil, fmt.Errorf("invalid configuration: %v", strings.Join(problems, "; "))
+	}
+	return config, flags.Args(), nil
+}
+
+// loadFile overlays the settings in a YAML or TOML file, picked by extension. Keys we don't know
+// are an error rather than silently ignored, so a typo doesn't quietly leave a default in place.
+func (config *Config) loadFile(fileName string) error {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %v", err)
+	}
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err = decoder.Decode(config); err != nil && errors.Is(err, io.EOF) == false { // an empty file is fine
+			return fmt.Errorf("failed to parse config file '%v': %v", fileName, err)
+		}
+	case ".toml":
+		metadata, err := toml.Decode(string(data), config)
+		if err != nil {
+			return fmt.Errorf("failed to parse config file '%v': %v", fileName, err)
+		}
+		if undecoded := metadata.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("unknown settings in config file '%v': %v", fileName, undecoded)
+		}
+	default:
+		return fmt.Errorf("config file '%v' must be .yaml, .yml or .toml", fileName)
+	}
+	return nil
+}
+
+// validate returns every problem with the configuration.
+func (config *Config) validate() []string {
+	var problems []string
+	switch config.Store {
+	case storeMySQL, storePostgres, storeSQLite, storeMemory:
+	default:
+		problems = append(problems, fmt.Sprintf("store must be %v, %v, %v or %v, got '%v'", storeMySQL, storePostgres, storeSQLite, storeMemory, config.Store))
+	}
+	if config.StoreTimeout < 0 {
+		problems = append(problems, "store timeout cannot be negative")
+	}
+	for operation, timeout := range config.StoreOperationTimeouts {
+		if isStoreOperation(operation) == false {
+			problems = append(problems, fmt.Sprintf("no store operation '%v' to set a timeout for", operation))
+		} else if timeout < 0 {
+			problems = append(problems, fmt.Sprintf("store timeout for %v cannot be negative", operation))
+		}
+	}
+	if _, _, err := net.SplitHostPort(config.Listen); err != nil {
+		problems = append(problems, fmt.Sprintf("listen address '%v' is not host:port", config.Listen))
+	}
+	switch config.PasswordHash {
+	case hashBcrypt, hashArgon2id:
+	default:
+		problems = append(problems, fmt.Sprintf("password hash must be %v or %v, got '%v'", hashBcrypt, hashArgon2id, config.PasswordHash))
+	}
+	if config.SessionTTL <= 0 {
+		problems = append(problems, "session TTL must be positive")
+	}
+
+	switch config.Token.Algorithm {
+	case "", tokenHS256, tokenRS256, tokenEdDSA:
+	default:
+		problems = append(problems, fmt.Sprintf("token algorithm must be %v, %v or %v, got '%v'", tokenHS256, tokenRS256, tokenEdDSA, config.Token.Algorithm))
+	}
+	if config.Token.AccessTTL <= 0 || config.Token.RefreshTTL <= 0 {
+		problems = append(problems, "token TTLs must be positive")
+	}
+
+	if config.Store == storeMySQL {
+		if config.MySQL.DSN != "" {
+			if _, err := mysql.ParseDSN(config.MySQL.DSN); err != nil {
+				problems = append(problems, fmt.Sprintf("invalid mySQL DSN: %v", err))
+			}
+		} else {
+			if config.MySQL.Database == "" {
+				problems = append(problems, "mySQL database not set")
+			}
+		}
+		for _, table := range []struct{ name, value string }{{"users", config.MySQL.UsersTable},
+			{"sessions", config.MySQL.SessionsTable}, {"refresh tokens", config.MySQL.RefreshTokensTable},
+			{"migrations", config.MySQL.MigrationsTable}} {
+			if isValidTableName(table.value) == false {
+				problems = append(problems, fmt.Sprintf("invalid mySQL %v table name '%v'", table.name, table.value))
+			}
+		}
+	}
+	if config.Store == storeSQLite {
+		if config.SQLite.DSN == "" {
+			problems = append(problems, "SQLite DSN not set")
+		}
+		for _, table := range []struct{ name, value string }{{"users", config.SQLite.UsersTable},
+			{"sessions", config.SQLite.SessionsTable}, {"refresh tokens", config.SQLite.RefreshTokensTable},
+			{"migrations", config.SQLite.MigrationsTable}} {
+			if isValidTableName(table.value) == false {
+				problems = append(problems, fmt.Sprintf("invalid SQLite %v table name '%v'", table.name, table.value))
+			}
+		}
+	}
+	if config.Store == storePostgres {
+		if _, err := pgconn.ParseConfig(config.Postgres.DSN); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid PostgreSQL DSN: %v", err))
+		}
+		for _, table := range []struct{ name, value string }{{"users", config.Postgres.UsersTable},
+			{"sessions", config.Postgres.SessionsTable}, {"refresh tokens", config.Postgres.RefreshTokensTable},
+			{"migrations", config.Postgres.MigrationsTable}} {
+			if isValidTableName(table.value) == false {
+				problems = append(problems, fmt.Sprintf("invalid PostgreSQL %v table name '%v'", table.name, table.value))
+			}
+		}
+	}
+
+	if config.Memory.SnapshotEvery <= 0 {
+		problems = append(problems, "memory snapshot interval must be positive")
+	}
+
+	for _, timeout := range []struct {
+		name  string
+		value time.Duration
+	}{{"read", config.HTTP.ReadTimeout}, {"read header", config.HTTP.ReadHeaderTimeout},
+		{"write", config.HTTP.WriteTimeout}, {"idle", config.HTTP.IdleTimeout}} {
+		if timeout.value < 0 {
+			problems = append(problems, fmt.Sprintf("HTTP %v timeout cannot be negative", timeout.name))
+		}
+	}
+	if config.HTTP.ShutdownTimeout <= 0 {
+		problems = append(problems, "HTTP shutdown timeout must be positive")
+	}
+	if config.HTTP.MaxBodyBytes <= 0 {
+		problems = append(problems, "HTTP max body bytes must be positive")
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(config.Log.Level)); err != nil {
+		problems = append(problems, fmt.Sprintf("log level must be debug, info, warn or error, got '%v'", config.Log.Level))
+	}
+	switch config.Log.Format {
+	case logFormatJSON, logFormatText:
+	default:
+		problems = append(problems, fmt.Sprintf("log format must be %v or %v, got '%v'", logFormatJSON, logFormatText, config.Log.Format))
+	}
+	if config.Log.Output == "" {
+		problems = append(problems, "log output not set")
+	}
+
+	switch config.Tracing.Exporter {
+	case traceExporterNone, traceExporterOTLP, traceExporterStdout:
+	case traceExporterFile:
+		if config.Tracing.File == "" {
+			problems = append(problems, "trace file not set for the file exporter")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("trace exporter must be %v, %v, %v or %v, got '%v'", traceExporterNone, traceExporterOTLP,
+			traceExporterStdout, traceExporterFile, config.Tracing.Exporter))
+	}
+	if config.Tracing.SampleRatio < 0 || config.Tracing.SampleRatio > 1 {
+		problems = append(problems, "trace sample ratio must be between 0 and 1")
+	}
+	return problems
+}
+
+// dsn returns the mySQL data source name - the configured DSN, or one built from the parts.
+func (config MySQLConfig) dsn() string {
+	if config.DSN != "" {
+		return config.DSN
+	}
+	dsnConfig := mysql.NewConfig()
+	dsnConfig.User = config.User
+	dsnConfig.Passwd = config.Password
+	dsnConfig.Net = "tcp"
+	dsnConfig.Addr = config.Address
+	dsnConfig.DBName = config.Database
+	return dsnConfig.FormatDSN()
+}
+
+// databaseName returns the database the DSN connects to, for logging.
+func (config MySQLConfig) databaseName() string {
+	if parsed, err := mysql.ParseDSN(config.dsn()); err == nil {
+		return parsed.DBName
+	}
+	return config.Database
+}
+
+// databaseName returns the database file the DSN names, for logging.
+func (config SQLiteConfig) databaseName() string {
+	fileName, _, _ := strings.Cut(strings.TrimPrefix(config.DSN, "file:"), "?")
+	return fileName
+}
+
+// databaseName returns the database the DSN connects to, for logging.
+func (config PostgresConfig) databaseName() string {
+	if parsed, err := pgconn.ParseConfig(config.DSN); err == nil {
+		return parsed.Database
+	}
+	return ""
+}
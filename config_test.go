@@ -0,0 +1,135 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTestConfig(t *testing.T, name string, contents string) string {
+	fileName := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(fileName, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+// clearConfigEnv unsets any ENDPOINT_* settings from the environment the tests run in, for the
+// duration of the test.
+func clearConfigEnv(t *testing.T) {
+	for _, variable := range os.Environ() {
+		if name, _, _ := strings.Cut(variable, "="); strings.HasPrefix(name, "ENDPOINT_") {
+			t.Setenv(name, "")
+			os.Unsetenv(name)
+		}
+	}
+}
+
+// Test that a flag beats the environment, which beats the config file, which beats the default.
+func TestConfigPrecedence(t *testing.T) {
+	clearConfigEnv(t)
+	fileName := writeTestConfig(t, "endpoint.yaml", `
+store: memory
+listen: ":9000"
+sessionTTL: 2h
+storeOperationTimeouts:
+  GetAllUsers: 10s
+mysql:
+  usersTable: fileUsers
+  sessionsTable: fileSessions
+http:
+  writeTimeout: 20s
+`)
+	t.Setenv("ENDPOINT_CONFIG", fileName)
+	t.Setenv("ENDPOINT_LISTEN", ":9100")
+	t.Setenv("ENDPOINT_MYSQL_SESSIONS_TABLE", "envSessions")
+	t.Setenv("ENDPOINT_HTTP_WRITE_TIMEOUT", "25s")
+
+	config, args, err := loadConfig([]string{"-http-write-timeout", "30s", "migrate", "status"})
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	if config.Store != storeMemory || config.SessionTTL != 2*time.Hour || config.MySQL.UsersTable != "fileUsers" ||
+		config.StoreOperationTimeouts["GetAllUsers"] != 10*time.Second {
+		t.Errorf("expected settings from the file, got %+v", config)
+	}
+	if config.Listen != ":9100" || config.MySQL.SessionsTable != "envSessions" {
+		t.Errorf("expected the environment to override the file, got %+v", config)
+	}
+	if config.HTTP.WriteTimeout != 30*time.Second {
+		t.Errorf("expected the flag to override the environment, got %v", config.HTTP.WriteTimeout)
+	}
+	if config.PasswordHash != hashBcrypt || config.MySQL.RefreshTokensTable != "userRefreshTokens" {
+		t.Errorf("expected defaults for unset values, got %+v", config)
+	}
+	if strings.Join(args, " ") != "migrate status" {
+		t.Errorf("expected the remaining args, got %v", args)
+	}
+}
+
+func TestConfigFileFormats(t *testing.T) {
+	clearConfigEnv(t)
+	tomlFile := writeTestConfig(t, "endpoint.toml", `
+store = "memory"
+[storeOperationTimeouts]
+CreateUser = "2s"
+[token]
+alg = "EdDSA"
+accessTTL = "5m"
+`)
+	config, _, err := loadConfig([]string{"-config", tomlFile})
+	if err != nil {
+		t.Fatalf("failed to load TOML config: %v", err)
+	}
+	if config.Store != storeMemory || config.Token.Algorithm != tokenEdDSA || config.Token.AccessTTL != 5*time.Minute ||
+		config.StoreOperationTimeouts["CreateUser"] != 2*time.Second {
+		t.Errorf("expected settings from the TOML file, got %+v", config)
+	}
+
+	for name, contents := range map[string]string{"typo.yaml": "stroe: memory\n", "typo.toml": "stroe = \"memory\"\n", "endpoint.ini": "store=memory\n"} {
+		if _, _, err = loadConfig([]string{"-config", writeTestConfig(t, name, contents)}); err == nil {
+			t.Errorf("expected an error loading %v", name)
+		}
+	}
+}
+
+// Test that validation reports every problem, not just the first.
+func TestConfigValidation(t *testing.T) {
+	clearConfigEnv(t)
+	_, _, err := loadConfig([]string{"-store", "mysql", "-listen", "8080", "-mysql-users-table", "users; drop", "-http-idle-timeout", "-1s", "-token-alg", "none", "-log-level", "chatty", "-store-operation-timeouts", "GetUsers=1s"})
+	if err == nil {
+		t.Fatal("expected an invalid configuration")
+	}
+	for _, expected := range []string{"listen address", "users table", "idle timeout", "token algorithm", "log level", "GetUsers"} {
+		if strings.Contains(err.Error(), expected) == false {
+			t.Errorf("expected '%v' to be reported, got %v", expected, err)
+		}
+	}
+
+	// a local mySQL with a passwordless user needs no DSN.
+	if _, _, err = loadConfig([]string{"-store", "mysql"}); err != nil {
+		t.Errorf("expected the passwordless mySQL defaults to be valid, got %v", err)
+	}
+
+	t.Setenv("ENDPOINT_SESSION_TTL", "a while")
+	if _, _, err = loadConfig(nil); err == nil || strings.Contains(err.Error(), "ENDPOINT_SESSION_TTL") == false {
+		t.Errorf("expected a bad environment value to be reported, got %v", err)
+	}
+}
+
+func TestMySQLDSN(t *testing.T) {
+	mySQL := defaultConfig().MySQL
+	if mySQL.Password != "" {
+		t.Error("expected no default mySQL password")
+	}
+	mySQL.Password = "secret"
+	if dsn := mySQL.dsn(); dsn != "root:secret@tcp(127.0.0.1:3306)/entrypoint" {
+		t.Errorf("expected the original DSN by default, got %v", dsn)
+	}
+	mySQL.DSN = "app:secret@tcp(db:3306)/users?parseTime=true"
+	if mySQL.dsn() != mySQL.DSN || mySQL.databaseName() != "users" {
+		t.Errorf("expected the configured DSN to be used as is, got %v (%v)", mySQL.dsn(), mySQL.databaseName())
+	}
+}
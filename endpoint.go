@@ -6,7 +6,11 @@ package main
 import (
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/gorilla/mux"
 )
@@ -15,25 +19,105 @@ func homeLink(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "This is my golang test home.")
 }
 
-func createEendpointsAndRun() {
-	router := mux.NewRouter().StrictSlash(true)
+// createEendpointsAndRun sets up the store and routes and serves. With config.RequireSession set,
+// every /user/* route other than register and login needs a session token from /user/login.
+func createEendpointsAndRun(config Config) {
+	// match on the encoded path, so a user name in /users/{userName} may contain an escaped '/'.
+	router := mux.NewRouter().StrictSlash(true).UseEncodedPath()
 	router.HandleFunc("/", homeLink)
-	if initDB() {
-		log.Println("initialized memory model")
-	} else {
-		log.Fatal("Failed to initialize memory model")
+	// unknown routes get the same problem+json errors as everything else - see problem.go.
+	router.NotFoundHandler = http.HandlerFunc(notFound)
+	router.MethodNotAllowedHandler = http.HandlerFunc(methodNotAllowed)
+	setReadiness(readinessStarting)
+	if selectUserStore(config) == false {
+		log.Fatalf("Unsupported user store '%v'", config.Store)
 	}
+	readinessChecks[config.Store] = userStore.Ping
+	_, migrates := userStore.(SchemaMigrator)
+	pool, pooled := userStore.(pooledStore)
+	userStore = instrumentStore(userStore)
+
+	// count and time every request, and expose that at /metrics - see metrics.go.
+	router.Use(instrumentRequests)
+	// and trace them - see tracing.go.
+	router.Use(traceRequests)
+	router.Handle("/metrics", metricsHandler()).Methods("GET")
+
+	// liveness and readiness - see health.go. These answer while the store is still starting up.
+	router.HandleFunc("/healthz", healthz).Methods("GET")
+	router.HandleFunc("/readyz", readyz).Methods("GET")
+
+	// everything else needs the store, so goes on a subrouter that holds requests off until it is up.
+	api := router.NewRoute().Subrouter()
+	api.Use(storeStarted)
 	// Endpoints. Technically only asked for the first, the others allow for unit tests.
 	// Note that these could all share the base user endpoint - to differentiate between
 	// get/delete and get all/delete all I could have specified that distinction in the json.
 	// However, this to me is cleaner, and allows me to easily decouple from http.
-	router.HandleFunc("/user/register", createUser).Methods("POST")
-	router.HandleFunc("/user/get", getUser).Methods("GET")
-	router.HandleFunc("/user/getAll", getAllUsers).Methods("GET")
-	router.HandleFunc("/user/update", updateUser).Methods("PUT") // does NOT create if record not found
-	router.HandleFunc("/user/delete", deleteUser).Methods("DELETE")
-	router.HandleFunc("/user/deleteAll", deleteAllUsers).Methods("DELETE")
-
-	log.Fatal(http.ListenAndServe(":8080", router))
-	releaseDB()
+	session := func(handler http.HandlerFunc) http.HandlerFunc {
+		if config.RequireSession {
+			return requireSession(handler)
+		}
+		return handler
+	}
+	api.HandleFunc("/user/register", createUser).Methods("POST")
+	api.HandleFunc("/user/login", loginUser).Methods("POST")
+	api.HandleFunc("/user/logout", requireSession(logoutUser)).Methods("POST")
+	api.HandleFunc("/user/get", session(getUser)).Methods("GET")
+	api.HandleFunc("/user/getAll", session(getAllUsers)).Methods("GET")
+	api.HandleFunc("/user/update", session(updateUser)).Methods("PUT") // does NOT create if record not found
+	api.HandleFunc("/user/delete", session(deleteUser)).Methods("DELETE")
+	api.HandleFunc("/user/deleteAll", session(deleteAllUsers)).Methods("DELETE")
+
+	// The same handlers as resources. The legacy /user/* routes above are kept for compatibility.
+	api.HandleFunc("/users", createUser).Methods("POST")
+	api.HandleFunc("/users", session(getAllUsers)).Methods("GET")
+	api.HandleFunc("/users/{userName}", session(getUser)).Methods("GET")
+	api.HandleFunc("/users/{userName}", session(updateUser)).Methods("PUT") // does NOT create if record not found
+	api.HandleFunc("/users/{userName}", session(patchUser)).Methods("PATCH")
+	api.HandleFunc("/users/{userName}", session(deleteUser)).Methods("DELETE")
+
+	// JWT tokens for other services - see token.go
+	if tokenService != nil {
+		api.HandleFunc("/token", issueToken).Methods("POST")
+		api.HandleFunc("/token/refresh", refreshToken).Methods("POST")
+		api.HandleFunc("/token/revoke", revokeToken).Methods("POST")
+		api.HandleFunc("/.well-known/jwks.json", getJWKS).Methods("GET")
+	}
+
+	server := &http.Server{
+		Addr:              config.Listen,
+		Handler:           requestIDs(router), // every request gets an ID and a log line - see logging.go
+		ReadTimeout:       config.HTTP.ReadTimeout,
+		ReadHeaderTimeout: config.HTTP.ReadHeaderTimeout,
+		WriteTimeout:      config.HTTP.WriteTimeout,
+		IdleTimeout:       config.HTTP.IdleTimeout,
+	}
+	listener, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		releaseDB()
+		log.Fatalf("Failed to listen on %v: %v", config.Listen, err)
+	}
+	log.Printf("listening on %v", listener.Addr())
+
+	// bring the store up while already answering /healthz and /readyz, so an orchestrator can tell
+	// a slow migration from a dead process.
+	// A store that fails to come up shuts us down the same way a signal does.
+	initFailed := startStore(migrates, func() error {
+		if initDB() == false {
+			return fmt.Errorf("failed to initialize %v model", config.Store)
+		}
+		log.Printf("initialized %v model", config.Store)
+		if pooled {
+			registerDBStats(pool.connectionPool())
+		}
+		return nil
+	}, releaseDB)
+
+	// serve until told to stop, then drain and release the store - see shutdown.go.
+	stop := make(chan os.Signal, 2)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	if err = runServer(server, listener, stop, initFailed, config.HTTP.ShutdownTimeout); err != nil {
+		os.Exit(1)
+	}
 }
@@ -7,7 +7,9 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -333,8 +335,8 @@ func TestUpdate(t *testing.T) {
 		if userResp.User.UserName != user.UserName {
 			t.Errorf("    update failed, expected username %v, got %v", user.UserName, userResp.User.UserName)
 		}
-		if userResp.User.Password != newPassword {
-			t.Errorf("    update failed, expected password %v, got %v", newPassword, userResp.User.Password)
+		if userResp.User.Email != user.Email {
+			t.Errorf("    update failed, expected email %v, got %v", user.Email, userResp.User.Email)
 		} else {
 			log.Println("    updated OK")
 		}
@@ -408,3 +410,638 @@ func TestDelete(t *testing.T) {
 		t.Error(msg)
 	}
 }
+
+// users whose names and emails would have broken the old string-formatted SQL.
+var awkwardUsers = testUsers{
+	{
+		UserName: "O'Brien",
+		Email:    "o'brien@quote.org",
+		Password: "pass'word",
+	},
+	{
+		UserName: `back\slash`,
+		Email:    `back\slash@escape.com`,
+		Password: `pa\ss`,
+	},
+	{
+		UserName: "semi;colon",
+		Email:    "x'; DROP TABLE usersTest; --@evil.net",
+		Password: "'; DELETE FROM usersTest; --",
+	},
+	{
+		UserName: `"double" quote`,
+		Email:    `"quoted"@example.com`,
+		Password: `pass"word`,
+	},
+	{
+		UserName: "Zoë Ünicode 名前 🙂",
+		Email:    "zoë@ünicode.example",
+		Password: "пароль",
+	},
+}
+
+// Test users with quotes, backslashes, semicolons and unicode round trip through every operation.
+func TestAwkwardCharacters(t *testing.T) {
+	log.Print("**** Starting unit test awkward characters ****")
+	if ret := deleteAll(); ret == false {
+		t.Error("delete all request failed")
+	}
+
+	for _, user := range awkwardUsers {
+		if success, msg, userResp := testCreate(user); success == true {
+			if userResp.User.UserName != user.UserName {
+				t.Errorf("    bad resp record: %v", userResp)
+			}
+		} else {
+			t.Error(msg)
+		}
+	}
+
+	// read each back and make sure nothing was mangled on the way in.
+	for _, user := range awkwardUsers {
+		if success, msg, userResp := testGet(user); success == true {
+			if userResp.User.UserName != user.UserName || userResp.User.Email != user.Email {
+				t.Errorf("    expected %q/%q, got %q/%q", user.UserName, user.Email, userResp.User.UserName, userResp.User.Email)
+			}
+		} else {
+			t.Error(msg)
+		}
+	}
+
+	// none of the injection attempts above should have touched the other rows.
+	if success, msg, userResp := testGetAll(); success == true {
+		if userResp.Count != len(awkwardUsers) {
+			t.Errorf("    expected %v users, got %v", len(awkwardUsers), userResp.Count)
+		}
+	} else {
+		t.Error(msg)
+	}
+
+	// update only the user we target.
+	user := awkwardUsers[0]
+	user.Email = "o'brien.new@quote.org" // a quote is fine in the local part, not the domain
+	if success, msg, _ := testUpdate(user); success == false {
+		t.Error(msg)
+	}
+	if success, msg, userResp := testGet(user); success == true {
+		if userResp.User.Email != user.Email {
+			t.Errorf("    update failed, expected email %q, got %q", user.Email, userResp.User.Email)
+		}
+	} else {
+		t.Error(msg)
+	}
+	if success, msg, userResp := testGet(awkwardUsers[1]); success == true {
+		if userResp.User.Email != awkwardUsers[1].Email {
+			t.Errorf("    update touched user %q, email now %q", awkwardUsers[1].UserName, userResp.User.Email)
+		}
+	} else {
+		t.Error(msg)
+	}
+
+	// and delete only the user we target.
+	if success, msg, userResp := testDelete(awkwardUsers[2].UserName); success == true {
+		if userResp.User.UserName != awkwardUsers[2].UserName {
+			t.Errorf("    bad resp record: %v", userResp)
+		}
+	} else {
+		t.Error(msg)
+	}
+	if success, msg, userResp := testGetAll(); success == true {
+		if userResp.Count != len(awkwardUsers)-1 {
+			t.Errorf("    expected %v users after delete, got %v", len(awkwardUsers)-1, userResp.Count)
+		}
+	} else {
+		t.Error(msg)
+	}
+}
+
+// issue a request and return the status code and raw response body.
+func testRawRequest(method string, path string, body interface{}) (int, string, error) {
+	buf := new(bytes.Buffer)
+	json.NewEncoder(buf).Encode(body)
+	req, err := http.NewRequest(method, baseURL+path, buf)
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(respBody), err
+}
+
+// Test that neither the password nor its hash is ever serialized in a response.
+func TestPasswordNotReturned(t *testing.T) {
+	log.Print("**** Starting unit test password not returned ****")
+	if ret := deleteAll(); ret == false {
+		t.Error("delete all request failed")
+	}
+
+	user := myUsers[0]
+	requests := []struct {
+		method string
+		path   string
+		body   interface{}
+	}{
+		{"POST", "register", user},
+		{"GET", "get", UserNameOperation{UserName: user.UserName}},
+		{"PUT", "update", user},
+		{"GET", "getAll", ""},
+		{"DELETE", "delete", UserNameOperation{UserName: user.UserName}},
+	}
+	for _, request := range requests {
+		status, body, err := testRawRequest(request.method, request.path, request.body)
+		if err != nil {
+			t.Errorf("    %v %v failed: %v", request.method, request.path, err)
+			continue
+		}
+		if status >= 300 {
+			t.Errorf("    %v %v returned %v: %v", request.method, request.path, status, body)
+		}
+		if strings.Contains(body, "Password") || strings.Contains(body, user.Password) || strings.Contains(body, "$2a$") {
+			t.Errorf("    %v %v leaked the password: %v", request.method, request.path, body)
+		}
+	}
+}
+
+// log in, returning the http status and the decoded response.
+func testLogin(userName string, password string) (int, LoginOperationResult, error) {
+	var loginResp LoginOperationResult
+	buf := new(bytes.Buffer)
+	json.NewEncoder(buf).Encode(LoginOperation{UserName: userName, Password: password})
+	req, err := http.NewRequest("POST", baseURL+"login", buf)
+	if err != nil {
+		return 0, loginResp, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, loginResp, err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	json.Unmarshal(body, &loginResp)
+	return resp.StatusCode, loginResp, nil
+}
+
+// log out the session for token, returning the http status.
+func testLogout(token string) (int, error) {
+	req, err := http.NewRequest("POST", baseURL+"logout", nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// Test logging in with good and bad credentials, and that a session ends at logout.
+func TestLoginLogout(t *testing.T) {
+	log.Print("**** Starting unit test login/logout ****")
+	if ret := deleteAll(); ret == false {
+		t.Error("delete all request failed")
+	}
+	user := myUsers[0]
+	if success, msg, _ := testCreate(user); success == false {
+		t.Fatal(msg)
+	}
+
+	if status, _, err := testLogin(user.UserName, "wrong"+user.Password); err != nil || status != http.StatusUnauthorized {
+		t.Errorf("    expected 401 for bad password, got %v (%v)", status, err)
+	}
+	if status, _, err := testLogin("nobody", user.Password); err != nil || status != http.StatusUnauthorized {
+		t.Errorf("    expected 401 for unknown user, got %v (%v)", status, err)
+	}
+
+	status, loginResp, err := testLogin(user.UserName, user.Password)
+	if err != nil || status != http.StatusOK {
+		t.Fatalf("    login failed: %v (%v)", status, err)
+	}
+	if len(loginResp.Token) < 1 || loginResp.User.UserName != user.UserName {
+		t.Errorf("    bad login response: %+v", loginResp)
+	}
+
+	if status, err := testLogout(loginResp.Token); err != nil || status != http.StatusOK {
+		t.Errorf("    logout failed: %v (%v)", status, err)
+	}
+	// the token is dead now.
+	if status, err := testLogout(loginResp.Token); err != nil || status != http.StatusUnauthorized {
+		t.Errorf("    expected 401 logging out twice, got %v (%v)", status, err)
+	}
+}
+
+// post body to the token service at path, returning the http status and decoded response.
+func testTokenRequest(path string, body interface{}) (int, TokenOperationResult, error) {
+	var tokenResp TokenOperationResult
+	buf := new(bytes.Buffer)
+	json.NewEncoder(buf).Encode(body)
+	req, err := http.NewRequest("POST", tokenURL+path, buf)
+	if err != nil {
+		return 0, tokenResp, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, tokenResp, err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	json.Unmarshal(respBody, &tokenResp)
+	return resp.StatusCode, tokenResp, nil
+}
+
+var tokenURL = "http://localhost:8080/token"
+
+// Test issuing, rotating and revoking tokens. Skipped unless the server runs with -token-alg.
+func TestTokens(t *testing.T) {
+	log.Print("**** Starting unit test tokens ****")
+	if status, _, err := testTokenRequest("", LoginOperation{}); err != nil || status == http.StatusNotFound || status == http.StatusMethodNotAllowed {
+		t.Skipf("token service not enabled (%v %v)", status, err)
+	}
+	if ret := deleteAll(); ret == false {
+		t.Error("delete all request failed")
+	}
+	user := myUsers[1]
+	if success, msg, _ := testCreate(user); success == false {
+		t.Fatal(msg)
+	}
+
+	if status, _, _ := testTokenRequest("", LoginOperation{UserName: user.UserName, Password: "nope"}); status != http.StatusUnauthorized {
+		t.Errorf("    expected 401 for bad password, got %v", status)
+	}
+	status, issued, err := testTokenRequest("", LoginOperation{UserName: user.UserName, Password: user.Password})
+	if err != nil || status != http.StatusOK || len(issued.AccessToken) < 1 || len(issued.RefreshToken) < 1 {
+		t.Fatalf("    token request failed: %v %v %+v", status, err, issued)
+	}
+
+	// the refresh token rotates: the new one works, the old one is spent.
+	status, refreshed, _ := testTokenRequest("/refresh", RefreshTokenOperation{RefreshToken: issued.RefreshToken})
+	if status != http.StatusOK || refreshed.RefreshToken == issued.RefreshToken || refreshed.User.UserName != user.UserName {
+		t.Errorf("    refresh failed: %v %+v", status, refreshed)
+	}
+	if status, _, _ := testTokenRequest("/refresh", RefreshTokenOperation{RefreshToken: issued.RefreshToken}); status != http.StatusUnauthorized {
+		t.Errorf("    expected 401 reusing a refresh token, got %v", status)
+	}
+
+	// revoked tokens are dead too.
+	if status, _, _ := testTokenRequest("/revoke", RefreshTokenOperation{RefreshToken: refreshed.RefreshToken}); status != http.StatusOK {
+		t.Errorf("    revoke failed: %v", status)
+	}
+	if status, _, _ := testTokenRequest("/refresh", RefreshTokenOperation{RefreshToken: refreshed.RefreshToken}); status != http.StatusUnauthorized {
+		t.Errorf("    expected 401 for a revoked refresh token, got %v", status)
+	}
+
+	// the access token is accepted in place of a session.
+	if status, err := testLogout(refreshed.AccessToken); err != nil || status != http.StatusOK {
+		t.Errorf("    access token rejected: %v (%v)", status, err)
+	}
+}
+
+var usersURL = "http://localhost:8080/users"
+
+// issue a request against the /users resource, returning the http status and raw response body.
+func testResourceRequest(method string, userName string, body interface{}) (int, []byte, error) {
+	reqURL := usersURL
+	if userName != "" {
+		reqURL += "/" + url.PathEscape(userName)
+	}
+	buf := new(bytes.Buffer)
+	if body != nil {
+		json.NewEncoder(buf).Encode(body)
+	}
+	req, err := http.NewRequest(method, reqURL, buf)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, respBody, err
+}
+
+// Test that a new user comes back as stored, with a real ID, and that Location finds them.
+func TestCreateLocation(t *testing.T) {
+	log.Print("**** Starting unit test create location ****")
+	if ret := deleteAll(); ret == false {
+		t.Error("delete all request failed")
+	}
+	user := User{UserName: "where/am I?", Email: "where@example.com", Password: "passwrd5"}
+	buf := new(bytes.Buffer)
+	json.NewEncoder(buf).Encode(user)
+	resp, err := http.Post(usersURL, "application/json", buf)
+	if err != nil {
+		t.Fatalf("    POST /users failed: %v", err)
+	}
+	var createResp UserOperationResult
+	json.NewDecoder(resp.Body).Decode(&createResp)
+	resp.Body.Close()
+	location := resp.Header.Get("Location")
+	if resp.StatusCode != http.StatusCreated || createResp.User.ID == 0 || location != "/users/"+url.PathEscape(user.UserName) {
+		t.Fatalf("    expected 201 with an ID and Location, got %v %+v '%v'", resp.StatusCode, createResp, location)
+	}
+
+	resp, err = http.Get(strings.TrimSuffix(usersURL, "/users") + location)
+	if err != nil {
+		t.Fatalf("    GET %v failed: %v", location, err)
+	}
+	var getResp UserOperationResult
+	json.NewDecoder(resp.Body).Decode(&getResp)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || getResp.User != createResp.User {
+		t.Errorf("    expected GET %v to find %+v, got %v %+v", location, createResp.User, resp.StatusCode, getResp.User)
+	}
+}
+
+// Test the /users resource routes, and that they see the same data as the legacy routes.
+func TestUsersResource(t *testing.T) {
+	log.Print("**** Starting unit test users resource ****")
+	if ret := deleteAll(); ret == false {
+		t.Error("delete all request failed")
+	}
+
+	// names that need escaping in a path.
+	user := User{UserName: "slash/and space?", Email: "slash@example.com", Password: "passwrd4"}
+	if status, body, err := testResourceRequest("POST", "", user); err != nil || status != http.StatusCreated {
+		t.Fatalf("    POST /users failed: %v %s (%v)", status, body, err)
+	}
+	if status, body, _ := testResourceRequest("POST", "", user); status != http.StatusConflict || strings.Contains(string(body), "duplicate-user-name") == false {
+		t.Errorf("    expected 409 duplicate-user-name for a second POST, got %v %s", status, body)
+	}
+
+	var getResp UserOperationResult
+	status, body, err := testResourceRequest("GET", user.UserName, nil)
+	json.Unmarshal(body, &getResp)
+	if err != nil || status != http.StatusOK || getResp.User.UserName != user.UserName {
+		t.Errorf("    GET /users/{userName} failed: %v %s (%v)", status, body, err)
+	}
+	var problem Problem
+	status, body, _ = testResourceRequest("GET", "nobody", nil)
+	if json.Unmarshal(body, &problem); status != http.StatusNotFound || problem.Code != "user-not-found" {
+		t.Errorf("    expected a 404 user-not-found problem for unknown user, got %v %s", status, body)
+	}
+
+	// patch just the email; the password must still work afterwards.
+	newEmail := "patched@example.com"
+	if status, body, err := testResourceRequest("PATCH", user.UserName, map[string]string{"Email": newEmail}); err != nil || status != http.StatusOK {
+		t.Errorf("    PATCH failed: %v %s (%v)", status, body, err)
+	}
+	if success, msg, getResp := testGet(user); success == false || getResp.User.Email != newEmail {
+		t.Errorf("    legacy get after patch: %v %+v", msg, getResp)
+	}
+	if status, _, err := testLogin(user.UserName, user.Password); err != nil || status != http.StatusOK {
+		t.Errorf("    login after patch failed: %v (%v)", status, err)
+	}
+
+	// put takes the user name from the path, and refuses a body that names someone else.
+	user.Email = "put@example.com"
+	if status, body, err := testResourceRequest("PUT", user.UserName, User{Email: user.Email, Password: user.Password}); err != nil || status != http.StatusOK {
+		t.Errorf("    PUT failed: %v %s (%v)", status, body, err)
+	}
+	if status, _, _ := testResourceRequest("PUT", user.UserName, myUsers[0]); status != http.StatusBadRequest {
+		t.Errorf("    expected 400 for mismatched user name, got %v", status)
+	}
+
+	var getAllResp UserGetAllOperationResult
+	status, body, err = testResourceRequest("GET", "", nil)
+	json.Unmarshal(body, &getAllResp)
+	if err != nil || status != http.StatusOK || getAllResp.Count != 1 || getAllResp.Users[0].Email != user.Email {
+		t.Errorf("    GET /users failed: %v %s (%v)", status, body, err)
+	}
+
+	if status, body, err := testResourceRequest("DELETE", user.UserName, nil); err != nil || status != http.StatusOK {
+		t.Errorf("    DELETE failed: %v %s (%v)", status, body, err)
+	}
+	if status, _, _ := testResourceRequest("DELETE", user.UserName, nil); status != http.StatusNotFound {
+		t.Errorf("    expected 404 deleting twice, got %v", status)
+	}
+}
+
+// Test paging through /users with a sort order and a page size.
+func TestGetAllPaging(t *testing.T) {
+	log.Print("**** Starting unit test get all paging ****")
+	if ret := deleteAll(); ret == false {
+		t.Error("delete all request failed")
+	}
+	for _, user := range myUsers {
+		if success, msg, _ := testCreate(user); success == false {
+			t.Error(msg)
+		}
+	}
+
+	var seen []string
+	params := url.Values{"sort": {"-UserName"}, "limit": {"2"}}
+	for pages := 0; pages < len(myUsers); pages++ {
+		var pageResp UserGetAllOperationResult
+		resp, err := http.Get(usersURL + "?" + params.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		json.Unmarshal(body, &pageResp)
+		if resp.StatusCode != http.StatusOK || pageResp.Total != len(myUsers) || pageResp.Count > 2 {
+			t.Fatalf("    bad page: %v %s", resp.StatusCode, body)
+		}
+		for _, user := range pageResp.Users {
+			seen = append(seen, user.UserName)
+		}
+		if pageResp.NextCursor == "" {
+			break
+		}
+		params.Set("cursor", pageResp.NextCursor)
+	}
+	if strings.Join(seen, ",") != "Tony,Joan,Alfie" {
+		t.Errorf("    expected Tony,Joan,Alfie, got %v", seen)
+	}
+
+	if resp, err := http.Get(usersURL + "?limit=lots"); err != nil {
+		t.Error(err)
+	} else if resp.Body.Close(); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("    expected 400 for a bad limit, got %v", resp.StatusCode)
+	}
+}
+
+// send a PATCH to /users/{userName} with the given content type, returning the http status.
+func testPatch(userName string, contentType string, patch string) (int, error) {
+	req, err := http.NewRequest("PATCH", usersURL+"/"+url.PathEscape(userName), strings.NewReader(patch))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// Test PATCH with both patch formats, and the ways a patch can be refused.
+func TestPatchFormats(t *testing.T) {
+	log.Print("**** Starting unit test patch formats ****")
+	if ret := deleteAll(); ret == false {
+		t.Error("delete all request failed")
+	}
+	user := myUsers[2]
+	if success, msg, _ := testCreate(user); success == false {
+		t.Fatal(msg)
+	}
+
+	tests := []struct {
+		contentType string
+		patch       string
+		status      int
+	}{
+		{"application/merge-patch+json", `{"Email":"merged@example.com"}`, http.StatusOK},
+		{"application/json-patch+json", `[{"op":"test","path":"/Email","value":"merged@example.com"},{"op":"replace","path":"/Email","value":"patched@example.com"}]`, http.StatusOK},
+		{"application/json-patch+json", `[{"op":"test","path":"/Email","value":"merged@example.com"}]`, http.StatusUnprocessableEntity},
+		{"application/merge-patch+json", `{"UserName":"Someone"}`, http.StatusUnprocessableEntity},
+		{"application/merge-patch+json", `{"Email":""}`, http.StatusUnprocessableEntity},
+		{"text/plain", `Email=x`, http.StatusUnsupportedMediaType},
+	}
+	for _, test := range tests {
+		if status, err := testPatch(user.UserName, test.contentType, test.patch); err != nil || status != test.status {
+			t.Errorf("    %v %v: expected %v, got %v (%v)", test.contentType, test.patch, test.status, status, err)
+		}
+	}
+	if success, msg, getResp := testGet(user); success == false || getResp.User.Email != "patched@example.com" {
+		t.Errorf("    expected patched email, got %v %+v", msg, getResp.User)
+	}
+	if status, err := testPatch("nobody", "application/merge-patch+json", `{"Email":"x@example.com"}`); err != nil || status != http.StatusNotFound {
+		t.Errorf("    expected 404 patching unknown user, got %v (%v)", status, err)
+	}
+}
+
+// testConditionalRequest sends a /users/{userName} request with the given precondition headers,
+// returning the status and ETag of the response.
+func testConditionalRequest(method string, userName string, body interface{}, headers map[string]string) (int, string, error) {
+	buf := new(bytes.Buffer)
+	if body != nil {
+		json.NewEncoder(buf).Encode(body)
+	}
+	req, err := http.NewRequest(method, usersURL+"/"+url.PathEscape(userName), buf)
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, resp.Header.Get("ETag"), nil
+}
+
+// Test ETags, and that a write made against a stale ETag is refused rather than clobbering.
+func TestETags(t *testing.T) {
+	log.Print("**** Starting unit test etags ****")
+	if ret := deleteAll(); ret == false {
+		t.Error("delete all request failed")
+	}
+	user := myUsers[0]
+	if success, msg, _ := testCreate(user); success == false {
+		t.Fatal(msg)
+	}
+
+	status, etag, err := testConditionalRequest("GET", user.UserName, nil, nil)
+	if err != nil || status != http.StatusOK || etag == "" {
+		t.Fatalf("    expected 200 with an ETag, got %v '%v' (%v)", status, etag, err)
+	}
+	if status, _, err = testConditionalRequest("GET", user.UserName, nil, map[string]string{"If-None-Match": etag}); err != nil || status != http.StatusNotModified {
+		t.Errorf("    expected 304 for a matching If-None-Match, got %v (%v)", status, err)
+	}
+	if status, _, err = testConditionalRequest("GET", user.UserName, nil, map[string]string{"If-None-Match": "W/" + etag}); err != nil || status != http.StatusNotModified {
+		t.Errorf("    expected 304 for a weak If-None-Match, got %v (%v)", status, err)
+	}
+	if status, _, err = testConditionalRequest("PUT", user.UserName, user, map[string]string{"If-Match": "W/" + etag}); err != nil || status != http.StatusPreconditionFailed {
+		t.Errorf("    expected 412 for a weak If-Match, got %v (%v)", status, err)
+	}
+	if status, _, err = testConditionalRequest("PUT", "nobody", User{UserName: "nobody", Email: "nobody@example.com", Password: "passwrd1"}, nil); err != nil || status != http.StatusNotFound {
+		t.Errorf("    expected 404 updating a missing user, got %v (%v)", status, err)
+	}
+
+	// two clients both start from etag; only the first update wins.
+	first, second := user, user
+	first.Email = "first@example.com"
+	second.Email = "second@example.com"
+	status, newETag, err := testConditionalRequest("PUT", user.UserName, first, map[string]string{"If-Match": etag})
+	if err != nil || status != http.StatusOK || newETag == "" || newETag == etag {
+		t.Errorf("    expected 200 and a new ETag for the first update, got %v '%v' (%v)", status, newETag, err)
+	}
+	if status, _, err = testConditionalRequest("PUT", user.UserName, second, map[string]string{"If-Match": etag}); err != nil || status != http.StatusPreconditionFailed {
+		t.Errorf("    expected 412 for the stale update, got %v (%v)", status, err)
+	}
+	if success, msg, getResp := testGet(user); success == false || getResp.User.Email != first.Email {
+		t.Errorf("    expected the first update to stick, got %v %+v", msg, getResp.User)
+	}
+
+	if status, _, err = testConditionalRequest("PATCH", user.UserName, map[string]string{"Email": "patched@example.com"}, map[string]string{"If-Match": etag}); err != nil || status != http.StatusPreconditionFailed {
+		t.Errorf("    expected 412 for a stale patch, got %v (%v)", status, err)
+	}
+	if status, _, err = testConditionalRequest("DELETE", user.UserName, nil, map[string]string{"If-Match": etag}); err != nil || status != http.StatusPreconditionFailed {
+		t.Errorf("    expected 412 for a stale delete, got %v (%v)", status, err)
+	}
+	if status, _, err = testConditionalRequest("DELETE", user.UserName, nil, map[string]string{"If-Match": newETag}); err != nil || status != http.StatusOK {
+		t.Errorf("    expected 200 deleting with the current ETag, got %v (%v)", status, err)
+	}
+	if status, _, err = testConditionalRequest("PUT", user.UserName, first, map[string]string{"If-Match": "*"}); err != nil || status != http.StatusPreconditionFailed {
+		t.Errorf("    expected 412 for If-Match: * on a deleted user, got %v (%v)", status, err)
+	}
+}
+
+// Test that the running server reports itself alive and ready.
+func TestHealth(t *testing.T) {
+	log.Print("**** Starting unit test health ****")
+	for _, path := range []string{"/healthz", "/readyz"} {
+		resp, err := http.Get("http://localhost:8080" + path)
+		if err != nil {
+			t.Errorf("    %v failed: %v", path, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("    %v: expected 200, got %v", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	log.Print("**** Starting unit test metrics ****")
+	http.Get("http://localhost:8080/users/metricsNobody")
+	resp, err := http.Get("http://localhost:8080/metrics")
+	if err != nil {
+		t.Fatalf("    /metrics failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("    /metrics: expected 200, got %v", resp.StatusCode)
+	}
+	for _, series := range []string{`endpoint_http_requests_total{method="GET",route="/users/{userName}",status="404"}`,
+		`endpoint_model_operations_total{operation="GetUser",status="User not found"}`} {
+		if bytes.Contains(body, []byte(series)) == false {
+			t.Errorf("    /metrics: expected %v", series)
+		}
+	}
+}
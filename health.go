@@ -0,0 +1,118 @@
+package main
+
+// Liveness and readiness. /healthz only says the process is up and serving. /readyz says whether we
+// should be sent traffic: not while the store is still being initialized (migrations included) or
+// once shutdown has started, and otherwise only if every dependency answers a ping in time.
+// Until the store is ready, the store backed routes answer 503 rather than touch it.
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Readiness states.
+const (
+	readinessStarting     = "starting"
+	readinessMigrating    = "migrating"
+	readinessReady        = "ready"
+	readinessShuttingDown = "shutting down"
+)
+
+// how long a dependency gets to answer a readiness ping.
+const readinessPingTimeout = 2 * time.Second
+
+var readiness atomic.Value
+
+func setReadiness(state string) {
+	slog.Info("setReadiness()", "state", state)
+	readiness.Store(state)
+}
+
+// advanceReadiness moves to state only from one of from, so a late step of starting up can't undo
+// shutting down. It reports whether it did.
+func advanceReadiness(state string, from ...string) bool {
+	for _, earlier := range from {
+		if readiness.CompareAndSwap(earlier, state) {
+			slog.Info("advanceReadiness()", "state", state)
+			return true
+		}
+	}
+	return false
+}
+
+func currentReadiness() string {
+	if state, ok := readiness.Load().(string); ok {
+		return state
+	}
+	return readinessStarting
+}
+
+// HealthCheck - the result of pinging one dependency.
+type HealthCheck struct {
+	Status  string
+	Reason  string `json:",omitempty"`
+	Latency string
+}
+
+// HealthResult - the /healthz and /readyz response.
+type HealthResult struct {
+	Status string
+	Reason string                 `json:",omitempty"`
+	Checks map[string]HealthCheck `json:",omitempty"`
+}
+
+// readinessChecks - the dependencies /readyz pings, by name.
+var readinessChecks = map[string]func(ctx context.Context) error{}
+
+// GET -> "/healthz"
+func healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(HealthResult{Status: "ok"})
+}
+
+// GET -> "/readyz"
+func readyz(w http.ResponseWriter, r *http.Request) {
+	result := HealthResult{Status: "ready"}
+	httpStatus := http.StatusOK
+	if state := currentReadiness(); state != readinessReady {
+		result.Status, result.Reason = "not ready", state
+		httpStatus = http.StatusServiceUnavailable
+	} else {
+		result.Checks = make(map[string]HealthCheck)
+		for name, check := range readinessChecks {
+			ctx, cancel := context.WithTimeout(r.Context(), readinessPingTimeout)
+			start := time.Now()
+			err := check(ctx)
+			cancel()
+			healthCheck := HealthCheck{Status: "ok", Latency: time.Since(start).String()}
+			if err != nil {
+				healthCheck.Status, healthCheck.Reason = "failed", err.Error()
+				result.Status, result.Reason = "not ready", name+" check failed"
+				httpStatus = http.StatusServiceUnavailable
+			}
+			result.Checks[name] = healthCheck
+		}
+	}
+	if httpStatus != http.StatusOK {
+		loggerFor(r.Context()).Warn("readyz(): not ready", "status", httpStatus, "result", result)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(httpStatus)
+	json.NewEncoder(w).Encode(result)
+}
+
+// storeStarted - middleware that turns requests away with a 503 until the store is initialized.
+func storeStarted(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if state := currentReadiness(); state == readinessStarting || state == readinessMigrating {
+			w.Header().Set("Retry-After", "1")
+			writeProblem(w, r, newProblem(http.StatusServiceUnavailable, problemUnavailable, http.StatusText(http.StatusServiceUnavailable), "store is "+state))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
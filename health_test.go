@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func testHealthRequest(t *testing.T, handler http.HandlerFunc) (int, HealthResult) {
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("GET", "/", nil))
+	var result HealthResult
+	if err := json.NewDecoder(recorder.Body).Decode(&result); err != nil {
+		t.Fatalf("bad health response: %v", err)
+	}
+	return recorder.Code, result
+}
+
+// Test that readiness follows the startup and shutdown states and the dependency checks, while
+// liveness stays up throughout.
+func TestReadiness(t *testing.T) {
+	defer setReadiness(currentReadiness())
+	savedChecks := readinessChecks
+	defer func() { readinessChecks = savedChecks }()
+
+	var pingErr error
+	readinessChecks = map[string]func(ctx context.Context) error{
+		"memory": (&MemoryDB{}).Ping,
+		"other":  func(ctx context.Context) error { return pingErr },
+	}
+
+	tests := []struct {
+		state   string
+		pingErr error
+		status  int
+	}{
+		{readinessStarting, nil, http.StatusServiceUnavailable},
+		{readinessMigrating, nil, http.StatusServiceUnavailable},
+		{readinessReady, nil, http.StatusOK},
+		{readinessReady, errors.New("connection refused"), http.StatusServiceUnavailable},
+		{readinessShuttingDown, nil, http.StatusServiceUnavailable},
+	}
+	for _, test := range tests {
+		setReadiness(test.state)
+		pingErr = test.pingErr
+		status, result := testHealthRequest(t, readyz)
+		if status != test.status {
+			t.Errorf("%v (ping error %v): expected %v, got %v %+v", test.state, test.pingErr, test.status, status, result)
+		}
+		if test.state == readinessReady && (result.Checks["memory"].Status != "ok" || len(result.Checks) != 2) {
+			t.Errorf("expected every dependency to be reported, got %+v", result.Checks)
+		}
+		if test.pingErr != nil && result.Checks["other"].Reason != test.pingErr.Error() {
+			t.Errorf("expected the failed dependency's error, got %+v", result.Checks["other"])
+		}
+		if status, _ := testHealthRequest(t, healthz); status != http.StatusOK {
+			t.Errorf("%v: expected /healthz to be OK, got %v", test.state, status)
+		}
+	}
+}
+
+// Test that store backed routes are held off until the store is up.
+func TestStoreStarted(t *testing.T) {
+	defer setReadiness(currentReadiness())
+	handler := storeStarted(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for state, expected := range map[string]int{readinessStarting: http.StatusServiceUnavailable, readinessMigrating: http.StatusServiceUnavailable,
+		readinessReady: http.StatusOK, readinessShuttingDown: http.StatusOK} {
+		setReadiness(state)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/users", nil))
+		if recorder.Code != expected {
+			t.Errorf("%v: expected %v, got %v", state, expected, recorder.Code)
+		}
+	}
+}
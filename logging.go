@@ -0,0 +1,207 @@
+package main
+
+// Structured logging, with log/slog. Lines are JSON (or logfmt style text, -log-format) written to
+// stderr, stdout or a file (-log-output), at -log-level and above; the plain log package is routed
+// through the same handler, at info. Every request gets an ID - the caller's X-Request-ID if it sent
+// a sane one, otherwise a new one - which is echoed in the response, carried in the request context
+// down into the model layer, and attached to every line logged on the request's behalf.
+// Passwords, tokens and other secrets never reach the log: attributes with a sensitive name are
+// redacted, and so are the matching fields of any struct that is logged. Email addresses are masked.
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Log formats and outputs.
+const (
+	logFormatJSON   = "json"
+	logFormatText   = "text"
+	logOutputStderr = "stderr"
+	logOutputStdout = "stdout"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// what we accept as a caller supplied request ID; anything else is replaced with one of our own.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+const redacted = "[REDACTED]"
+
+// sensitiveKeys - attribute and field names, lower cased, whose values are never logged.
+var sensitiveKeys = map[string]bool{
+	"password": true, "passwd": true, "token": true, "tokenhash": true, "accesstoken": true,
+	"refreshtoken": true, "authorization": true, "secret": true, "dsn": true,
+}
+
+type requestIDContextKey struct{}
+
+// initLogging sets up the default logger from config. Until it is called we log JSON to stderr at info.
+func initLogging(config LogConfig) error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(config.Level)); err != nil {
+		return fmt.Errorf("invalid log level '%v'", config.Level)
+	}
+	var output io.Writer
+	switch config.Output {
+	case logOutputStderr, "":
+		output = os.Stderr
+	case logOutputStdout:
+		output = os.Stdout
+	default:
+		file, err := os.OpenFile(config.Output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open log file: %v", err)
+		}
+		output = file
+	}
+	slog.SetDefault(slog.New(newLogHandler(output, level, config.Format)))
+	return nil
+}
+
+// newLogHandler returns a handler writing format lines to output, redacting as it goes.
+func newLogHandler(output io.Writer, level slog.Level, format string) slog.Handler {
+	options := &slog.HandlerOptions{Level: level, ReplaceAttr: redactAttr}
+	if format == logFormatText {
+		return slog.NewTextHandler(output, options)
+	}
+	return slog.NewJSONHandler(output, options)
+}
+
+func init() {
+	slog.SetDefault(slog.New(newLogHandler(os.Stderr, slog.LevelInfo, logFormatJSON)))
+}
+
+// redactAttr - the handlers' ReplaceAttr. Blanks sensitive attributes, masks email addresses, and
+// turns logged structs into groups of their fields so the sensitive ones can be blanked too.
+func redactAttr(groups []string, attr slog.Attr) slog.Attr {
+	if sensitiveKeys[strings.ToLower(attr.Key)] {
+		if attr.Value.Kind() == slog.KindString && attr.Value.String() == "" {
+			return attr
+		}
+		return slog.String(attr.Key, redacted)
+	}
+	if strings.EqualFold(attr.Key, "email") && attr.Value.Kind() == slog.KindString {
+		return slog.String(attr.Key, maskEmail(attr.Value.String()))
+	}
+	if attr.Value.Kind() == slog.KindAny {
+		attr.Value = redactValue(attr.Value.Any())
+	}
+	return attr
+}
+
+// redactValue returns a struct as a group of its exported fields, recursively, with the sensitive
+// fields redacted. Anything else, including types that know how to print themselves, is left alone.
+func redactValue(value any) slog.Value {
+	switch value.(type) {
+	case nil, error, fmt.Stringer, json.Marshaler, encoding.TextMarshaler, time.Time:
+		return slog.AnyValue(value)
+	}
+	v := reflect.ValueOf(value)
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return slog.AnyValue(value)
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return slog.AnyValue(value)
+	}
+	var attrs []slog.Attr
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.IsExported() == false {
+			continue
+		}
+		attrs = append(attrs, redactAttr(nil, slog.Any(field.Name, v.Field(i).Interface())))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// LogValue - how a User is logged: never with its password, and with only a hint of its email.
+func (user User) LogValue() slog.Value {
+	return slog.GroupValue(slog.Int("ID", user.ID), slog.String("UserName", user.UserName),
+		slog.String("Email", maskEmail(user.Email)), slog.Int("Version", user.Version))
+}
+
+// maskEmail keeps the first character and the domain of an email address.
+func maskEmail(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 1 {
+		if email == "" {
+			return ""
+		}
+		return "***"
+	}
+	return email[:1] + "***" + email[at:]
+}
+
+// withRequestID returns ctx carrying the request ID.
+func withRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey{}, requestID)
+}
+
+// requestIDFromContext returns the ID of the request ctx belongs to, or "" outside a request.
+func requestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDContextKey{}).(string)
+	return requestID
+}
+
+// loggerFor returns the logger for work done on behalf of ctx - tagged with its request ID and
+// trace ID, if any.
+func loggerFor(ctx context.Context) *slog.Logger {
+	logger := slog.Default()
+	if requestID := requestIDFromContext(ctx); requestID != "" {
+		logger = logger.With("requestID", requestID)
+	}
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.IsValid() {
+		logger = logger.With("traceID", spanContext.TraceID().String())
+	}
+	return logger
+}
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(id)
+}
+
+// requestIDs - middleware that gives every request an ID, returns it in the X-Request-ID response
+// header and puts it in the request context, then logs the request once it has been handled.
+func requestIDs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(requestIDHeader)
+		if requestIDPattern.MatchString(requestID) == false {
+			requestID = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, requestID)
+		ctx := withRequestID(r.Context(), requestID)
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		level := slog.LevelInfo
+		if recorder.status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		loggerFor(ctx).Log(ctx, level, "request", "method", r.Method, "path", r.URL.Path,
+			"status", recorder.status, "duration", time.Since(start))
+	})
+}
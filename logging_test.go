@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Test that secrets never make it into a log line, however they are logged.
+func TestLogRedaction(t *testing.T) {
+	var output bytes.Buffer
+	logger := slog.New(newLogHandler(&output, slog.LevelDebug, logFormatJSON))
+
+	user := User{ID: 7, UserName: "Alfie", Email: "alfie@example.com", Password: "hunter2"}
+	logger.Info("user", "user", user, "userPointer", &user)
+	logger.Info("login", "login", LoginOperation{UserName: "Alfie", Password: "hunter2"})
+	logger.Info("tokens", "result", TokenOperationResult{Status: "Success", AccessToken: "access.jwt.hunter2", RefreshToken: "hunter2refresh"})
+	logger.Info("attrs", "password", "hunter2", "Authorization", "Bearer hunter2")
+	logger.Info("session", "session", Session{TokenHash: "hunter2hash", UserName: "Alfie"})
+	logger.Info("info", "result", UserOperationResult{User: user.info()})
+
+	logged := output.String()
+	if strings.Contains(logged, "hunter2") {
+		t.Errorf("secret logged:\n%v", logged)
+	}
+	if strings.Contains(logged, "alfie@example.com") || strings.Contains(logged, `a***@example.com`) == false {
+		t.Errorf("expected the email to be masked:\n%v", logged)
+	}
+	for _, expected := range []string{`"UserName":"Alfie"`, `"Status":"Success"`, redacted} {
+		if strings.Contains(logged, expected) == false {
+			t.Errorf("expected %v in:\n%v", expected, logged)
+		}
+	}
+}
+
+// Test that a caller's request ID is kept and one is made up otherwise, and that the ID reaches the
+// handler's context and the log lines written on its behalf.
+func TestRequestIDs(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	var output bytes.Buffer
+	slog.SetDefault(slog.New(newLogHandler(&output, slog.LevelInfo, logFormatJSON)))
+
+	var seen string
+	handler := requestIDs(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestIDFromContext(r.Context())
+		loggerFor(r.Context()).Info("handled")
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	tests := []struct {
+		supplied string
+		kept     bool
+	}{
+		{"abc-123", true},
+		{"", false},
+		{"not a valid id\n", false},
+		{strings.Repeat("x", 200), false},
+	}
+	for _, test := range tests {
+		output.Reset()
+		request := httptest.NewRequest("GET", "/users", nil)
+		if test.supplied != "" {
+			request.Header.Set(requestIDHeader, test.supplied)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+
+		returned := recorder.Header().Get(requestIDHeader)
+		if returned == "" || returned != seen {
+			t.Errorf("'%v': expected the response ID '%v' to be the one the handler saw, '%v'", test.supplied, returned, seen)
+		}
+		if (returned == test.supplied) != test.kept {
+			t.Errorf("'%v': expected kept %v, got '%v'", test.supplied, test.kept, returned)
+		}
+		if strings.Count(output.String(), `"requestID":"`+returned+`"`) != 2 || strings.Contains(output.String(), `"status":418`) == false {
+			t.Errorf("'%v': expected the handler's and the request's log lines to carry the ID:\n%v", test.supplied, output.String())
+		}
+	}
+}
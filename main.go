@@ -1,8 +1,51 @@
 package main
 
-import "log"
+import (
+	"errors"
+	"flag"
+	"log"
+	"os"
+)
 
 func main() {
+	// settings come from defaults, an optional config file, the environment and flags - see config.go.
+	config, args, err := loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	if err = initLogging(config.Log); err != nil {
+		log.Fatal(err)
+	}
+	if err = initTracing(config.Tracing); err != nil {
+		log.Fatal(err)
+	}
+
+	if selectPasswordHash(config.PasswordHash) == false {
+		log.Fatalf("Unsupported password hash '%v'", config.PasswordHash)
+	}
+	sessionTTL = config.SessionTTL
+	uniqueEmails = config.UniqueEmails
+	storeTimeout, storeOperationTimeouts = config.StoreTimeout, config.StoreOperationTimeouts
+	maxRequestBodyBytes = config.HTTP.MaxBodyBytes
+	if config.Token.Algorithm != "" && initTokenService(config.Token.Algorithm, config.Token.KeyFile, config.Token.Issuer, config.Token.AccessTTL, config.Token.RefreshTTL) == false {
+		log.Fatalf("Failed to set up %v token service", config.Token.Algorithm)
+	}
+
+	// "endpoint [flags] migrate ..." runs schema migrations and exits, rather than serving.
+	if len(args) > 0 && args[0] == "migrate" {
+		if selectUserStore(config) == false {
+			log.Fatalf("Unsupported store '%v'", config.Store)
+		}
+		ok := runMigrateCommand(args[1:])
+		releaseDB()
+		if ok == false {
+			os.Exit(1)
+		}
+		return
+	}
+
 	log.Println("endpoint server started")
-	createEendpointsAndRun()
+	createEendpointsAndRun(config)
 }
@@ -0,0 +1,115 @@
+package main
+
+// Prometheus metrics, served at /metrics:
+//   endpoint_http_requests_total, endpoint_http_request_duration_seconds - per route, method and status
+//   endpoint_model_operations_total - per store operation and the ModelStatusCode it returned
+//   endpoint_model_operation_duration_seconds - store latency, per operation
+//   go_sql_* - the mySQL connection pool (open, idle, in use, waits)
+// plus the usual Go runtime and process metrics.
+// go get -u github.com/prometheus/client_golang
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "endpoint_http_requests_total",
+		Help: "HTTP requests handled, by route, method and status.",
+	}, []string{"route", "method", "status"})
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "endpoint_http_request_duration_seconds",
+		Help:    "HTTP request latency, by route, method and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+	modelOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "endpoint_model_operations_total",
+		Help: "User store operations, by operation and model status.",
+	}, []string{"operation", "status"})
+	modelOperationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "endpoint_model_operation_duration_seconds",
+		Help:    "User store operation latency, by operation.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(httpRequests, httpRequestDuration, modelOperations, modelOperationDuration,
+		collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+}
+
+// metricsHandler - GET -> "/metrics"
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+var dbStatsCollector prometheus.Collector
+
+// pooledStore - a store backed by a sql.DB, whose connection pool stats are worth publishing.
+type pooledStore interface {
+	connectionPool() (db *sql.DB, dbName string)
+}
+
+// registerDBStats publishes the connection pool stats for db, replacing those of any earlier connection.
+func registerDBStats(db *sql.DB, dbName string) {
+	if dbStatsCollector != nil {
+		metricsRegistry.Unregister(dbStatsCollector)
+	}
+	dbStatsCollector = collectors.NewDBStatsCollector(db, dbName)
+	if err := metricsRegistry.Register(dbStatsCollector); err != nil {
+		log.Printf("registerDBStats(): %v", err)
+	}
+}
+
+// statusRecorder - a ResponseWriter that remembers the status written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	recorder.status = status
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+// instrumentRequests - middleware that counts and times every routed request. The route label is
+// the route's path template, so /users/{userName} is one series rather than one per user.
+func instrumentRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		route := routeTemplate(r)
+		status := strconv.Itoa(recorder.status)
+		httpRequests.WithLabelValues(route, r.Method, status).Inc()
+		httpRequestDuration.WithLabelValues(route, r.Method, status).Observe(time.Since(start).Seconds())
+	})
+}
+
+// routeTemplate returns the path template of the route r matched, e.g. /users/{userName}.
+func routeTemplate(r *http.Request) string {
+	if current := mux.CurrentRoute(r); current != nil {
+		if template, err := current.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return "unknown"
+}
+
+// observeModel records the outcome and latency of a store operation.
+func observeModel(operation string, start time.Time, retCode ModelStatusCode) {
+	modelOperations.WithLabelValues(operation, ModelStatusText(retCode)).Inc()
+	modelOperationDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// Test that requests are counted under their route template and the status actually written.
+func TestInstrumentRequests(t *testing.T) {
+	router := mux.NewRouter()
+	router.Use(instrumentRequests)
+	router.HandleFunc("/users/{userName}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}).Methods("GET")
+	router.HandleFunc("/users", func(w http.ResponseWriter, r *http.Request) {}).Methods("GET")
+
+	notFound := httpRequests.WithLabelValues("/users/{userName}", "GET", "404")
+	ok := httpRequests.WithLabelValues("/users", "GET", "200")
+	notFoundBefore, okBefore := testutil.ToFloat64(notFound), testutil.ToFloat64(ok)
+	for _, path := range []string{"/users/alice", "/users/bob", "/users"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	if got := testutil.ToFloat64(notFound) - notFoundBefore; got != 2 {
+		t.Errorf("expected 2 requests to /users/{userName} counted as 404, got %v", got)
+	}
+	if got := testutil.ToFloat64(ok) - okBefore; got != 1 {
+		t.Errorf("expected 1 request to /users counted as 200, got %v", got)
+	}
+
+	recorder := httptest.NewRecorder()
+	metricsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if body := recorder.Body.String(); strings.Contains(body, `endpoint_http_request_duration_seconds_count{method="GET",route="/users/{userName}",status="404"}`) == false {
+		t.Errorf("expected the latency histogram in /metrics, got:\n%v", body)
+	}
+}
+
+// Test that store operations are counted by the model status they return.
+func TestInstrumentStore(t *testing.T) {
+	store := instrumentStore(&MemoryDB{})
+	store.InitDB()
+	defer store.ReleaseDB()
+
+	created := modelOperations.WithLabelValues("CreateUser", ModelStatusText(ModelSuccess))
+	notFound := modelOperations.WithLabelValues("GetUser", ModelStatusText(ModelDBUserNotFound))
+	createdBefore, notFoundBefore := testutil.ToFloat64(created), testutil.ToFloat64(notFound)
+
+	store.CreateUser(context.Background(), User{UserName: "metrics", Email: "metrics@example.com", Password: "hashed"})
+	store.GetUser(context.Background(), "nobody")
+	store.GetUser(context.Background(), "nobody")
+	if got := testutil.ToFloat64(created) - createdBefore; got != 1 {
+		t.Errorf("expected 1 successful CreateUser, got %v", got)
+	}
+	if got := testutil.ToFloat64(notFound) - notFoundBefore; got != 2 {
+		t.Errorf("expected 2 GetUser not found, got %v", got)
+	}
+}
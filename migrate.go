@@ -0,0 +1,404 @@
+package main
+
+// Versioned schema migrations. Each backend with a schema keeps numbered SQL files under
+// migrations/<backend>/, embedded in the binary:
+//   0001_create_users.up.sql    applied going up
+//   0001_create_users.down.sql  undoes it
+// Table names come from the store's config, so the files refer to them as {{users}}, {{sessions}}
+// and {{refresh_tokens}}. Applied versions are recorded in a table of their own - schema_migrations
+// unless configured otherwise, so deployments sharing a schema can each keep their own history - and
+// the runner holds a lock named for that table while it works so two instances starting together
+// don't both migrate.
+// Migrations run from initDB on startup, or on their own with "endpoint migrate up|down|status".
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+// Migration directions, as passed to SchemaMigrator.Migrate.
+const (
+	migrateUp   = "up"
+	migrateDown = "down"
+)
+
+// how long to wait for another instance to finish migrating before giving up.
+const migrationLockTimeout = 60 * time.Second
+
+// the table applied versions are recorded in, when none is configured.
+const defaultMigrationsTable = "schema_migrations"
+
+// SchemaMigrator - implemented by backends with a versioned schema.
+type SchemaMigrator interface {
+	// Migrate applies (up) or reverts (down) steps migrations. 0 steps going up means all pending.
+	Migrate(direction string, steps int) bool
+	MigrationStatus() ([]MigrationState, bool)
+}
+
+// Migration - one numbered schema change, with table names already filled in.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationState - a migration and whether it has been applied.
+type MigrationState struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// migrationDialect - the backend specific SQL the runner needs. The statements are formatted with
+// the name of the versions table; the locks are given it to name themselves after.
+type migrationDialect struct {
+	dir                string // under migrations/
+	createVersionTable string
+	selectVersions     string
+	insertVersion      string
+	deleteVersion      string
+	lock               func(ctx context.Context, conn *sql.Conn, versionTable string) error
+	unlock             func(ctx context.Context, conn *sql.Conn, versionTable string) error
+}
+
+var mysqlMigrationDialect = migrationDialect{
+	dir:                "migrations/mysql",
+	createVersionTable: "CREATE TABLE IF NOT EXISTS %v (Version bigint NOT NULL, Name varchar(255) NOT NULL, AppliedAt bigint NOT NULL, PRIMARY KEY (Version))",
+	selectVersions:     "SELECT Version, AppliedAt from %v",
+	insertVersion:      "INSERT into %v (Version, Name, AppliedAt) VALUES ( ?, ?, ? )",
+	deleteVersion:      "DELETE from %v where Version = ?",
+	// GET_LOCK is server wide, so the lock is named for the database we are migrating.
+	lock: func(ctx context.Context, conn *sql.Conn, versionTable string) error {
+		var acquired sql.NullInt64
+		err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(CONCAT(DATABASE(), '.', ?), ?)", versionTable, int(migrationLockTimeout/time.Second)).Scan(&acquired)
+		if err == nil && acquired.Int64 != 1 {
+			err = fmt.Errorf("timed out after %v waiting for the migration lock", migrationLockTimeout)
+		}
+		return err
+	},
+	unlock: func(ctx context.Context, conn *sql.Conn, versionTable string) error {
+		_, err := conn.ExecContext(ctx, "SELECT RELEASE_LOCK(CONCAT(DATABASE(), '.', ?))", versionTable)
+		return err
+	},
+}
+
+// SQLite locks the whole database for writing, so the lock is a write transaction held while we
+// migrate. As on mySQL, where DDL commits as it goes, a failed migration keeps what it got done.
+var sqliteMigrationDialect = migrationDialect{
+	dir:                "migrations/sqlite",
+	createVersionTable: mysqlMigrationDialect.createVersionTable,
+	selectVersions:     mysqlMigrationDialect.selectVersions,
+	insertVersion:      mysqlMigrationDialect.insertVersion,
+	deleteVersion:      mysqlMigrationDialect.deleteVersion,
+	lock: func(ctx context.Context, conn *sql.Conn, versionTable string) error {
+		if _, err := conn.ExecContext(ctx, fmt.Sprintf("PRAGMA busy_timeout = %d", migrationLockTimeout.Milliseconds())); err != nil {
+			return err
+		}
+		_, err := conn.ExecContext(ctx, "BEGIN IMMEDIATE")
+		return err
+	},
+	unlock: func(ctx context.Context, conn *sql.Conn, versionTable string) error {
+		_, err := conn.ExecContext(ctx, "COMMIT")
+		return err
+	},
+}
+
+// Postgres advisory locks are per database, held by the session that takes them. Waiting for one
+// has no timeout of its own, so the wait is bounded by the context instead.
+var postgresMigrationDialect = migrationDialect{
+	dir:                "migrations/postgres",
+	createVersionTable: mysqlMigrationDialect.createVersionTable,
+	selectVersions:     mysqlMigrationDialect.selectVersions,
+	insertVersion:      "INSERT into %v (Version, Name, AppliedAt) VALUES ( $1, $2, $3 )",
+	deleteVersion:      "DELETE from %v where Version = $1",
+	lock: func(ctx context.Context, conn *sql.Conn, versionTable string) error {
+		lockCtx, cancel := context.WithTimeout(ctx, migrationLockTimeout)
+		defer cancel()
+		_, err := conn.ExecContext(lockCtx, "SELECT pg_advisory_lock(hashtext($1))", versionTable)
+		if err != nil && lockCtx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("timed out after %v waiting for the migration lock", migrationLockTimeout)
+		}
+		return err
+	},
+	unlock: func(ctx context.Context, conn *sql.Conn, versionTable string) error {
+		_, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock(hashtext($1))", versionTable)
+		return err
+	},
+}
+
+var migrationFilePattern = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// loadMigrations reads the migrations in dir, in version order, substituting the table names.
+// Every migration must have an up file; a missing down file only matters when reverting it.
+func loadMigrations(dir string, tables map[string]string) ([]Migration, error) {
+	entries, err := migrationFiles.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var replacements []string
+	for placeholder, tableName := range tables {
+		replacements = append(replacements, "{{"+placeholder+"}}", tableName)
+	}
+	replacer := strings.NewReplacer(replacements...)
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		match := migrationFilePattern.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("unexpected file '%v' in %v", entry.Name(), dir)
+		}
+		version, _ := strconv.Atoi(match[1])
+		migration, exists := byVersion[version]
+		if exists == false {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		} else if migration.Name != match[2] {
+			return nil, fmt.Errorf("migration %v is named both '%v' and '%v'", version, migration.Name, match[2])
+		}
+		body, err := migrationFiles.ReadFile(path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		text := replacer.Replace(string(body))
+		if strings.Contains(text, "{{") {
+			return nil, fmt.Errorf("migration '%v' refers to an unknown table", entry.Name())
+		}
+		if match[3] == migrateUp {
+			migration.Up = text
+		} else {
+			migration.Down = text
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" {
+			return nil, fmt.Errorf("migration %v_%v has no up file", migration.Version, migration.Name)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// splitStatements breaks a migration into single statements - a statement ends with a ';' at the
+// end of a line - dropping "--" comment lines. Drivers don't agree on multi statement support.
+func splitStatements(migration string) []string {
+	var statements []string
+	var current []string
+	for _, line := range strings.Split(migration, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		current = append(current, line)
+		if strings.HasSuffix(trimmed, ";") {
+			statements = append(statements, strings.TrimSuffix(strings.TrimSpace(strings.Join(current, "\n")), ";"))
+			current = nil
+		}
+	}
+	if len(current) > 0 {
+		statements = append(statements, strings.TrimSpace(strings.Join(current, "\n")))
+	}
+	return statements
+}
+
+// Migrator - runs one backend's migrations against a database, recording them in versionTable.
+type Migrator struct {
+	db           *sql.DB
+	dialect      migrationDialect
+	versionTable string
+	tables       map[string]string
+}
+
+func newMigrator(db *sql.DB, dialect migrationDialect, versionTable string, tables map[string]string) *Migrator {
+	return &Migrator{db: db, dialect: dialect, versionTable: versionTable, tables: tables}
+}
+
+// withLock runs fn on a single connection holding the migration lock. Everything happens on that
+// one connection, since the lock - and session state the migrations may set - belong to it.
+func (migrator *Migrator) withLock(ctx context.Context, fn func(conn *sql.Conn, migrations []Migration, applied map[int]time.Time) error) error {
+	migrations, err := loadMigrations(migrator.dialect.dir, migrator.tables)
+	if err != nil {
+		return err
+	}
+	conn, err := migrator.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err = migrator.dialect.lock(ctx, conn, migrator.versionTable); err != nil {
+		return fmt.Errorf("failed to take the migration lock: %v", err)
+	}
+	defer func() {
+		if err := migrator.dialect.unlock(ctx, conn, migrator.versionTable); err != nil {
+			log.Printf("Migrator.withLock(): failed to release the migration lock: %v", err)
+		}
+	}()
+
+	if _, err = conn.ExecContext(ctx, fmt.Sprintf(migrator.dialect.createVersionTable, migrator.versionTable)); err != nil {
+		return fmt.Errorf("failed to create %v: %v", migrator.versionTable, err)
+	}
+	applied, err := migrator.appliedVersions(ctx, conn)
+	if err != nil {
+		return err
+	}
+	return fn(conn, migrations, applied)
+}
+
+func (migrator *Migrator) appliedVersions(ctx context.Context, conn *sql.Conn) (map[int]time.Time, error) {
+	rows, err := conn.QueryContext(ctx, fmt.Sprintf(migrator.dialect.selectVersions, migrator.versionTable))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %v: %v", migrator.versionTable, err)
+	}
+	defer rows.Close()
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt int64
+		if err = rows.Scan(&version, &appliedAt); err != nil {
+			return nil, fmt.Errorf("failed to read %v: %v", migrator.versionTable, err)
+		}
+		applied[version] = time.Unix(appliedAt, 0).UTC()
+	}
+	return applied, rows.Err()
+}
+
+// run executes one direction of a migration, statement by statement, then records it.
+func (migrator *Migrator) run(ctx context.Context, conn *sql.Conn, migration Migration, direction string) error {
+	text := migration.Up
+	if direction == migrateDown {
+		text = migration.Down
+		if text == "" {
+			return fmt.Errorf("migration %04d_%v has no down file", migration.Version, migration.Name)
+		}
+	}
+	log.Printf("Migrator.run(): %v %04d_%v", direction, migration.Version, migration.Name)
+	for _, statement := range splitStatements(text) {
+		if _, err := conn.ExecContext(ctx, statement); err != nil {
+			return fmt.Errorf("migration %04d_%v %v failed: %v\n%v", migration.Version, migration.Name, direction, err, statement)
+		}
+	}
+
+	var err error
+	if direction == migrateUp {
+		_, err = conn.ExecContext(ctx, fmt.Sprintf(migrator.dialect.insertVersion, migrator.versionTable), migration.Version, migration.Name, time.Now().Unix())
+	} else {
+		_, err = conn.ExecContext(ctx, fmt.Sprintf(migrator.dialect.deleteVersion, migrator.versionTable), migration.Version)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to record migration %04d_%v: %v", migration.Version, migration.Name, err)
+	}
+	return nil
+}
+
+// Up applies up to steps pending migrations in version order, or all of them for 0 steps.
+func (migrator *Migrator) Up(ctx context.Context, steps int) error {
+	return migrator.withLock(ctx, func(conn *sql.Conn, migrations []Migration, applied map[int]time.Time) error {
+		count := 0
+		for _, migration := range migrations {
+			if _, done := applied[migration.Version]; done {
+				continue
+			}
+			if steps > 0 && count == steps {
+				break
+			}
+			if err := migrator.run(ctx, conn, migration, migrateUp); err != nil {
+				return err
+			}
+			count++
+		}
+		log.Printf("Migrator.Up(): applied %v migrations", count)
+		return nil
+	})
+}
+
+// Down reverts the steps most recently applied migrations.
+func (migrator *Migrator) Down(ctx context.Context, steps int) error {
+	return migrator.withLock(ctx, func(conn *sql.Conn, migrations []Migration, applied map[int]time.Time) error {
+		count := 0
+		for i := len(migrations) - 1; i >= 0 && count < steps; i-- {
+			if _, done := applied[migrations[i].Version]; done == false {
+				continue
+			}
+			if err := migrator.run(ctx, conn, migrations[i], migrateDown); err != nil {
+				return err
+			}
+			count++
+		}
+		log.Printf("Migrator.Down(): reverted %v migrations", count)
+		return nil
+	})
+}
+
+// Status lists every known migration and whether it has been applied.
+func (migrator *Migrator) Status(ctx context.Context) ([]MigrationState, error) {
+	var states []MigrationState
+	err := migrator.withLock(ctx, func(conn *sql.Conn, migrations []Migration, applied map[int]time.Time) error {
+		for _, migration := range migrations {
+			appliedAt, done := applied[migration.Version]
+			states = append(states, MigrationState{Migration: migration, Applied: done, AppliedAt: appliedAt})
+		}
+		return nil
+	})
+	return states, err
+}
+
+// runMigrateCommand handles "endpoint migrate up [steps] | down [steps] | status" against the
+// selected store. Returns false on failure.
+func runMigrateCommand(args []string) bool {
+	migrator, ok := userStore.(SchemaMigrator)
+	if ok == false {
+		log.Println("runMigrateCommand(): the selected store has no schema to migrate")
+		return false
+	}
+	if len(args) < 1 || len(args) > 2 {
+		log.Println("runMigrateCommand(): usage: endpoint migrate up [steps] | down [steps] | status")
+		return false
+	}
+	steps := 0
+	if args[0] == migrateDown {
+		steps = 1
+	}
+	if len(args) == 2 {
+		var err error
+		if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+			log.Printf("runMigrateCommand(): invalid step count '%v'", args[1])
+			return false
+		}
+	}
+
+	switch args[0] {
+	case migrateUp, migrateDown:
+		return migrator.Migrate(args[0], steps)
+	case "status":
+		states, ok := migrator.MigrationStatus()
+		if ok == false {
+			return false
+		}
+		for _, state := range states {
+			status := "pending"
+			if state.Applied {
+				status = "applied " + state.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%-30v %v\n", state.Version, state.Name, status)
+		}
+		return true
+	}
+	log.Printf("runMigrateCommand(): unknown migrate command '%v'", args[0])
+	return false
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// Test that each backend's embedded migrations load, are numbered without gaps, can all be
+// reverted, and have every table name filled in.
+func TestLoadMigrations(t *testing.T) {
+	tables := map[string]string{"users": "usersTest", "sessions": "userSessions", "refresh_tokens": "userRefreshTokens"}
+	for _, dialect := range []migrationDialect{mysqlMigrationDialect, postgresMigrationDialect, sqliteMigrationDialect} {
+		migrations, err := loadMigrations(dialect.dir, tables)
+		if err != nil {
+			t.Fatalf("failed to load %v: %v", dialect.dir, err)
+		}
+		if len(migrations) == 0 {
+			t.Fatalf("no migrations found in %v", dialect.dir)
+		}
+		for i, migration := range migrations {
+			if migration.Version != i+1 {
+				t.Errorf("%v: expected migration %v, got %v_%v", dialect.dir, i+1, migration.Version, migration.Name)
+			}
+			if migration.Down == "" {
+				t.Errorf("%v: migration %v_%v has no down file", dialect.dir, migration.Version, migration.Name)
+			}
+			if strings.Contains(migration.Up+migration.Down, "{{") {
+				t.Errorf("%v: migration %v_%v has an unfilled table name", dialect.dir, migration.Version, migration.Name)
+			}
+		}
+		if strings.Contains(migrations[0].Up, "usersTest") == false {
+			t.Errorf("%v: expected the users table name in the first migration, got %v", dialect.dir, migrations[0].Up)
+		}
+	}
+
+	// a placeholder we were not given is an error, not a silently broken statement.
+	if _, err := loadMigrations(mysqlMigrationDialect.dir, map[string]string{"users": "usersTest"}); err == nil {
+		t.Error("expected an error for a missing table name")
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	migration := `-- a comment
+CREATE TABLE a (
+    ID int
+);
+
+SET @x = 'a;b';
+SELECT 1`
+	statements := splitStatements(migration)
+	expected := []string{"CREATE TABLE a (\n    ID int\n)", "SET @x = 'a;b'", "SELECT 1"}
+	if len(statements) != len(expected) {
+		t.Fatalf("expected %v statements, got %v: %q", len(expected), len(statements), statements)
+	}
+	for i := range expected {
+		if statements[i] != expected[i] {
+			t.Errorf("statement %v: expected %q, got %q", i, expected[i], statements[i])
+		}
+	}
+}
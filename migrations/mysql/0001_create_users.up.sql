@@ -0,0 +1,9 @@
+-- The users table as it has always been created. IF NOT EXISTS so databases that predate
+-- migrations pick up from here without losing anything.
+CREATE TABLE IF NOT EXISTS {{users}} (
+    ID int NOT NULL AUTO_INCREMENT,
+    UserName varchar(255) NOT NULL UNIQUE,
+    email varchar(255),
+    password varchar(255),
+    PRIMARY KEY (ID)
+) CHARACTER SET utf8mb4;
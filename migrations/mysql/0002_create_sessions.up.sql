@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS {{sessions}} (
+    Token char(64) NOT NULL,
+    UserName varchar(255) NOT NULL,
+    Expires bigint NOT NULL,
+    PRIMARY KEY (Token),
+    INDEX (UserName)
+) CHARACTER SET utf8mb4;
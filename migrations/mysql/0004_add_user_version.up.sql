@@ -0,0 +1,10 @@
+-- Record versions for ETags. mySQL has no ADD COLUMN IF NOT EXISTS, and tables created by the
+-- startup check before migrations may already have the column, so only add it when missing.
+SET @add_version = IF(
+    (SELECT COUNT(*) FROM information_schema.COLUMNS
+        WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = '{{users}}' AND COLUMN_NAME = 'Version') = 0,
+    'ALTER TABLE {{users}} ADD COLUMN Version int NOT NULL DEFAULT 1',
+    'SELECT 1');
+PREPARE add_version FROM @add_version;
+EXECUTE add_version;
+DEALLOCATE PREPARE add_version;
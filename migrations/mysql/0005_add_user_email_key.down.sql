@@ -0,0 +1 @@
+ALTER TABLE {{users}} DROP INDEX EmailKey, DROP COLUMN EmailKey;
@@ -0,0 +1,6 @@
+-- The normalized email, for -unique-emails. It is only filled in while that is on; NULLs never
+-- collide, so with it off the index constrains nothing. Compared byte for byte, as the server
+-- does the normalizing - the table's default collation would also fold accents.
+ALTER TABLE {{users}}
+    ADD COLUMN EmailKey varchar(255) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin NULL,
+    ADD UNIQUE INDEX EmailKey (EmailKey);
@@ -0,0 +1,11 @@
+-- The users table. Postgres folds unquoted names to lower case, the same way everywhere, so the
+-- mixed case names the model uses still work. User names are compared exactly here; 0004 makes
+-- them compare ignoring case, as mySQL's collation does. EmailKey is for -unique-emails.
+CREATE TABLE IF NOT EXISTS {{users}} (
+    ID integer GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    UserName varchar(255) NOT NULL UNIQUE,
+    Email varchar(255),
+    Password varchar(255),
+    Version int NOT NULL DEFAULT 1,
+    EmailKey varchar(255) NULL UNIQUE
+);
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS {{refresh_tokens}} (
+    Token char(64) NOT NULL PRIMARY KEY,
+    UserName varchar(255) NOT NULL,
+    Expires bigint NOT NULL
+);
+CREATE INDEX IF NOT EXISTS {{refresh_tokens}}_UserName ON {{refresh_tokens}} (UserName);
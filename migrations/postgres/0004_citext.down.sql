@@ -0,0 +1,4 @@
+-- The extension is left in place; something else may be using it.
+ALTER TABLE {{refresh_tokens}} ALTER COLUMN UserName TYPE varchar(255);
+ALTER TABLE {{sessions}} ALTER COLUMN UserName TYPE varchar(255);
+ALTER TABLE {{users}} ALTER COLUMN UserName TYPE varchar(255), ALTER COLUMN Email TYPE varchar(255);
@@ -0,0 +1,10 @@
+-- Compare user names and emails ignoring case, as mySQL's collation and SQLite's NOCASE do:
+-- citext columns compare, sort and match LIKE ignoring case, so user names become unique ignoring
+-- case and lookups find a user whatever case the name is given in. Sessions and refresh tokens
+-- are found by user name too. This fails if existing user names differ only in case; rename one
+-- of each pair first. citext is a trusted extension from PostgreSQL 13, so any user that can
+-- create in the database may add it.
+CREATE EXTENSION IF NOT EXISTS citext;
+ALTER TABLE {{users}} ALTER COLUMN UserName TYPE citext, ALTER COLUMN Email TYPE citext;
+ALTER TABLE {{sessions}} ALTER COLUMN UserName TYPE citext;
+ALTER TABLE {{refresh_tokens}} ALTER COLUMN UserName TYPE citext;
@@ -0,0 +1,11 @@
+-- The users table with the same rules as on mySQL: IDs count up and are never reused, user names
+-- are unique ignoring case, and EmailKey is there for -unique-emails (see the mySQL migrations).
+-- NOCASE only folds ASCII, where mySQL's collation folds everything.
+CREATE TABLE IF NOT EXISTS {{users}} (
+    ID integer PRIMARY KEY AUTOINCREMENT,
+    UserName varchar(255) NOT NULL COLLATE NOCASE UNIQUE,
+    Email varchar(255) COLLATE NOCASE,
+    Password varchar(255),
+    Version int NOT NULL DEFAULT 1,
+    EmailKey varchar(255) NULL UNIQUE
+);
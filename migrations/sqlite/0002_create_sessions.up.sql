@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS {{sessions}} (
+    Token char(64) NOT NULL PRIMARY KEY,
+    UserName varchar(255) NOT NULL COLLATE NOCASE,
+    Expires bigint NOT NULL
+);
+CREATE INDEX IF NOT EXISTS {{sessions}}_UserName ON {{sessions}} (UserName);
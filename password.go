@@ -0,0 +1,131 @@
+package main
+
+// Password hashing. Passwords are never stored in the clear - the model stores an encoded hash
+// that carries its own algorithm and parameters as a prefix, so we can tell on a successful
+// login whether the stored hash should be upgraded to the currently configured algorithm.
+//   bcrypt:   $2a$<cost>$<salt+hash>
+//   argon2id: $argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<hash>
+// go get -u golang.org/x/crypto
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Supported password hash algorithms, as passed to selectPasswordHash.
+const (
+	hashBcrypt   = "bcrypt"
+	hashArgon2id = "argon2id"
+)
+
+// argon2Params - tuning parameters for argon2id, these are encoded into every hash.
+type argon2Params struct {
+	memory  uint32 // KiB
+	time    uint32
+	threads uint8
+	saltLen uint32
+	keyLen  uint32
+}
+
+var (
+	passwordHashAlgorithm = hashBcrypt
+	bcryptCost            = bcrypt.DefaultCost
+	argon2Config          = argon2Params{memory: 64 * 1024, time: 1, threads: 4, saltLen: 16, keyLen: 32}
+)
+
+// selectPasswordHash sets the algorithm used for new hashes. Returns false for an unknown algorithm.
+func selectPasswordHash(algorithm string) bool {
+	switch algorithm {
+	case hashBcrypt, hashArgon2id:
+		passwordHashAlgorithm = algorithm
+	default:
+		log.Printf("selectPasswordHash(): unknown password hash algorithm '%v'", algorithm)
+		return false
+	}
+	log.Printf("selectPasswordHash(): using %v", algorithm)
+	return true
+}
+
+// hashPassword encodes password with the configured algorithm.
+func hashPassword(password string) (string, error) {
+	switch passwordHashAlgorithm {
+	case hashArgon2id:
+		return hashArgon2(password, argon2Config)
+	default:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+		return string(hash), err
+	}
+}
+
+func hashArgon2(password string, params argon2Params) (string, error) {
+	salt := make([]byte, params.saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, params.keyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, params.memory, params.time, params.threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// decodeArgon2 splits an encoded argon2id hash back into its parameters, salt and key.
+func decodeArgon2(encoded string) (argon2Params, []byte, []byte, error) {
+	var params argon2Params
+	var version int
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != hashArgon2id {
+		return params, nil, nil, fmt.Errorf("not an argon2id hash")
+	}
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2 version '%v'", parts[2])
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads); err != nil {
+		return params, nil, nil, fmt.Errorf("bad argon2 parameters '%v': %v", parts[3], err)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("bad argon2 salt: %v", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("bad argon2 key: %v", err)
+	}
+	params.saltLen = uint32(len(salt))
+	params.keyLen = uint32(len(key))
+	return params, salt, key, nil
+}
+
+// checkPassword compares password against an encoded hash. The second return is true when the
+// password matched but the hash is not in the currently configured algorithm/parameters, and so
+// should be replaced. Anything without a recognised prefix is treated as a legacy plain text
+// password, which always needs a rehash.
+func checkPassword(encoded string, password string) (bool, bool) {
+	switch {
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		params, salt, key, err := decodeArgon2(encoded)
+		if err != nil {
+			log.Printf("checkPassword(): %v", err)
+			return false, false
+		}
+		candidate := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, params.keyLen)
+		if subtle.ConstantTimeCompare(key, candidate) != 1 {
+			return false, false
+		}
+		return true, passwordHashAlgorithm != hashArgon2id || params != argon2Config
+	case strings.HasPrefix(encoded, "$2a$"), strings.HasPrefix(encoded, "$2b$"), strings.HasPrefix(encoded, "$2y$"):
+		if bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password)) != nil {
+			return false, false
+		}
+		cost, err := bcrypt.Cost([]byte(encoded))
+		return true, passwordHashAlgorithm != hashBcrypt || err != nil || cost != bcryptCost
+	default:
+		matched := subtle.ConstantTimeCompare([]byte(encoded), []byte(password)) == 1
+		return matched, matched
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// Hash and verify with each algorithm, and check the rehash flag follows the configured algorithm.
+func TestPasswordHashing(t *testing.T) {
+	defer selectPasswordHash(passwordHashAlgorithm)
+	defer func(cost int) { bcryptCost = cost }(bcryptCost)
+	bcryptCost = 4 // keep the test quick
+
+	for _, algorithm := range []string{hashBcrypt, hashArgon2id} {
+		if selectPasswordHash(algorithm) == false {
+			t.Fatalf("    failed to select %v", algorithm)
+		}
+		hash, err := hashPassword("pass'word")
+		if err != nil {
+			t.Fatalf("    %v: hash failed: %v", algorithm, err)
+		}
+		if strings.Contains(hash, "pass'word") {
+			t.Errorf("    %v: hash contains the plain text: %v", algorithm, hash)
+		}
+		if matched, needsRehash := checkPassword(hash, "pass'word"); matched == false || needsRehash == true {
+			t.Errorf("    %v: expected match without rehash, got %v/%v", algorithm, matched, needsRehash)
+		}
+		if matched, _ := checkPassword(hash, "wrong"); matched == true {
+			t.Errorf("    %v: wrong password matched", algorithm)
+		}
+	}
+
+	// a bcrypt hash verified while argon2id is configured should be flagged for upgrade.
+	selectPasswordHash(hashBcrypt)
+	hash, _ := hashPassword("secret")
+	selectPasswordHash(hashArgon2id)
+	if matched, needsRehash := checkPassword(hash, "secret"); matched == false || needsRehash == false {
+		t.Errorf("    expected bcrypt hash to match and need rehash, got %v/%v", matched, needsRehash)
+	}
+
+	// legacy plain text rows match once, and always need a rehash.
+	if matched, needsRehash := checkPassword("secret", "secret"); matched == false || needsRehash == false {
+		t.Errorf("    expected plain text to match and need rehash, got %v/%v", matched, needsRehash)
+	}
+	if matched, _ := checkPassword("$argon2id$garbage", "$argon2id$garbage"); matched == true {
+		t.Error("    malformed hash matched")
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+// Error responses. Every failure - a model status code, a request we can't read, a session we
+// don't recognise, a route that doesn't exist - is answered the same way, as RFC 7807 problem
+// details (Content-Type application/problem+json): the HTTP status, a Title, a Detail for humans,
+// and a stable Code for programs to switch on. Bad input also lists what is wrong with each field
+// in Errors. Successful responses are unchanged.
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+const problemContentType = "application/problem+json"
+
+// problemTypePrefix - a problem's type URI is this followed by its code.
+const problemTypePrefix = "urn:endpoint:problem:"
+
+// Problem codes for failures that don't come from the model.
+const (
+	problemUnreadableBody   = "unreadable-body"
+	problemUserNameMismatch = "user-name-mismatch"
+	problemUnsupportedMedia = "unsupported-media-type"
+	problemUnavailable      = "service-unavailable"
+	problemNotFound         = "not-found"
+	problemMethodNotAllowed = "method-not-allowed"
+	problemInternal         = "internal-error"
+)
+
+// modelProblemCodes - the problem code for each failed model status code. These are part of the
+// API; add to them, but don't change them.
+var modelProblemCodes = map[ModelStatusCode]string{
+	ModelDBCreateFailure:    "user-create-failed",
+	ModelDBGetFailure:       "user-get-failed",
+	ModelDBUserNotFound:     "user-not-found",
+	ModelDBUpdateFailure:    "user-update-failed",
+	ModelDBDeleteFailure:    "user-delete-failed",
+	ModelInvalidCredentials: "invalid-credentials",
+	ModelSessionNotFound:    "session-not-found",
+	ModelDBSessionFailure:   "session-failed",
+	ModelTokenNotFound:      "token-not-found",
+	ModelDBTokenFailure:     "token-failed",
+	ModelInvalidQuery:       "invalid-query",
+	ModelInvalidPatch:       "invalid-patch",
+	ModelVersionConflict:    "version-conflict",
+	ModelDBTimeout:          "store-timeout",
+	ModelCanceled:           "request-canceled",
+	ModelInvalidUser:        "invalid-user",
+	ModelDuplicateUserName:  "duplicate-user-name",
+	ModelDuplicateEmail:     "duplicate-email",
+}
+
+// conflictFields - the field each duplicate status code collided on.
+var conflictFields = map[ModelStatusCode]string{
+	ModelDuplicateUserName: "UserName",
+	ModelDuplicateEmail:    "Email",
+}
+
+// Problem - an RFC 7807 problem details response. Code and Errors are our extensions, as are
+// RequestID, which matches the X-Request-ID response header, and Offset, how far into a malformed
+// JSON body the trouble starts.
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Instance  string       `json:"instance,omitempty"`
+	Code      string       `json:"code"`
+	RequestID string       `json:"requestId,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
+	Offset    int64        `json:"offset,omitempty"`
+}
+
+// FieldError - what is wrong with one field of a request. Field is the field's JSON name, Code a
+// stable identifier for the rule it broke.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// newProblem returns the problem identified by code, answered with an HTTP status.
+func newProblem(status int, code string, title string, detail string) Problem {
+	return Problem{Type: problemTypePrefix + code, Title: title, Status: status, Detail: detail, Code: code}
+}
+
+// modelProblem returns the problem for a model operation that failed with retCode and reason. A
+// duplicate says which field collided.
+func modelProblem(status int, retCode ModelStatusCode, reason string) Problem {
+	code, isKnown := modelProblemCodes[retCode]
+	title := ModelStatusText(retCode)
+	if isKnown == false {
+		code, title = problemInternal, http.StatusText(http.StatusInternalServerError)
+	}
+	problem := newProblem(status, code, title, reason)
+	if field, isConflict := conflictFields[retCode]; isConflict {
+		problem.Errors = []FieldError{{Field: field, Code: "duplicate", Message: "is already taken"}}
+	}
+	return problem
+}
+
+// writeProblem answers r with problem.
+func writeProblem(w http.ResponseWriter, r *http.Request, problem Problem) {
+	problem.Instance = r.URL.Path
+	problem.RequestID = requestIDFromContext(r.Context())
+	w.Header().Set("Content-Type", problemContentType)
+	w.WriteHeader(problem.Status)
+	json.NewEncoder(w).Encode(problem)
+}
+
+// unreadableBodyProblem - for a request body that could not be read at all.
+func unreadableBodyProblem(err error) Problem {
+	return newProblem(http.StatusBadRequest, problemUnreadableBody, "Unreadable request body", err.Error())
+}
+
+// notFound and methodNotAllowed answer requests the router has no route for.
+func notFound(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, r, newProblem(http.StatusNotFound, problemNotFound, http.StatusText(http.StatusNotFound),
+		"no such resource '"+r.URL.Path+"'"))
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, r, newProblem(http.StatusMethodNotAllowed, problemMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed),
+		r.Method+" is not supported on '"+r.URL.Path+"'"))
+}
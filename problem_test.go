@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func decodeProblem(t *testing.T, recorder *httptest.ResponseRecorder) Problem {
+	t.Helper()
+	if contentType := recorder.Header().Get("Content-Type"); contentType != problemContentType {
+		t.Errorf("expected %v, got '%v': %s", problemContentType, contentType, recorder.Body)
+	}
+	var problem Problem
+	if err := json.NewDecoder(recorder.Body).Decode(&problem); err != nil {
+		t.Fatalf("failed to decode problem: %v", err)
+	}
+	if problem.Status != recorder.Code || problem.Type != problemTypePrefix+problem.Code {
+		t.Errorf("problem does not match the response: %v %+v", recorder.Code, problem)
+	}
+	return problem
+}
+
+// Test that every failed model status has a stable problem code of its own.
+func TestModelProblemCodes(t *testing.T) {
+	seen := map[string]bool{}
+	for retCode := range modelStatusText {
+		if retCode == ModelSuccess {
+			continue
+		}
+		code := modelProblemCodes[retCode]
+		if code == "" || seen[code] {
+			t.Errorf("%v: missing or duplicate problem code '%v'", ModelStatusText(retCode), code)
+		}
+		seen[code] = true
+	}
+	if problem := modelProblem(http.StatusInternalServerError, ModelStatusCode(-1), "?"); problem.Code != problemInternal {
+		t.Errorf("expected an unknown status to be an internal error, got %+v", problem)
+	}
+}
+
+// Test that failures are answered with problem details, down to the offending fields.
+func TestProblemResponses(t *testing.T) {
+	savedStore := userStore
+	defer func() { userStore = savedStore }()
+	userStore = &MemoryDB{}
+	userStore.InitDB()
+
+	recorder := httptest.NewRecorder()
+	request := newJSONRequest("POST", "/users", `{"UserName":"someone"}`)
+	request = request.WithContext(withRequestID(request.Context(), "problem-test"))
+	createUser(recorder, request)
+	problem := decodeProblem(t, recorder)
+	if recorder.Code != http.StatusUnprocessableEntity || problem.Code != "invalid-user" || problem.Instance != "/users" ||
+		problem.RequestID != "problem-test" {
+		t.Errorf("unexpected problem for an invalid user: %v %+v", recorder.Code, problem)
+	}
+	if len(problem.Errors) != 2 || problem.Errors[0].Field != "Email" || problem.Errors[1].Field != "Password" {
+		t.Errorf("expected the missing fields to be listed, got %+v", problem.Errors)
+	}
+
+	for i := 0; i < 2; i++ {
+		recorder = httptest.NewRecorder()
+		createUser(recorder, newJSONRequest("POST", "/users", `{"UserName":"someone","Email":"someone@example.com","Password":"secret"}`))
+	}
+	problem = decodeProblem(t, recorder)
+	if recorder.Code != http.StatusConflict || problem.Code != "duplicate-user-name" || len(problem.Errors) != 1 || problem.Errors[0].Field != "UserName" {
+		t.Errorf("unexpected problem for a duplicate user: %v %+v", recorder.Code, problem)
+	}
+
+	recorder = httptest.NewRecorder()
+	getUser(recorder, newJSONRequest("GET", "/user/get", `{"UserName":"nobody"}`))
+	if problem = decodeProblem(t, recorder); recorder.Code != http.StatusNotFound || problem.Code != "user-not-found" {
+		t.Errorf("unexpected problem for a missing user: %v %+v", recorder.Code, problem)
+	}
+
+	recorder = httptest.NewRecorder()
+	notFound(recorder, httptest.NewRequest("GET", "/nowhere", nil))
+	if problem = decodeProblem(t, recorder); recorder.Code != http.StatusNotFound || problem.Code != problemNotFound {
+		t.Errorf("unexpected problem for an unknown route: %v %+v", recorder.Code, problem)
+	}
+}
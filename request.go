@@ -0,0 +1,116 @@
+package main
+
+// Reading request bodies. bindJSON is how a handler turns a JSON body into its request block: the
+// body must be declared as application/json, fit in -http-max-body-bytes, hold exactly one JSON
+// value, and name no fields the block doesn't have. Anything else is answered with a problem saying
+// exactly what was wrong - where the syntax error is, which field has the wrong type. What the
+// values themselves must look like is up to the rules in validation.go.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const jsonContentType = "application/json"
+
+// maxRequestBodyBytes - the largest request body we will read. Set from -http-max-body-bytes.
+var maxRequestBodyBytes int64 = 1 << 20
+
+// Problem codes for request bodies that can't be bound.
+const (
+	problemInvalidJSON  = "invalid-json"
+	problemBodyTooLarge = "body-too-large"
+)
+
+// readRequestBody reads r's body, refusing one over the size limit.
+func readRequestBody(w http.ResponseWriter, r *http.Request) ([]byte, Problem, bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBodyBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, newProblem(http.StatusRequestEntityTooLarge, problemBodyTooLarge, "Request body too large",
+				fmt.Sprintf("request body is over the limit of %v bytes", tooLarge.Limit)), false
+		}
+		return nil, unreadableBodyProblem(err), false
+	}
+	return body, Problem{}, true
+}
+
+// bindJSON reads r's JSON body into target. If it can't, the problem says why.
+func bindJSON(w http.ResponseWriter, r *http.Request, target interface{}) (Problem, bool) {
+	contentType := r.Header.Get("Content-Type")
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != jsonContentType || (params["charset"] != "" && strings.EqualFold(params["charset"], "utf-8") == false) {
+		return newProblem(http.StatusUnsupportedMediaType, problemUnsupportedMedia, "Unsupported media type",
+			fmt.Sprintf("unsupported Content-Type '%v', expected %v", contentType, jsonContentType)), false
+	}
+	body, problem, isRead := readRequestBody(w, r)
+	if isRead == false {
+		return problem, false
+	}
+	return decodeJSON(body, target)
+}
+
+// decodeJSON decodes body, which must be exactly one JSON value, into target. Fields target doesn't
+// have are an error rather than silently dropped.
+func decodeJSON(body []byte, target interface{}) (Problem, bool) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(target); err != nil {
+		return jsonProblem(err, int64(len(body))), false
+	}
+	offset := decoder.InputOffset()
+	if _, err := decoder.Token(); err != io.EOF {
+		problem := invalidJSONProblem(fmt.Sprintf("unexpected data after the JSON value at offset %v", offset))
+		problem.Offset = offset
+		return problem, false
+	}
+	return Problem{}, true
+}
+
+func invalidJSONProblem(detail string) Problem {
+	return newProblem(http.StatusBadRequest, problemInvalidJSON, "Invalid JSON", detail)
+}
+
+// jsonProblem describes a decoding error, pointing at the offending offset or field where it can.
+func jsonProblem(err error, length int64) Problem {
+	var syntaxError *json.SyntaxError
+	var typeError *json.UnmarshalTypeError
+	var problem Problem
+	switch {
+	case err == io.EOF:
+		problem = invalidJSONProblem("request body is empty")
+	case err == io.ErrUnexpectedEOF:
+		problem = invalidJSONProblem(fmt.Sprintf("malformed JSON at offset %v: unexpected end of input", length))
+		problem.Offset = length
+	case errors.As(err, &syntaxError):
+		problem = invalidJSONProblem(fmt.Sprintf("malformed JSON at offset %v: %v", syntaxError.Offset, syntaxError))
+		problem.Offset = syntaxError.Offset
+	case errors.As(err, &typeError):
+		if typeError.Field == "" {
+			problem = invalidJSONProblem(fmt.Sprintf("expected a JSON object, got %v at offset %v", typeError.Value, typeError.Offset))
+		} else {
+			problem = invalidJSONProblem(fmt.Sprintf("wrong type for field %v at offset %v", typeError.Field, typeError.Offset))
+			problem.Errors = []FieldError{{Field: typeError.Field, Code: "type",
+				Message: fmt.Sprintf("must be a %v, not a JSON %v", typeError.Type, typeError.Value)}}
+		}
+		problem.Offset = typeError.Offset
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field := strings.TrimPrefix(err.Error(), "json: unknown field ")
+		if unquoted, unquoteErr := strconv.Unquote(field); unquoteErr == nil {
+			field = unquoted
+		}
+		problem = invalidJSONProblem(fmt.Sprintf("unknown field '%v'", field))
+		problem.Errors = []FieldError{{Field: field, Code: "unknown", Message: "is not a field of this request"}}
+	default:
+		problem = invalidJSONProblem(err.Error())
+	}
+	return problem
+}
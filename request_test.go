@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newJSONRequest returns a request with a JSON body, for calling handlers directly.
+func newJSONRequest(method string, target string, body string) *http.Request {
+	request := httptest.NewRequest(method, target, strings.NewReader(body))
+	request.Header.Set("Content-Type", jsonContentType)
+	return request
+}
+
+func TestBindJSON(t *testing.T) {
+	defer func(saved int64) { maxRequestBodyBytes = saved }(maxRequestBodyBytes)
+	maxRequestBodyBytes = 64
+
+	tests := []struct {
+		contentType string
+		body        string
+		status      int
+		code        string
+		offset      int64
+		field       string
+	}{
+		{jsonContentType, `{"UserName":"Alfie","Password":"x"}`, http.StatusOK, "", 0, ""},
+		{"application/json; charset=UTF-8", ` {"UserName":"Alfie"} `, http.StatusOK, "", 0, ""},
+		{"", `{"UserName":"Alfie"}`, http.StatusUnsupportedMediaType, problemUnsupportedMedia, 0, ""},
+		{"text/plain", `{"UserName":"Alfie"}`, http.StatusUnsupportedMediaType, problemUnsupportedMedia, 0, ""},
+		{"application/json; charset=latin1", `{"UserName":"Alfie"}`, http.StatusUnsupportedMediaType, problemUnsupportedMedia, 0, ""},
+		{jsonContentType, ``, http.StatusBadRequest, problemInvalidJSON, 0, ""},
+		{jsonContentType, `{"UserName":"Alfie",}`, http.StatusBadRequest, problemInvalidJSON, 21, ""},
+		{jsonContentType, `{"UserName":"Alfie"`, http.StatusBadRequest, problemInvalidJSON, 19, ""},
+		{jsonContentType, `{"UserName":"Alfie"} {"UserName":"Joan"}`, http.StatusBadRequest, problemInvalidJSON, 20, ""},
+		{jsonContentType, `{"UserName":7}`, http.StatusBadRequest, problemInvalidJSON, 13, "UserName"},
+		{jsonContentType, `{"UserName":"Alfie","Admin":true}`, http.StatusBadRequest, problemInvalidJSON, 0, "Admin"},
+		{jsonContentType, `["Alfie"]`, http.StatusBadRequest, problemInvalidJSON, 1, ""},
+		{jsonContentType, `{"UserName":"` + strings.Repeat("a", 64) + `"}`, http.StatusRequestEntityTooLarge, problemBodyTooLarge, 0, ""},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest("POST", "/users", strings.NewReader(test.body))
+		if test.contentType != "" {
+			request.Header.Set("Content-Type", test.contentType)
+		}
+		var loginOp LoginOperation
+		problem, isBound := bindJSON(httptest.NewRecorder(), request, &loginOp)
+		if test.status == http.StatusOK {
+			if isBound == false || loginOp.UserName != "Alfie" {
+				t.Errorf("%v: expected to bind, got %+v %+v", test.body, loginOp, problem)
+			}
+			continue
+		}
+		if isBound || problem.Status != test.status || problem.Code != test.code || problem.Offset != test.offset {
+			t.Errorf("%v (%v): unexpected problem %+v", test.body, test.contentType, problem)
+		}
+		if test.field != "" && (len(problem.Errors) != 1 || problem.Errors[0].Field != test.field) {
+			t.Errorf("%v: expected an error for %v, got %+v", test.body, test.field, problem.Errors)
+		}
+	}
+}
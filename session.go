@@ -0,0 +1,125 @@
+package main
+
+// Server side sessions. A successful login issues an opaque random token; the store only ever sees
+// the SHA-256 of that token, so a leaked session table does not hand out live sessions.
+// Clients present the token as "Authorization: Bearer <token>".
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// SessionStore - session operations every user model backend must provide.
+type SessionStore interface {
+	CreateSession(ctx context.Context, session Session) (ModelStatusCode, string)
+	GetSession(ctx context.Context, tokenHash string) (Session, ModelStatusCode, string)
+	DeleteSession(ctx context.Context, tokenHash string) (ModelStatusCode, string)
+	DeleteUserSessions(ctx context.Context, userName string) (ModelStatusCode, string)
+}
+
+// Session - a logged in user.
+type Session struct {
+	TokenHash string
+	UserName  string
+	Expires   time.Time
+}
+
+func (session Session) isExpired() bool {
+	return time.Now().After(session.Expires)
+}
+
+// how long a session lives after login.
+var sessionTTL = 24 * time.Hour
+
+// context key under which requireSession stores the validated session.
+type sessionContextKey struct{}
+
+func newSessionToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// bearerToken pulls the token out of the Authorization header, or returns "".
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
+
+// modelCreateSession starts a session for userName, returning the token to hand to the client.
+func modelCreateSession(ctx context.Context, userName string) (string, Session, ModelStatusCode, string) {
+	token, err := newSessionToken()
+	if err != nil {
+		return "", Session{}, ModelDBSessionFailure, fmt.Sprintf("failed to generate session token: %v", err)
+	}
+	session := Session{TokenHash: hashSessionToken(token), UserName: userName, Expires: time.Now().Add(sessionTTL).UTC()}
+	retCode, reason := userStore.CreateSession(ctx, session)
+	if retCode != ModelSuccess {
+		return "", session, retCode, reason
+	}
+	return token, session, ModelSuccess, ""
+}
+
+func modelGetSession(ctx context.Context, token string) (Session, ModelStatusCode, string) {
+	if len(token) < 1 {
+		return Session{}, ModelSessionNotFound, "session token not supplied"
+	}
+	return userStore.GetSession(ctx, hashSessionToken(token))
+}
+
+func modelDeleteSession(ctx context.Context, token string) (ModelStatusCode, string) {
+	return userStore.DeleteSession(ctx, hashSessionToken(token))
+}
+
+// sessionFromContext returns the session validated by requireSession, if any.
+func sessionFromContext(ctx context.Context) (Session, bool) {
+	session, ok := ctx.Value(sessionContextKey{}).(Session)
+	return session, ok
+}
+
+// requireSession - middleware that rejects requests without a valid session token (or JWT access
+// token, when the token service is up) with a 401.
+// The session is passed on to the handler in the request context.
+func requireSession(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := bearerToken(r)
+		session, retCode, reason := modelGetSession(r.Context(), token)
+		// a signed access token from /token is as good as a session.
+		if retCode == ModelSessionNotFound && tokenService != nil && strings.Count(token, ".") == 2 {
+			if claims, err := tokenService.parseAccessToken(token); err == nil {
+				session, retCode = Session{UserName: claims.Subject, Expires: claims.ExpiresAt.Time}, ModelSuccess
+			} else {
+				reason = fmt.Sprintf("invalid access token: %v", err)
+			}
+		}
+		if retCode != ModelSuccess {
+			logger := loggerFor(r.Context())
+			httpStatus := http.StatusUnauthorized
+			if retCode != ModelSessionNotFound {
+				httpStatus = modelHTTPStatus(logger, "requireSession", retCode)
+			}
+			logger.Info("requireSession(): rejecting", "method", r.Method, "path", r.URL.Path, "reason", reason)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeProblem(w, r, modelProblem(httpStatus, retCode, reason))
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), sessionContextKey{}, session)))
+	}
+}
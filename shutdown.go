@@ -0,0 +1,114 @@
+package main
+
+// Graceful shutdown. On SIGINT or SIGTERM, or if the store fails to initialize, the server stops
+// accepting connections and gives the requests already in flight up to the drain timeout
+// (http.shutdownTimeout) to finish; a second signal cuts the wait short. Then the shutdown hooks run - closing the store, and with it the
+// sql.DB or anything the in memory store needs to flush - newest first. The store is only closed
+// once it has finished initializing, however long that takes.
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+var shutdownLock sync.Mutex
+var shutdownHooks []func()
+
+// onShutdown registers hook to run once the server has drained.
+func onShutdown(hook func()) {
+	shutdownLock.Lock()
+	defer shutdownLock.Unlock()
+	shutdownHooks = append(shutdownHooks, hook)
+}
+
+// startStore brings the store up with initialize in the background, sending any error on the channel
+// returned, and registers release to run on shutdown once initialize has returned - never while it is
+// still using the store. Readiness goes to migrating, if the store migrates, and then ready, but
+// neither once shutdown has started.
+func startStore(migrates bool, initialize func() error, release func()) <-chan error {
+	initFailed := make(chan error, 1)
+	initDone := make(chan struct{})
+	onShutdown(func() {
+		<-initDone
+		release()
+	})
+	go func() {
+		defer close(initDone)
+		if migrates {
+			advanceReadiness(readinessMigrating, readinessStarting)
+		}
+		if err := initialize(); err != nil {
+			initFailed <- err
+			return
+		}
+		advanceReadiness(readinessReady, readinessStarting, readinessMigrating)
+	}()
+	return initFailed
+}
+
+// runShutdownHooks runs the registered hooks, newest first, and clears them so they only run once.
+func runShutdownHooks() {
+	shutdownLock.Lock()
+	hooks := shutdownHooks
+	shutdownHooks = nil
+	shutdownLock.Unlock()
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hooks[i]()
+	}
+}
+
+// runServer serves on listener until a signal arrives on stop or an error on failed, then drains and
+// runs the shutdown hooks. It returns an error if the server could not serve, failed was sent one, or
+// in-flight requests had to be cut off.
+func runServer(server *http.Server, listener net.Listener, stop <-chan os.Signal, failed <-chan error, drainTimeout time.Duration) error {
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
+
+	var failure error
+	select {
+	case err := <-serveErr:
+		log.Printf("runServer(): server failed: %v", err)
+		runShutdownHooks()
+		return err
+	case sig := <-stop:
+		log.Printf("runServer(): %v received, draining in-flight requests for up to %v", sig, drainTimeout)
+	case failure = <-failed:
+		log.Printf("runServer(): %v, draining in-flight requests for up to %v", failure, drainTimeout)
+	}
+	setReadiness(readinessShuttingDown)
+
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	go func() {
+		select {
+		case sig := <-stop:
+			log.Printf("runServer(): %v received again, not waiting for in-flight requests", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	err := server.Shutdown(ctx)
+	if err != nil {
+		log.Printf("runServer(): drain incomplete, closing remaining connections: %v", err)
+		server.Close()
+	}
+	if serveErr := <-serveErr; errors.Is(serveErr, http.ErrServerClosed) == false {
+		log.Printf("runServer(): server failed while draining: %v", serveErr)
+	}
+
+	runShutdownHooks()
+	log.Println("runServer(): shutdown complete")
+	if failure != nil {
+		return failure
+	}
+	return err
+}
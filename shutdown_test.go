@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startTestServer runs a server whose only handler blocks until release is closed, returning the
+// address it listens on, a channel closed once the handler has responded, and a channel that gets
+// runServer's result.
+func startTestServer(t *testing.T, stop chan os.Signal, failed <-chan error, drainTimeout time.Duration, started chan struct{}, release chan struct{}) (string, chan struct{}, chan error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handled := make(chan struct{})
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+		close(handled)
+	})}
+	result := make(chan error, 1)
+	go func() {
+		result <- runServer(server, listener, stop, failed, drainTimeout)
+	}()
+	return listener.Addr().String(), handled, result
+}
+
+// Test that a request in flight when the signal arrives still completes, that no new connections
+// are accepted meanwhile, and that the shutdown hooks only run once the request is done.
+func TestGracefulShutdown(t *testing.T) {
+	stop := make(chan os.Signal, 2)
+	started, release := make(chan struct{}), make(chan struct{})
+	addr, handled, result := startTestServer(t, stop, nil, 5*time.Second, started, release)
+
+	onShutdown(func() {
+		select {
+		case <-handled:
+		default:
+			t.Error("shutdown hook ran before the in-flight request finished")
+		}
+	})
+
+	type response struct {
+		body string
+		err  error
+	}
+	responses := make(chan response, 1)
+	go func() {
+		resp, err := http.Get("http://" + addr + "/")
+		if err != nil {
+			responses <- response{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		responses <- response{body: string(body), err: err}
+	}()
+	<-started
+	stop <- syscall.SIGTERM
+
+	// the listener closes straight away, while the request is still being handled.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("server still accepting connections after shutdown started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(release)
+	if resp := <-responses; resp.err != nil || resp.body != "done" {
+		t.Errorf("in-flight request did not complete: '%v' %v", resp.body, resp.err)
+	}
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("expected a clean shutdown, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not shut down")
+	}
+}
+
+// Test that a request outlasting the drain timeout is cut off, and the hooks still run.
+func TestShutdownDrainTimeout(t *testing.T) {
+	stop := make(chan os.Signal, 2)
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	addr, _, result := startTestServer(t, stop, nil, 100*time.Millisecond, started, release)
+
+	hookRan := false
+	onShutdown(func() { hookRan = true })
+
+	go http.Get("http://" + addr + "/")
+	<-started
+	stop <- syscall.SIGINT
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Error("expected the drain to time out")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not shut down")
+	}
+	if hookRan == false {
+		t.Error("shutdown hook did not run")
+	}
+}
+
+// Test that a failure reported on failed drains and runs the hooks like a signal, then returns it.
+func TestShutdownOnFailure(t *testing.T) {
+	stop, failed := make(chan os.Signal, 2), make(chan error, 1)
+	started, release := make(chan struct{}), make(chan struct{})
+	addr, handled, result := startTestServer(t, stop, failed, 5*time.Second, started, release)
+
+	hookRan := false
+	onShutdown(func() { hookRan = true })
+
+	go http.Get("http://" + addr + "/")
+	<-started
+	failed <- errors.New("failed to initialize test model")
+	close(release)
+	select {
+	case err := <-result:
+		if err == nil || err.Error() != "failed to initialize test model" {
+			t.Errorf("expected the failure to be returned, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not shut down")
+	}
+	select {
+	case <-handled:
+	default:
+		t.Error("in-flight request was not drained")
+	}
+	if hookRan == false {
+		t.Error("shutdown hook did not run")
+	}
+}
+
+// Test that a signal while the store is still initializing neither releases it under initialize
+// nor is undone by the store becoming ready afterwards. Run with -race to catch the former.
+func TestShutdownDuringInit(t *testing.T) {
+	setReadiness(readinessStarting)
+	stop := make(chan os.Signal, 2)
+	initializing, proceed := make(chan struct{}), make(chan struct{})
+	store := "closed"
+	failed := startStore(true, func() error {
+		store = "initializing"
+		close(initializing)
+		<-proceed
+		store = "open"
+		return nil
+	}, func() {
+		if store != "open" {
+			t.Errorf("expected the store to be released once open, it was %v", store)
+		}
+		store = "released"
+	})
+	_, _, result := startTestServer(t, stop, failed, 5*time.Second, make(chan struct{}), make(chan struct{}))
+
+	<-initializing
+	stop <- syscall.SIGTERM
+	select {
+	case <-result:
+		t.Fatal("shutdown did not wait for the store to finish initializing")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(proceed)
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("expected a clean shutdown, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not shut down")
+	}
+	if store != "released" {
+		t.Errorf("expected the store to be released, it was %v", store)
+	}
+	if state := currentReadiness(); state != readinessShuttingDown {
+		t.Errorf("expected readiness to stay %v, got %v", readinessShuttingDown, state)
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+// JWT token service, so other services can authenticate our users without calling back here.
+// A successful credential check at /token issues a short lived signed access token plus an opaque
+// refresh token. Refresh tokens are stored (hashed, like sessions) through the user model and are
+// single use - every /token/refresh hands back a new one. Public keys are published as a JWKS.
+// go get -u github.com/golang-jwt/jwt/v5
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Supported signing algorithms, as passed to initTokenService.
+const (
+	tokenHS256 = "HS256"
+	tokenRS256 = "RS256"
+	tokenEdDSA = "EdDSA"
+)
+
+// RefreshTokenStore - refresh token operations every user model backend must provide.
+type RefreshTokenStore interface {
+	CreateRefreshToken(ctx context.Context, token RefreshToken) (ModelStatusCode, string)
+	ConsumeRefreshToken(ctx context.Context, tokenHash string) (RefreshToken, ModelStatusCode, string)
+	DeleteRefreshToken(ctx context.Context, tokenHash string) (ModelStatusCode, string)
+	DeleteUserRefreshTokens(ctx context.Context, userName string) (ModelStatusCode, string)
+}
+
+// RefreshToken - a stored refresh token. As with sessions only the hash of the token is kept.
+type RefreshToken struct {
+	TokenHash string
+	UserName  string
+	Expires   time.Time
+}
+
+func (token RefreshToken) isExpired() bool {
+	return time.Now().After(token.Expires)
+}
+
+// TokenService - signing configuration for access tokens.
+type TokenService struct {
+	algorithm  string
+	method     jwt.SigningMethod
+	keyID      string
+	signKey    interface{}
+	verifyKey  interface{}
+	issuer     string
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+}
+
+// TokenPair - what a client gets back from /token and /token/refresh.
+type TokenPair struct {
+	AccessToken  string
+	ExpiresIn    int // seconds
+	RefreshToken string
+}
+
+// JWK - a single published public key.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+// JWKS - the published key set.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// the active token service, set once at startup by initTokenService.
+var tokenService *TokenService
+
+// initTokenService loads the signing key for algorithm from keyFile - a raw secret for HS256, a PEM
+// private key for RS256 and EdDSA. With no keyFile an ephemeral key is generated, which is fine for
+// dev and tests but means tokens do not survive a restart.
+func initTokenService(algorithm string, keyFile string, issuer string, accessTTL time.Duration, refreshTTL time.Duration) bool {
+	service := TokenService{algorithm: algorithm, issuer: issuer, accessTTL: accessTTL, refreshTTL: refreshTTL}
+
+	var keyData []byte
+	if keyFile != "" {
+		var err error
+		if keyData, err = os.ReadFile(keyFile); err != nil {
+			log.Printf("initTokenService(): failed to read key file '%v': %v", keyFile, err)
+			return false
+		}
+	} else {
+		log.Printf("initTokenService(): no key file, using an ephemeral %v key", algorithm)
+	}
+
+	var err error
+	switch algorithm {
+	case tokenHS256:
+		err = service.loadHMACKey(keyData)
+	case tokenRS256:
+		err = service.loadRSAKey(keyData)
+	case tokenEdDSA:
+		err = service.loadEdDSAKey(keyData)
+	default:
+		err = fmt.Errorf("unknown signing algorithm '%v'", algorithm)
+	}
+	if err != nil {
+		log.Printf("initTokenService(): %v", err)
+		return false
+	}
+
+	tokenService = &service
+	log.Printf("initTokenService(): signing %v tokens with key '%v'", algorithm, service.keyID)
+	return true
+}
+
+func (service *TokenService) loadHMACKey(keyData []byte) error {
+	secret := []byte(strings.TrimSpace(string(keyData)))
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return err
+		}
+	}
+	if len(secret) < 32 {
+		return fmt.Errorf("HS256 secret must be at least 32 bytes, got %v", len(secret))
+	}
+	service.method = jwt.SigningMethodHS256
+	service.signKey = secret
+	service.verifyKey = secret
+	service.keyID = thumbprint(fmt.Sprintf(`{"k":"%s","kty":"oct"}`, base64.RawURLEncoding.EncodeToString(secret)))
+	return nil
+}
+
+func (service *TokenService) loadRSAKey(keyData []byte) error {
+	var key *rsa.PrivateKey
+	var err error
+	if len(keyData) == 0 {
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	} else {
+		key, err = jwt.ParseRSAPrivateKeyFromPEM(keyData)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load RS256 key: %v", err)
+	}
+	service.method = jwt.SigningMethodRS256
+	service.signKey = key
+	service.verifyKey = &key.PublicKey
+	service.keyID = thumbprint(fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, rsaExponent(&key.PublicKey), rsaModulus(&key.PublicKey)))
+	return nil
+}
+
+func (service *TokenService) loadEdDSAKey(keyData []byte) error {
+	var key ed25519.PrivateKey
+	if len(keyData) == 0 {
+		var err error
+		if _, key, err = ed25519.GenerateKey(rand.Reader); err != nil {
+			return fmt.Errorf("failed to generate EdDSA key: %v", err)
+		}
+	} else {
+		parsed, err := jwt.ParseEdPrivateKeyFromPEM(keyData)
+		if err != nil {
+			return fmt.Errorf("failed to load EdDSA key: %v", err)
+		}
+		var ok bool
+		if key, ok = parsed.(ed25519.PrivateKey); ok == false {
+			return fmt.Errorf("EdDSA key is not an Ed25519 key")
+		}
+	}
+	service.method = jwt.SigningMethodEdDSA
+	service.signKey = key
+	service.verifyKey = key.Public()
+	x := base64.RawURLEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+	service.keyID = thumbprint(fmt.Sprintf(`{"crv":"Ed25519","kty":"OKP","x":"%s"}`, x))
+	return nil
+}
+
+// thumbprint - RFC 7638 key id from the canonical JSON of the key's required members.
+func thumbprint(canonicalJWK string) string {
+	sum := sha256.Sum256([]byte(canonicalJWK))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func rsaModulus(key *rsa.PublicKey) string {
+	return base64.RawURLEncoding.EncodeToString(key.N.Bytes())
+}
+
+func rsaExponent(key *rsa.PublicKey) string {
+	return base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes())
+}
+
+// jwks returns the public keys, for the JWKS endpoint. A symmetric HS256 key is never published.
+func (service *TokenService) jwks() JWKS {
+	keys := JWKS{Keys: []JWK{}}
+	switch key := service.verifyKey.(type) {
+	case *rsa.PublicKey:
+		keys.Keys = append(keys.Keys, JWK{Kty: "RSA", Kid: service.keyID, Use: "sig", Alg: service.algorithm,
+			N: rsaModulus(key), E: rsaExponent(key)})
+	case ed25519.PublicKey:
+		keys.Keys = append(keys.Keys, JWK{Kty: "OKP", Kid: service.keyID, Use: "sig", Alg: service.algorithm,
+			Crv: "Ed25519", X: base64.RawURLEncoding.EncodeToString(key)})
+	}
+	return keys
+}
+
+// signAccessToken issues an access token for userName.
+func (service *TokenService) signAccessToken(userName string) (string, error) {
+	now := time.Now()
+	jti, err := newSessionToken()
+	if err != nil {
+		return "", err
+	}
+	claims := jwt.RegisteredClaims{
+		Issuer:    service.issuer,
+		Subject:   userName,
+		IssuedAt:  jwt.NewNumericDate(now),
+		NotBefore: jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(service.accessTTL)),
+		ID:        jti,
+	}
+	token := jwt.NewWithClaims(service.method, claims)
+	token.Header["kid"] = service.keyID
+	return token.SignedString(service.signKey)
+}
+
+// parseAccessToken verifies an access token we issued, returning its claims.
+func (service *TokenService) parseAccessToken(tokenString string) (*jwt.RegisteredClaims, error) {
+	claims := &jwt.RegisteredClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		return service.verifyKey, nil
+	}, jwt.WithValidMethods([]string{service.algorithm}), jwt.WithIssuer(service.issuer), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// modelIssueTokens signs an access token for an already authenticated user, and stores a new
+// refresh token for them.
+func modelIssueTokens(ctx context.Context, userName string) (TokenPair, ModelStatusCode, string) {
+	var pair TokenPair
+	if tokenService == nil {
+		return pair, ModelDBTokenFailure, "token service not configured"
+	}
+
+	accessToken, err := tokenService.signAccessToken(userName)
+	if err != nil {
+		return pair, ModelDBTokenFailure, fmt.Sprintf("failed to sign access token: %v", err)
+	}
+	refreshToken, err := newSessionToken()
+	if err != nil {
+		return pair, ModelDBTokenFailure, fmt.Sprintf("failed to generate refresh token: %v", err)
+	}
+	stored := RefreshToken{TokenHash: hashSessionToken(refreshToken), UserName: userName, Expires: time.Now().Add(tokenService.refreshTTL).UTC()}
+	if retCode, reason := userStore.CreateRefreshToken(ctx, stored); retCode != ModelSuccess {
+		return pair, retCode, reason
+	}
+
+	pair.AccessToken = accessToken
+	pair.ExpiresIn = int(tokenService.accessTTL / time.Second)
+	pair.RefreshToken = refreshToken
+	return pair, ModelSuccess, ""
+}
+
+// modelRefreshTokens trades a refresh token for a new pair. The old refresh token is used up.
+func modelRefreshTokens(ctx context.Context, refreshToken string) (TokenPair, User, ModelStatusCode, string) {
+	if len(refreshToken) < 1 {
+		return TokenPair{}, User{}, ModelTokenNotFound, "refresh token not supplied"
+	}
+	stored, retCode, reason := userStore.ConsumeRefreshToken(ctx, hashSessionToken(refreshToken))
+	if retCode != ModelSuccess {
+		return TokenPair{}, User{}, retCode, reason
+	}
+	// the user may have been deleted since the token was issued.
+	user, retCode, reason := userStore.GetUser(ctx, stored.UserName)
+	if retCode == ModelDBUserNotFound {
+		return TokenPair{}, User{}, ModelTokenNotFound, "refresh token not found"
+	} else if retCode != ModelSuccess {
+		return TokenPair{}, User{}, retCode, reason
+	}
+	pair, retCode, reason := modelIssueTokens(ctx, user.UserName)
+	return pair, user, retCode, reason
+}
+
+func modelRevokeRefreshToken(ctx context.Context, refreshToken string) (ModelStatusCode, string) {
+	return userStore.DeleteRefreshToken(ctx, hashSessionToken(refreshToken))
+}
@@ -0,0 +1,144 @@
+package main
+
+// Handlers for the token service in token.go. As in user_manager.go, these are a thin mapping
+// from model status codes to HTTP status codes.
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+// RefreshTokenOperation  - request block for refresh and revoke
+type RefreshTokenOperation struct {
+	RefreshToken string `json:"RefreshToken"`
+}
+
+// TokenOperationResult  - response block for token issue and refresh. Tokens are only set on success.
+type TokenOperationResult struct {
+	Status       string   `json:"Status"`
+	Reason       string   `json:"Reason"`
+	AccessToken  string   `json:"AccessToken,omitempty"`
+	TokenType    string   `json:"TokenType,omitempty"`
+	ExpiresIn    int      `json:"ExpiresIn,omitempty"`
+	RefreshToken string   `json:"RefreshToken,omitempty"`
+	User         UserInfo `json:"User"`
+}
+
+func (result *TokenOperationResult) setTokens(pair TokenPair) {
+	result.AccessToken = pair.AccessToken
+	result.TokenType = "Bearer"
+	result.ExpiresIn = pair.ExpiresIn
+	result.RefreshToken = pair.RefreshToken
+}
+
+// map token model codes onto HTTP status codes.
+func tokenHTTPStatus(logger *slog.Logger, caller string, retCode ModelStatusCode) int {
+	switch retCode {
+	case ModelSuccess:
+		return http.StatusOK
+	case ModelInvalidCredentials, ModelTokenNotFound:
+		return http.StatusUnauthorized
+	default:
+		return modelHTTPStatus(logger, caller, retCode)
+	}
+}
+
+// POST -> "/token"
+func issueToken(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFor(r.Context())
+	logger.Debug("issueToken(): invoked")
+	var result TokenOperationResult
+	var loginOp LoginOperation
+	if problem, isBound := bindJSON(w, r, &loginOp); isBound == false {
+		writeProblem(w, r, problem)
+		return
+	}
+	logger.Debug("issueToken(): request", "userName", loginOp.UserName)
+
+	var retCode ModelStatusCode
+	var user User
+	user, retCode, result.Reason = modelVerifyUserPassword(r.Context(), loginOp.UserName, loginOp.Password)
+	if retCode == ModelSuccess {
+		var pair TokenPair
+		pair, retCode, result.Reason = modelIssueTokens(r.Context(), user.UserName)
+		result.setTokens(pair)
+		result.User = user.info()
+	}
+	result.Status = ModelStatusText(retCode)
+
+	httpStatus := tokenHTTPStatus(logger, "issueToken", retCode)
+	logger.Debug("issueToken(): returning", "status", httpStatus, "result", result.Status)
+	w.Header().Set("Cache-Control", "no-store")
+	if retCode != ModelSuccess {
+		writeProblem(w, r, modelProblem(httpStatus, retCode, result.Reason))
+		return
+	}
+	w.WriteHeader(httpStatus)
+	json.NewEncoder(w).Encode(result)
+}
+
+// POST -> "/token/refresh"
+func refreshToken(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFor(r.Context())
+	logger.Debug("refreshToken(): invoked")
+	var result TokenOperationResult
+	var refreshOp RefreshTokenOperation
+	if problem, isBound := bindJSON(w, r, &refreshOp); isBound == false {
+		writeProblem(w, r, problem)
+		return
+	}
+
+	var retCode ModelStatusCode
+	var pair TokenPair
+	var user User
+	pair, user, retCode, result.Reason = modelRefreshTokens(r.Context(), refreshOp.RefreshToken)
+	if retCode == ModelSuccess {
+		result.setTokens(pair)
+		result.User = user.info()
+	}
+	result.Status = ModelStatusText(retCode)
+
+	httpStatus := tokenHTTPStatus(logger, "refreshToken", retCode)
+	logger.Debug("refreshToken(): returning", "status", httpStatus, "result", result.Status)
+	w.Header().Set("Cache-Control", "no-store")
+	if retCode != ModelSuccess {
+		writeProblem(w, r, modelProblem(httpStatus, retCode, result.Reason))
+		return
+	}
+	w.WriteHeader(httpStatus)
+	json.NewEncoder(w).Encode(result)
+}
+
+// POST -> "/token/revoke"
+// As RFC 7009 suggests, revoking a token we don't know about still succeeds.
+func revokeToken(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFor(r.Context())
+	logger.Debug("revokeToken(): invoked")
+	var result SimpleOperationResult
+	var refreshOp RefreshTokenOperation
+	if problem, isBound := bindJSON(w, r, &refreshOp); isBound == false {
+		writeProblem(w, r, problem)
+		return
+	}
+
+	var retCode ModelStatusCode
+	retCode, result.Reason = modelRevokeRefreshToken(r.Context(), refreshOp.RefreshToken)
+	result.Status = ModelStatusText(retCode)
+
+	httpStatus := tokenHTTPStatus(logger, "revokeToken", retCode)
+	logger.Debug("revokeToken(): returning", "status", httpStatus, "result", result)
+	if retCode != ModelSuccess {
+		writeProblem(w, r, modelProblem(httpStatus, retCode, result.Reason))
+		return
+	}
+	w.WriteHeader(httpStatus)
+	json.NewEncoder(w).Encode(result)
+}
+
+// GET -> "/.well-known/jwks.json"
+func getJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(tokenService.jwks())
+}
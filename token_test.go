@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// write a PEM private key for algorithm into dir, returning the file name.
+func writeTestKey(t *testing.T, dir string, algorithm string) string {
+	var der []byte
+	var err error
+	switch algorithm {
+	case tokenHS256:
+		fileName := filepath.Join(dir, "hs256.key")
+		if err = os.WriteFile(fileName, []byte("0123456789abcdef0123456789abcdef\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return fileName
+	case tokenRS256:
+		key, _ := rsa.GenerateKey(rand.Reader, 2048)
+		der, err = x509.MarshalPKCS8PrivateKey(key)
+	case tokenEdDSA:
+		_, key, _ := ed25519.GenerateKey(rand.Reader)
+		der, err = x509.MarshalPKCS8PrivateKey(key)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileName := filepath.Join(dir, algorithm+".pem")
+	if err = os.WriteFile(fileName, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+// Sign and verify access tokens with each algorithm, from both key files and ephemeral keys.
+func TestTokenService(t *testing.T) {
+	defer func(service *TokenService) { tokenService = service }(tokenService)
+	dir := t.TempDir()
+
+	for _, algorithm := range []string{tokenHS256, tokenRS256, tokenEdDSA} {
+		for _, keyFile := range []string{"", writeTestKey(t, dir, algorithm)} {
+			if initTokenService(algorithm, keyFile, "test", time.Minute, time.Hour) == false {
+				t.Fatalf("    %v: failed to init token service with key file '%v'", algorithm, keyFile)
+			}
+			token, err := tokenService.signAccessToken("Alfie")
+			if err != nil {
+				t.Fatalf("    %v: sign failed: %v", algorithm, err)
+			}
+			claims, err := tokenService.parseAccessToken(token)
+			if err != nil || claims.Subject != "Alfie" {
+				t.Errorf("    %v: parse failed: %v %+v", algorithm, err, claims)
+			}
+
+			// symmetric keys are never published, asymmetric ones are published under the token's kid.
+			keys := tokenService.jwks()
+			if algorithm == tokenHS256 {
+				if len(keys.Keys) != 0 {
+					t.Errorf("    %v: published a symmetric key", algorithm)
+				}
+			} else if len(keys.Keys) != 1 || keys.Keys[0].Kid != tokenService.keyID || keys.Keys[0].Alg != algorithm {
+				t.Errorf("    %v: bad JWKS %+v", algorithm, keys)
+			}
+		}
+	}
+
+	// a token signed by one key must not verify against another.
+	initTokenService(tokenEdDSA, "", "test", time.Minute, time.Hour)
+	token, _ := tokenService.signAccessToken("Alfie")
+	initTokenService(tokenEdDSA, "", "test", time.Minute, time.Hour)
+	if _, err := tokenService.parseAccessToken(token); err == nil {
+		t.Error("    token verified against the wrong key")
+	}
+
+	if initTokenService("none", "", "test", time.Minute, time.Hour) == true {
+		t.Error("    accepted unknown algorithm")
+	}
+}
+
+// Test that an HS256 key file holding nothing but whitespace gets a generated secret, as an empty one does.
+func TestHMACKeyBlank(t *testing.T) {
+	for _, keyData := range []string{"", "\n", "  \t\n"} {
+		var service TokenService
+		err := service.loadHMACKey([]byte(keyData))
+		if secret, _ := service.signKey.([]byte); err != nil || len(secret) != 32 {
+			t.Errorf("    key file %q: expected a generated secret, got %v bytes: %v", keyData, len(secret), err)
+		}
+	}
+	var service TokenService
+	if err := service.loadHMACKey([]byte(" too short\n")); err == nil {
+		t.Error("    accepted a short secret")
+	}
+}
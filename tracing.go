@@ -0,0 +1,201 @@
+package main
+
+// OpenTelemetry tracing. Each routed request gets a server span named after its route, continuing
+// the caller's trace if it sent a W3C traceparent header; each store operation gets a child span,
+// and each SQL statement a child of that, carrying the statement text with any literals blanked out.
+// Spans are exported with -trace-exporter: otlp (OTLP over HTTP to -trace-endpoint, or wherever the
+// standard OTEL_EXPORTER_OTLP_* variables say), stdout, or file (JSON lines in -trace-file, handy
+// for tests); with none, the default, incoming trace context is still passed on but nothing is recorded.
+// go get -u go.opentelemetry.io/otel
+// go get -u go.opentelemetry.io/otel/sdk
+// go get -u go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp
+// go get -u go.opentelemetry.io/otel/exporters/stdout/stdouttrace
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Trace exporters.
+const (
+	traceExporterNone   = "none"
+	traceExporterOTLP   = "otlp"
+	traceExporterStdout = "stdout"
+	traceExporterFile   = "file"
+)
+
+const tracerName = "endpoint"
+
+func init() {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+}
+
+// initTracing installs the tracer provider for config. The provider is flushed and shut down with
+// the server.
+func initTracing(config TracingConfig) error {
+	if config.Exporter == traceExporterNone {
+		return nil
+	}
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch config.Exporter {
+	case traceExporterOTLP:
+		var options []otlptracehttp.Option
+		if config.Endpoint != "" {
+			options = append(options, otlptracehttp.WithEndpoint(config.Endpoint))
+		}
+		if config.Insecure {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), options...)
+	case traceExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case traceExporterFile:
+		var file *os.File
+		if file, err = os.OpenFile(config.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err == nil {
+			exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+			onShutdown(func() { file.Close() })
+		}
+	default:
+		return fmt.Errorf("unknown trace exporter '%v'", config.Exporter)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create %v trace exporter: %v", config.Exporter, err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", config.ServiceName)))
+	if err != nil {
+		return fmt.Errorf("failed to describe the service for tracing: %v", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	onShutdown(func() {
+		if err := provider.Shutdown(context.Background()); err != nil {
+			fmt.Fprintf(os.Stderr, "initTracing(): failed to flush spans: %v\n", err)
+		}
+	})
+	return nil
+}
+
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// traceRequests - middleware that runs each routed request in a server span, picking up the trace
+// context from the request headers.
+func traceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		route := routeTemplate(r)
+		ctx, span := tracer().Start(ctx, r.Method+" "+route, trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attribute.String("http.request.method", r.Method), attribute.String("http.route", route),
+				attribute.String("url.path", r.URL.Path), attribute.String("http.request.id", requestIDFromContext(ctx))))
+		defer span.End()
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		span.SetAttributes(attribute.Int("http.response.status_code", recorder.status))
+		if recorder.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(recorder.status))
+		}
+	})
+}
+
+// startModelSpan starts the span for a store operation.
+func startModelSpan(ctx context.Context, operation string) (context.Context, trace.Span) {
+	return tracer().Start(ctx, "store."+operation, trace.WithAttributes(attribute.String("model.operation", operation)))
+}
+
+// endModelSpan records how a store operation went and ends its span. Anything other than success
+// marks the span as failed, so e.g. "user not found" stands out in a trace as well as a real error.
+func endModelSpan(span trace.Span, retCode ModelStatusCode, reason string) {
+	span.SetAttributes(attribute.String("model.status", ModelStatusText(retCode)))
+	if retCode != ModelSuccess {
+		span.SetStatus(codes.Error, reason)
+	}
+	span.End()
+}
+
+var (
+	sqlStringLiteral = regexp.MustCompile(`'(?:[^'\\]|\\.|'')*'`)
+	// a number on its own, not part of a name or a Postgres placeholder like $1. RE2 has no look
+	// behind, so the character before it is matched and put back.
+	sqlNumericLiteral = regexp.MustCompile(`(^|[^$\w])\d+(?:\.\d+)?\b`)
+)
+
+// sanitizeSQL returns query with its string and numeric literals replaced by '?'. Our statements
+// bind their values as parameters anyway; this is so nothing that slips into the text reaches a trace.
+func sanitizeSQL(query string) string {
+	query = sqlStringLiteral.ReplaceAllString(query, "?")
+	return sqlNumericLiteral.ReplaceAllString(query, "${1}?")
+}
+
+// tracedStmt - a prepared statement run on behalf of ctx. Each execution gets a span.
+type tracedStmt struct {
+	ctx    context.Context
+	stmt   *sql.Stmt
+	query  string
+	system string
+	dbName string
+}
+
+func (stmt *tracedStmt) start() (context.Context, trace.Span) {
+	query := sanitizeSQL(stmt.query)
+	operation, _, _ := strings.Cut(query, " ")
+	operation = strings.ToUpper(operation)
+	return tracer().Start(stmt.ctx, "sql."+operation, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("db.system.name", stmt.system), attribute.String("db.namespace", stmt.dbName),
+			attribute.String("db.operation.name", operation), attribute.String("db.query.text", query)))
+}
+
+func endSQLSpan(span trace.Span, err error) {
+	if err != nil && err != sql.ErrNoRows {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Exec - as sql.Stmt.Exec.
+func (stmt *tracedStmt) Exec(args ...interface{}) (sql.Result, error) {
+	ctx, span := stmt.start()
+	result, err := stmt.stmt.ExecContext(ctx, args...)
+	endSQLSpan(span, err)
+	return result, err
+}
+
+// Query - as sql.Stmt.Query. The span covers running the query, not reading the rows.
+func (stmt *tracedStmt) Query(args ...interface{}) (*sql.Rows, error) {
+	ctx, span := stmt.start()
+	rows, err := stmt.stmt.QueryContext(ctx, args...)
+	endSQLSpan(span, err)
+	return rows, err
+}
+
+// QueryRow - as sql.Stmt.QueryRow. The span covers running the query, not scanning the row.
+func (stmt *tracedStmt) QueryRow(args ...interface{}) *sql.Row {
+	ctx, span := stmt.start()
+	row := stmt.stmt.QueryRowContext(ctx, args...)
+	endSQLSpan(span, row.Err())
+	return row
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// Test that a request continues the caller's trace in a span named after its route, and that the
+// store operations it makes are child spans.
+func TestTraceRequests(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	defer otel.SetTracerProvider(otel.GetTracerProvider())
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	store := instrumentStore(&MemoryDB{})
+	store.InitDB()
+	router := mux.NewRouter()
+	router.Use(traceRequests)
+	router.HandleFunc("/users/{userName}", func(w http.ResponseWriter, r *http.Request) {
+		store.GetUser(r.Context(), mux.Vars(r)["userName"])
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	const traceID, parentID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	request := httptest.NewRequest("GET", "/users/nobody", nil)
+	request.Header.Set("traceparent", "00-"+traceID+"-"+parentID+"-01")
+	router.ServeHTTP(httptest.NewRecorder(), request)
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("expected a server span and a store span, got %v", len(spans))
+	}
+	storeSpan, serverSpan := spans[0], spans[1]
+	if serverSpan.Name() != "GET /users/{userName}" || serverSpan.SpanContext().TraceID().String() != traceID ||
+		serverSpan.Parent().SpanID().String() != parentID {
+		t.Errorf("expected the server span to continue the caller's trace, got %v in %v, parent %v", serverSpan.Name(),
+			serverSpan.SpanContext().TraceID(), serverSpan.Parent().SpanID())
+	}
+	if storeSpan.Name() != "store.GetUser" || storeSpan.Parent().SpanID() != serverSpan.SpanContext().SpanID() {
+		t.Errorf("expected store.GetUser as a child of the server span, got %v with parent %v", storeSpan.Name(), storeSpan.Parent().SpanID())
+	}
+	for _, attr := range serverSpan.Attributes() {
+		if attr.Key == "http.response.status_code" && attr.Value.AsInt64() != http.StatusNotFound {
+			t.Errorf("expected the response status on the server span, got %v", attr.Value.AsInt64())
+		}
+	}
+}
+
+func TestSanitizeSQL(t *testing.T) {
+	tests := []struct{ query, expected string }{
+		{"SELECT ID from usersTest where UserName = ?", "SELECT ID from usersTest where UserName = ?"},
+		{"UPDATE users2 SET Version = Version + 1 where UserName = 'bob' AND (? = 0 OR Version = 12)",
+			"UPDATE users2 SET Version = Version + ? where UserName = ? AND (? = ? OR Version = ?)"},
+		{"SELECT * from t where Email = 'o''brien@example.com' LIMIT 11", "SELECT * from t where Email = ? LIMIT ?"},
+		// Postgres placeholders keep their numbers, so the parameters can still be told apart.
+		{"UPDATE users SET Email = $1, Version = Version + 1 where UserName = $2 AND ($3 = 0 OR Version = $4) LIMIT 2.5",
+			"UPDATE users SET Email = $1, Version = Version + ? where UserName = $2 AND ($3 = ? OR Version = $4) LIMIT ?"},
+		{"42", "?"},
+	}
+	for _, test := range tests {
+		if sanitized := sanitizeSQL(test.query); sanitized != test.expected {
+			t.Errorf("expected '%v', got '%v'", test.expected, sanitized)
+		}
+	}
+}
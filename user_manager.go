@@ -7,24 +7,50 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
 )
 
+// statusClientClosedRequest - nginx's status for a request the client gave up on before we answered.
+// Nobody sees it but the logs and metrics, which is the point.
+const statusClientClosedRequest = 499
+
+// modelHTTPStatus maps the model codes any store operation can fail with onto HTTP status codes, for
+// a handler's switch to fall back on: a store timeout is a 504 and a canceled request a 499. Any
+// other code reaching it is one the caller did not expect - logged, and a 500.
+func modelHTTPStatus(logger *slog.Logger, caller string, retCode ModelStatusCode) int {
+	switch retCode {
+	case ModelDBTimeout:
+		return http.StatusGatewayTimeout
+	case ModelCanceled:
+		return statusClientClosedRequest
+	default:
+		logger.Error(caller+"(): model returned unexpected status code", "retCode", retCode)
+		return http.StatusInternalServerError
+	}
+}
+
 // UserOperationResult  - rrequest and return block for create and update user operations
 type UserOperationResult struct {
-	Status string `json:"Status"`
-	Reason string `json:"Reason"`
-	User   User   `json:"User"`
+	Status string   `json:"Status"`
+	Reason string   `json:"Reason"`
+	User   UserInfo `json:"User"`
 }
 
-// UserGetAllOperationResult - response object for GetAll users
+// UserGetAllOperationResult - response object for GetAll users. Count is the number of users in
+// this page, Total the number matching the filters; NextCursor fetches the next page, if any.
 type UserGetAllOperationResult struct {
-	Status string `json:"Status"`
-	Reason string `json:"Reason"`
-	Count  int    `json:"Count"`
-	Users  []User `json:"Users"`
+	Status     string     `json:"Status"`
+	Reason     string     `json:"Reason"`
+	Count      int        `json:"Count"`
+	Total      int        `json:"Total"`
+	NextCursor string     `json:"NextCursor,omitempty"`
+	Users      []UserInfo `json:"Users"`
 }
 
 // SimpleOperationResult  - request and return block for create and update user operations
@@ -38,225 +64,500 @@ type UserNameOperation struct {
 	UserName string `json:"UserName"`
 }
 
-//// HANDLERS - these correspond one to one with the API declared in endpoint.go
+// LoginOperation  - request block for login
+type LoginOperation struct {
+	UserName string `json:"UserName"`
+	Password string `json:"Password"`
+}
 
-// POST -> "/user/register"
-func createUser(w http.ResponseWriter, r *http.Request) {
-	log.Println("createUser(): invoked")
-	var result UserOperationResult
-	reqBody, err := ioutil.ReadAll(r.Body)
+// LoginOperationResult  - response block for login. Token is only set on success.
+type LoginOperationResult struct {
+	Status  string    `json:"Status"`
+	Reason  string    `json:"Reason"`
+	Token   string    `json:"Token,omitempty"`
+	Expires time.Time `json:"Expires"`
+	User    UserInfo  `json:"User"`
+}
+
+// userLocation returns the path of userName's resource, the reverse of pathUserName.
+func userLocation(userName string) string {
+	return "/users/" + url.PathEscape(userName)
+}
+
+// pathUserName returns the {userName} of a /users/{userName} route. The second return is false on
+// routes without one, i.e. the legacy /user/* routes.
+func pathUserName(r *http.Request) (string, bool) {
+	encoded, isResource := mux.Vars(r)["userName"]
+	if isResource == false {
+		return "", false
+	}
+	// the router matches on the encoded path so names may contain '/'.
+	userName, err := url.PathUnescape(encoded)
 	if err != nil {
-		fmt.Fprintf(w, "Invalid data - expected Username, Email, and Password for new user")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(result)
-		return
+		return encoded, true
 	}
+	return userName, true
+}
+
+// requestUserName gets the user name for get and delete, from the path on the resource routes and
+// from a json body on the legacy ones.
+func requestUserName(w http.ResponseWriter, r *http.Request) (UserNameOperation, Problem, bool) {
+	var userNameOp UserNameOperation
+	if userName, isResource := pathUserName(r); isResource {
+		userNameOp.UserName = userName
+		return userNameOp, Problem{}, true
+	}
+	problem, isBound := bindJSON(w, r, &userNameOp)
+	return userNameOp, problem, isBound
+}
+
+// writeUserNameMismatch answers a request whose body names a different user to its path.
+func writeUserNameMismatch(w http.ResponseWriter, r *http.Request, logger *slog.Logger, caller string, pathName string, bodyName string) {
+	problem := newProblem(http.StatusBadRequest, problemUserNameMismatch, "User name mismatch",
+		fmt.Sprintf("user name '%v' in body does not match '%v' in path", bodyName, pathName))
+	problem.Errors = []FieldError{{Field: "UserName", Code: "mismatch", Message: "must match the user name in the path"}}
+	logger.Debug(caller+"(): returning", "status", problem.Status, "problem", problem.Code)
+	writeProblem(w, r, problem)
+}
+
+//// HANDLERS - these correspond one to one with the API declared in endpoint.go
 
+// POST -> "/user/register", "/users"
+// Answers 201 with the user as stored, ID and all, and their resource's path in Location.
+func createUser(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFor(r.Context())
+	logger.Debug("createUser(): invoked")
+	var result UserOperationResult
 	// get user data from json.
 	var newUser User
-	json.Unmarshal(reqBody, &newUser)
-	log.Printf("createUser(): request data: %v", newUser)
+	if problem, isBound := bindJSON(w, r, &newUser); isBound == false {
+		writeProblem(w, r, problem)
+		return
+	}
+	logger.Debug("createUser(): request", "user", newUser)
 
 	// now update the db.
 	var httpStatus int
 	var retCode ModelStatusCode
-	result.User, retCode, result.Reason = modelCreateUser(newUser)
+	var user User
+	user, retCode, result.Reason = modelCreateUser(r.Context(), newUser)
+	result.User = user.info()
 	result.Status = ModelStatusText(retCode)
 
 	// handle response.
 	switch retCode {
 	case ModelSuccess:
 		httpStatus = http.StatusCreated
+		w.Header().Set("ETag", userETag(user))
+		w.Header().Set("Location", userLocation(user.UserName))
+	case ModelInvalidUser:
+		httpStatus = http.StatusUnprocessableEntity
+	case ModelDuplicateUserName, ModelDuplicateEmail:
+		httpStatus = http.StatusConflict
 	case ModelDBCreateFailure:
 		httpStatus = http.StatusInternalServerError
 	default:
-		log.Printf("createUser(): model returned unexpected status code %v", retCode)
-		httpStatus = http.StatusInternalServerError
+		httpStatus = modelHTTPStatus(logger, "createUser", retCode)
 	}
 
-	log.Printf("createUser(): returning %v -> %v", httpStatus, result)
+	logger.Debug("createUser(): returning", "status", httpStatus, "result", result)
+	if retCode != ModelSuccess {
+		problem := modelProblem(httpStatus, retCode, result.Reason)
+		if retCode == ModelInvalidUser {
+			problem.Errors = validateUser(newUser)
+		}
+		writeProblem(w, r, problem)
+		return
+	}
 	w.WriteHeader(httpStatus)
 	json.NewEncoder(w).Encode(result)
 }
 
-// PUT -> "/user/update"
+// PUT -> "/user/update", "/users/{userName}"
+// If-Match / If-None-Match make the update conditional - see user_version.go.
 func updateUser(w http.ResponseWriter, r *http.Request) {
-	log.Println("updateUser(): invoked")
+	logger := loggerFor(r.Context())
+	logger.Debug("updateUser(): invoked")
 	var result UserOperationResult
-	reqBody, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		fmt.Fprintf(w, "Invalid data - expected Username, Email, and Password for new user")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(result)
+	var user User
+	if problem, isBound := bindJSON(w, r, &user); isBound == false {
+		writeProblem(w, r, problem)
 		return
 	}
-
-	var user User
-	json.Unmarshal(reqBody, &user)
-	log.Printf("updateUser(): request data: %v", user)
+	logger.Debug("updateUser(): request", "user", user)
+
+	// on the resource route the path names the user; the body may repeat it, but not contradict it.
+	if userName, isResource := pathUserName(r); isResource {
+		if len(user.UserName) > 0 && user.UserName != userName {
+			writeUserNameMismatch(w, r, logger, "updateUser", userName, user.UserName)
+			return
+		}
+		user.UserName = userName
+	}
 
 	// now update the db.
 	var httpStatus int
 	var retCode ModelStatusCode
-	result.User, retCode, result.Reason = modelUpdateUser(user)
+	var updatedUser User
+	updatedUser, retCode, result.Reason = modelUpdateUser(r.Context(), user, requestPreconditions(r))
+	result.User = updatedUser.info()
 	result.Status = ModelStatusText(retCode)
 
 	// handle response.
 	switch retCode {
 	case ModelSuccess:
 		httpStatus = http.StatusOK
+		w.Header().Set("ETag", userETag(updatedUser))
 	case ModelDBUserNotFound:
 		httpStatus = http.StatusNotFound
-	case ModelDBUpdateFailure:
+	case ModelVersionConflict:
+		httpStatus = http.StatusPreconditionFailed
+	case ModelInvalidUser:
+		httpStatus = http.StatusUnprocessableEntity
+	case ModelDuplicateEmail:
+		httpStatus = http.StatusConflict
+	case ModelDBUpdateFailure, ModelDBGetFailure: // the get checking the preconditions
 		httpStatus = http.StatusInternalServerError
 	default:
-		log.Printf("updateUser(): model returned unexpected status code %v", retCode)
+		httpStatus = modelHTTPStatus(logger, "updateUser", retCode)
+	}
+
+	logger.Debug("updateUser(): returning", "status", httpStatus, "result", result)
+	if retCode != ModelSuccess {
+		problem := modelProblem(httpStatus, retCode, result.Reason)
+		if retCode == ModelInvalidUser {
+			problem.Errors = validateUser(user)
+		}
+		writeProblem(w, r, problem)
+		return
+	}
+	w.WriteHeader(httpStatus)
+	json.NewEncoder(w).Encode(result)
+}
+
+// PATCH -> "/users/{userName}"
+// The body is a JSON Merge Patch or a JSON Patch - see user_patch.go. Honours If-Match / If-None-Match.
+func patchUser(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFor(r.Context())
+	logger.Debug("patchUser(): invoked")
+	var result UserOperationResult
+	reqBody, problem, isRead := readRequestBody(w, r)
+	if isRead == false {
+		writeProblem(w, r, problem)
+		return
+	}
+
+	userName, _ := pathUserName(r)
+	patchType, isSupported := patchDocumentType(r.Header.Get("Content-Type"))
+	if isSupported == false {
+		w.Header().Set("Accept-Patch", mergePatchContentType+", "+jsonPatchContentType)
+		writeProblem(w, r, newProblem(http.StatusUnsupportedMediaType, problemUnsupportedMedia, "Unsupported patch type",
+			fmt.Sprintf("unsupported patch type '%v', expected %v or %v", r.Header.Get("Content-Type"), mergePatchContentType, jsonPatchContentType)))
+		return
+	}
+	logger.Debug("patchUser(): request", "userName", userName, "patchType", patchType)
+
+	// now update the db.
+	var httpStatus int
+	var retCode ModelStatusCode
+	var patchedUser User
+	patchedUser, retCode, result.Reason = modelPatchUser(r.Context(), userName, patchType, reqBody, requestPreconditions(r))
+	result.User = patchedUser.info()
+	result.Status = ModelStatusText(retCode)
+
+	// handle response.
+	switch retCode {
+	case ModelSuccess:
+		httpStatus = http.StatusOK
+		w.Header().Set("ETag", userETag(patchedUser))
+	case ModelDBUserNotFound:
+		httpStatus = http.StatusNotFound
+	case ModelVersionConflict:
+		httpStatus = http.StatusPreconditionFailed
+	case ModelInvalidPatch:
+		httpStatus = http.StatusUnprocessableEntity
+	case ModelDuplicateEmail:
+		httpStatus = http.StatusConflict
+	case ModelDBUpdateFailure, ModelDBGetFailure:
 		httpStatus = http.StatusInternalServerError
+	default:
+		httpStatus = modelHTTPStatus(logger, "patchUser", retCode)
 	}
 
-	log.Printf("updateUser(): returning %v -> %v", httpStatus, result)
+	logger.Debug("patchUser(): returning", "status", httpStatus, "result", result)
+	if retCode != ModelSuccess {
+		writeProblem(w, r, modelProblem(httpStatus, retCode, result.Reason))
+		return
+	}
 	w.WriteHeader(httpStatus)
 	json.NewEncoder(w).Encode(result)
 }
 
-// GET -> "/user/get"
+// GET -> "/user/get", "/users/{userName}"
+// Responses carry an ETag; a matching If-None-Match gets a 304 with no body.
 func getUser(w http.ResponseWriter, r *http.Request) {
-	log.Println("getUser(): invoked")
+	logger := loggerFor(r.Context())
+	logger.Debug("getUser(): invoked")
 	var result UserOperationResult
 	var httpStatus int
 
-	reqBody, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		fmt.Fprintf(w, "Invalid data - expected Username")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(result)
+	// the resource route names the user in the path, the legacy route in a json body.
+	userNameOp, problem, isBound := requestUserName(w, r)
+	if isBound == false {
+		writeProblem(w, r, problem)
 		return
 	}
-
-	// get user data from json. Could use error handling.
-	var userNameOp UserNameOperation
-	json.Unmarshal(reqBody, &userNameOp)
-	log.Printf("getUser(): request data: %v", userNameOp)
+	logger.Debug("getUser(): request", "userName", userNameOp.UserName)
 
 	// now retrieve from our db.
 	var retCode ModelStatusCode
-	result.User, retCode, result.Reason = modelGetUser(userNameOp.UserName)
+	var user User
+	user, retCode, result.Reason = modelGetUser(r.Context(), userNameOp.UserName)
+	result.User = user.info()
 	result.Status = ModelStatusText(retCode)
 
 	// handle response.
 	switch retCode {
 	case ModelSuccess:
 		httpStatus = http.StatusOK
+		w.Header().Set("ETag", userETag(user))
+		if etagListMatches(requestPreconditions(r).IfNoneMatch, userETag(user), true, true) {
+			logger.Debug("getUser(): not modified", "userName", user.UserName)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
 	case ModelDBUserNotFound:
 		httpStatus = http.StatusNotFound
 	case ModelDBGetFailure:
 		httpStatus = http.StatusInternalServerError
 	default:
-		log.Printf("getUser(): model returned unexpected status code %v", retCode)
-		httpStatus = http.StatusInternalServerError
+		httpStatus = modelHTTPStatus(logger, "getUser", retCode)
 
 	}
 
-	log.Printf("getUser(): returning %v -> %v", httpStatus, result)
+	logger.Debug("getUser(): returning", "status", httpStatus, "result", result)
+	if retCode != ModelSuccess {
+		writeProblem(w, r, modelProblem(httpStatus, retCode, result.Reason))
+		return
+	}
 	w.WriteHeader(httpStatus)
 	json.NewEncoder(w).Encode(result)
 }
 
-// GET -> "/user/getAll"
+// GET -> "/user/getAll", "/users"
+// Optional query parameters: limit, cursor, userNamePrefix, emailDomain, and sort - one of ID,
+// UserName or Email, with a leading '-' for descending.
 func getAllUsers(w http.ResponseWriter, r *http.Request) {
-	log.Println("getAllUsers() invoked")
+	logger := loggerFor(r.Context())
+	logger.Debug("getAllUsers(): invoked")
 	var result UserGetAllOperationResult
 	var httpStatus int
 
 	// access db
 	var retCode ModelStatusCode
-	result.Users, retCode, result.Reason = modelGetAllUsers()
+	var page UserPage
+	query, err := userQueryFromRequest(r)
+	if err != nil {
+		retCode, result.Reason = ModelInvalidQuery, err.Error()
+	} else {
+		page, retCode, result.Reason = modelGetAllUsers(r.Context(), query)
+	}
+	result.Users = usersInfo(page.Users)
 	result.Status = ModelStatusText(retCode)
 	result.Count = len(result.Users)
+	result.Total = page.Total
+	result.NextCursor = page.NextCursor
 
 	// handle response.
 	switch retCode {
 	case ModelSuccess:
-		log.Println("getAllUsers(): found")
 		httpStatus = http.StatusOK
-	case ModelDBCreateFailure:
-		log.Println("getAllUsers(): server error 1")
+	case ModelInvalidQuery:
+		httpStatus = http.StatusBadRequest
+	case ModelDBGetFailure:
+		logger.Error("getAllUsers(): server error", "reason", result.Reason)
 		httpStatus = http.StatusInternalServerError
 	default:
-		log.Printf("getAllUsers(): model returned unexpected status code %v", retCode)
-		httpStatus = http.StatusInternalServerError
+		httpStatus = modelHTTPStatus(logger, "getAllUsers", retCode)
 	}
 
-	log.Printf("getAllUsers(): returning %v -> %v", httpStatus, result)
+	logger.Debug("getAllUsers(): returning", "status", httpStatus, "result", result)
+	if retCode != ModelSuccess {
+		writeProblem(w, r, modelProblem(httpStatus, retCode, result.Reason))
+		return
+	}
 	w.WriteHeader(httpStatus)
 	json.NewEncoder(w).Encode(result)
 }
 
-// DELETE -> "/user/delete"
+// userQueryFromRequest reads the getAll query parameters.
+func userQueryFromRequest(r *http.Request) (UserQuery, error) {
+	params := r.URL.Query()
+	query := UserQuery{
+		UserNamePrefix: params.Get("userNamePrefix"),
+		EmailDomain:    params.Get("emailDomain"),
+		Cursor:         params.Get("cursor"),
+	}
+	query.SortBy, query.Descending = parseSort(params.Get("sort"))
+	if limit := params.Get("limit"); limit != "" {
+		var err error
+		if query.Limit, err = strconv.Atoi(limit); err != nil {
+			return query, fmt.Errorf("invalid limit '%v'", limit)
+		}
+	}
+	return query, nil
+}
+
+// DELETE -> "/user/delete", "/users/{userName}"
+// Honours If-Match / If-None-Match, as updateUser.
 func deleteUser(w http.ResponseWriter, r *http.Request) {
-	log.Println("deleteUser(): invoked")
+	logger := loggerFor(r.Context())
+	logger.Debug("deleteUser(): invoked")
 	var result UserOperationResult
 	var httpStatus int
 
-	reqBody, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		fmt.Fprintf(w, "Invalid data - expected Username, Email, and Password for new user")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(result)
+	userNameOp, problem, isBound := requestUserName(w, r)
+	if isBound == false {
+		writeProblem(w, r, problem)
 		return
 	}
-
-	// get user data from json.
-	var userNameOp UserNameOperation
-	json.Unmarshal(reqBody, &userNameOp)
-	log.Printf("deleteUser(): request data: %v", userNameOp)
+	logger.Debug("deleteUser(): request", "userName", userNameOp.UserName)
 
 	// access db
 	var retCode ModelStatusCode
-	result.User, retCode, result.Reason = modelDeleteUser(userNameOp.UserName)
+	var user User
+	user, retCode, result.Reason = modelDeleteUser(r.Context(), userNameOp.UserName, requestPreconditions(r))
+	result.User = user.info()
 	result.Status = ModelStatusText(retCode)
 
 	// handle response.
 	switch retCode {
 	case ModelSuccess:
 		httpStatus = http.StatusOK
-	case ModelDBCreateFailure:
-		log.Println("deleteUser(): server error")
+	case ModelDBUserNotFound:
+		httpStatus = http.StatusNotFound
+	case ModelVersionConflict:
+		httpStatus = http.StatusPreconditionFailed
+	case ModelDBDeleteFailure, ModelDBGetFailure: // the get checking the preconditions
+		logger.Error("deleteUser(): server error", "reason", result.Reason)
 		httpStatus = http.StatusInternalServerError
 	default:
-		log.Printf("deleteUser(): model returned unexpected status code %v", retCode)
-		httpStatus = http.StatusInternalServerError
+		httpStatus = modelHTTPStatus(logger, "deleteUser", retCode)
 	}
 
-	log.Printf("deleteUser(): returning %v -> %v", httpStatus, result)
+	logger.Debug("deleteUser(): returning", "status", httpStatus, "result", result)
+	if retCode != ModelSuccess {
+		writeProblem(w, r, modelProblem(httpStatus, retCode, result.Reason))
+		return
+	}
 	w.WriteHeader(httpStatus)
 	json.NewEncoder(w).Encode(result)
 }
 
 // DELETE -> "/user/deleteAll"
 func deleteAllUsers(w http.ResponseWriter, r *http.Request) {
-	log.Println("deleteAllUsers(): invoked")
+	logger := loggerFor(r.Context())
+	logger.Debug("deleteAllUsers(): invoked")
 	var result SimpleOperationResult
 	var httpStatus int
 
 	// access db
 	var retCode ModelStatusCode
-	retCode, result.Reason = modelDeleteAllUsers()
+	retCode, result.Reason = modelDeleteAllUsers(r.Context())
 	result.Status = ModelStatusText(retCode)
 
 	// handle response.
 	switch retCode {
 	case ModelSuccess:
 		httpStatus = http.StatusOK
-	case ModelDBCreateFailure:
+	case ModelDBDeleteFailure:
 		httpStatus = http.StatusInternalServerError
-		log.Println("deleteAllUsers(): server error 1")
+		logger.Error("deleteAllUsers(): server error", "reason", result.Reason)
 	default:
-		log.Printf("deleteAllUsers(): model returned unexpected status code %v", retCode)
+		httpStatus = modelHTTPStatus(logger, "deleteAllUsers", retCode)
+	}
+
+	logger.Debug("deleteAllUsers(): returning", "status", httpStatus, "result", result)
+	if retCode != ModelSuccess {
+		writeProblem(w, r, modelProblem(httpStatus, retCode, result.Reason))
+		return
+	}
+	w.WriteHeader(httpStatus)
+	json.NewEncoder(w).Encode(result)
+}
+
+// POST -> "/user/login"
+func loginUser(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFor(r.Context())
+	logger.Debug("loginUser(): invoked")
+	var result LoginOperationResult
+	var loginOp LoginOperation
+	if problem, isBound := bindJSON(w, r, &loginOp); isBound == false {
+		writeProblem(w, r, problem)
+		return
+	}
+	logger.Debug("loginUser(): request", "userName", loginOp.UserName)
+
+	// check the credentials, then open a session.
+	var httpStatus int
+	var retCode ModelStatusCode
+	var user User
+	user, retCode, result.Reason = modelVerifyUserPassword(r.Context(), loginOp.UserName, loginOp.Password)
+	if retCode == ModelSuccess {
+		var session Session
+		result.Token, session, retCode, result.Reason = modelCreateSession(r.Context(), user.UserName)
+		result.Expires = session.Expires
+		result.User = user.info()
+	}
+	result.Status = ModelStatusText(retCode)
+
+	// handle response.
+	switch retCode {
+	case ModelSuccess:
+		httpStatus = http.StatusOK
+	case ModelInvalidCredentials:
+		httpStatus = http.StatusUnauthorized
+	case ModelDBGetFailure, ModelDBSessionFailure:
+		httpStatus = http.StatusInternalServerError
+	default:
+		httpStatus = modelHTTPStatus(logger, "loginUser", retCode)
+	}
+
+	logger.Debug("loginUser(): returning", "status", httpStatus, "result", result.Status)
+	if retCode != ModelSuccess {
+		writeProblem(w, r, modelProblem(httpStatus, retCode, result.Reason))
+		return
+	}
+	w.WriteHeader(httpStatus)
+	json.NewEncoder(w).Encode(result)
+}
+
+// POST -> "/user/logout" (requires a session)
+func logoutUser(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFor(r.Context())
+	logger.Debug("logoutUser(): invoked")
+	var result SimpleOperationResult
+	var httpStatus int
+
+	var retCode ModelStatusCode
+	retCode, result.Reason = modelDeleteSession(r.Context(), bearerToken(r))
+	result.Status = ModelStatusText(retCode)
+
+	// handle response.
+	switch retCode {
+	case ModelSuccess:
+		httpStatus = http.StatusOK
+	case ModelDBSessionFailure:
 		httpStatus = http.StatusInternalServerError
+	default:
+		httpStatus = modelHTTPStatus(logger, "logoutUser", retCode)
 	}
 
-	log.Printf("deleteAllUsers(): returning %v -> %v", httpStatus, result)
+	logger.Debug("logoutUser(): returning", "status", httpStatus, "result", result)
+	if retCode != ModelSuccess {
+		writeProblem(w, r, modelProblem(httpStatus, retCode, result.Reason))
+		return
+	}
 	w.WriteHeader(httpStatus)
 	json.NewEncoder(w).Encode(result)
 }
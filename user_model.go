@@ -1,216 +1,557 @@
 package main
 
 // This is the user model - it roughly corresponds to the model part of MVP
-// This implementation is an mySQL db
+// This implementation is an SQL db - mySQL, SQLite (see user_model_sqlite.go) or PostgreSQL (see
+// user_model_postgres.go). What differs between them is described by a sqlDialect.
 // go get -u github.com/go-sql-driver/mysql
 // Status codes are defined in user_model_status.go
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 )
 
-// MyDB - mySql connection data.
+// MyDB - SQL connection data.
 type MyDB struct {
-	dbName     string
-	tableName  string
-	connection *sql.DB
+	dialect          sqlDialect
+	dsn              string
+	dbName           string // for logging, the DSN names the database
+	tableName        string
+	sessionTableName string
+	refreshTableName string
+	migrationsTable  string // where applied migrations are recorded, defaultMigrationsTable if empty
+	connection       *sql.DB
+
+	// prepared statements, keyed by statement text. Only valid for the current connection.
+	stmtLock   sync.Mutex
+	statements map[string]*sql.Stmt
+}
+
+// Statements used by the model. All user supplied values are bound parameters; the only
+// thing formatted in is the table name, which comes from our own config and is checked by
+// isValidTableName. The session statements are formatted with the session table name.
+const (
+	insertUserSQL      = "INSERT into %v (UserName, Email, EmailKey, Password) VALUES ( ?, ?, ?, ? )"
+	updateUserSQL      = "UPDATE %v SET Email = ?, EmailKey = ?, Password = ?, Version = Version + 1 where UserName = ? AND (? = 0 OR Version = ?)"
+	selectUserSQL      = "SELECT ID, UserName, Email, Password, Version from %v where UserName = ?"
+	selectUserByIDSQL  = "SELECT ID, UserName, Email, Password, Version from %v where ID = ?"
+	selectAllUsersSQL  = "SELECT ID, UserName, Email, Password, Version from %v"
+	deleteUserSQL      = "DELETE from %v where UserName = ? AND (? = 0 OR Version = ?)"
+	missingEmailKeySQL = "SELECT ID, Email from %v where EmailKey IS NULL"
+	setEmailKeySQL     = "UPDATE %v SET EmailKey = ? where ID = ?"
+	clearEmailKeysSQL  = "UPDATE %v SET EmailKey = NULL where EmailKey IS NOT NULL"
+
+	insertSessionSQL         = "INSERT into %v (Token, UserName, Expires) VALUES ( ?, ?, ? )"
+	selectSessionSQL         = "SELECT Token, UserName, Expires from %v where Token = ?"
+	deleteSessionSQL         = "DELETE from %v where Token = ?"
+	deleteUserSessionsSQL    = "DELETE from %v where UserName = ?"
+	deleteExpiredSessionsSQL = "DELETE from %v where Expires <= ?"
+
+	insertRefreshTokenSQL         = "INSERT into %v (Token, UserName, Expires) VALUES ( ?, ?, ? )"
+	selectRefreshTokenSQL         = "SELECT Token, UserName, Expires from %v where Token = ?"
+	deleteRefreshTokenSQL         = "DELETE from %v where Token = ?"
+	deleteUserRefreshTokensSQL    = "DELETE from %v where UserName = ?"
+	deleteExpiredRefreshTokensSQL = "DELETE from %v where Expires <= ?"
+)
+
+// sqlDialect - what differs between the databases MyDB runs against.
+type sqlDialect struct {
+	driverName   string // for sql.Open
+	system       string // db.system.name in traces
+	maxOpenConns int    // 0 for no limit
+	migrations   migrationDialect
+	// truncate empties a table and resets its IDs, statement by statement.
+	truncate []string
+	// likeEscape follows each LIKE, so escapeLike's backslashes are understood.
+	likeEscape string
+	// rebind rewrites our '?' placeholders into the driver's own, if it has others.
+	rebind func(query string) string
+	// returning follows an INSERT to read back the new row, for drivers with no LastInsertId.
+	returning string
+	// duplicateKey returns the unique index or column a failed write collided on.
+	duplicateKey func(err error) (string, bool)
+}
+
+var mysqlDialect = sqlDialect{
+	driverName:   "mysql",
+	system:       "mysql",
+	migrations:   mysqlMigrationDialect,
+	truncate:     []string{"TRUNCATE table %v"},
+	duplicateKey: mysqlDuplicateKey,
+}
+
+// mySQL's error number for a row that would break a UNIQUE index.
+const mysqlDuplicateEntry = 1062
+
+// mysqlDuplicateKey - "Duplicate entry '...' for key 'table.index'", or just 'index' before mySQL 8.
+func mysqlDuplicateKey(err error) (string, bool) {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) == false || mysqlErr.Number != mysqlDuplicateEntry {
+		return "", false
+	}
+	return strings.Trim(mysqlErr.Message[strings.LastIndex(mysqlErr.Message, " ")+1:], "'"), true
+}
+
+// duplicateStatus maps an error from a write onto ModelDuplicateUserName or ModelDuplicateEmail
+// if it is a duplicate key, going by the index it collided on.
+func (dialect sqlDialect) duplicateStatus(err error) (ModelStatusCode, bool) {
+	key, isDuplicate := dialect.duplicateKey(err)
+	if isDuplicate == false {
+		return ModelSuccess, false
+	}
+	if strings.EqualFold(key[strings.LastIndex(key, ".")+1:], "EmailKey") {
+		return ModelDuplicateEmail, true
+	}
+	return ModelDuplicateUserName, true
+}
+
+// emailKey returns the EmailKey column value for email: its normalized form with uniqueEmails
+// set, otherwise NULL.
+func emailKey(email string) interface{} {
+	if uniqueEmails == false {
+		return nil
+	}
+	return normalizeEmail(email)
+}
+
+var tableNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,63}$`)
+
+func isValidTableName(tableName string) bool {
+	return tableNamePattern.MatchString(tableName)
 }
 
 func (dbInfo *MyDB) closeDBConnection() {
+	dbInfo.stmtLock.Lock()
+	for _, stmt := range dbInfo.statements {
+		stmt.Close()
+	}
+	dbInfo.statements = nil
+	dbInfo.stmtLock.Unlock()
+
 	if dbInfo.connection != nil {
 		dbInfo.connection.Close()
 		dbInfo.connection = nil
 	}
 }
 
-func (dbInfo MyDB) isValidDBConnection() bool {
+// statement returns the prepared statement for queryFmt against the user table, to run for ctx.
+func (dbInfo *MyDB) statement(ctx context.Context, queryFmt string) (*tracedStmt, error) {
+	return dbInfo.prepared(ctx, fmt.Sprintf(queryFmt, dbInfo.tableName))
+}
+
+// sessionStatement returns the prepared statement for queryFmt against the session table.
+func (dbInfo *MyDB) sessionStatement(ctx context.Context, queryFmt string) (*tracedStmt, error) {
+	return dbInfo.prepared(ctx, fmt.Sprintf(queryFmt, dbInfo.sessionTableName))
+}
+
+// refreshStatement returns the prepared statement for queryFmt against the refresh token table.
+func (dbInfo *MyDB) refreshStatement(ctx context.Context, queryFmt string) (*tracedStmt, error) {
+	return dbInfo.prepared(ctx, fmt.Sprintf(queryFmt, dbInfo.refreshTableName))
+}
+
+// prepared returns the prepared statement for query, preparing and caching it on first use. Each
+// execution is traced as part of ctx - see tracing.go. The prepare runs under ctx and outside
+// stmtLock, so a slow one neither outlives its request nor holds up other queries; if two race to
+// prepare the same query, the first one cached wins and the other is closed.
+func (dbInfo *MyDB) prepared(ctx context.Context, query string) (*tracedStmt, error) {
+	if dbInfo.dialect.rebind != nil {
+		query = dbInfo.dialect.rebind(query)
+	}
+	dbInfo.stmtLock.Lock()
+	stmt, ok := dbInfo.statements[query]
+	dbInfo.stmtLock.Unlock()
+	if ok == false {
+		prepared, err := dbInfo.connection.PrepareContext(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		dbInfo.stmtLock.Lock()
+		if stmt, ok = dbInfo.statements[query]; ok == false {
+			if dbInfo.statements == nil {
+				dbInfo.statements = make(map[string]*sql.Stmt)
+			}
+			stmt = prepared
+			dbInfo.statements[query] = stmt
+		}
+		dbInfo.stmtLock.Unlock()
+		if stmt != prepared {
+			prepared.Close()
+		}
+	}
+	return &tracedStmt{ctx: ctx, stmt: stmt, query: query, system: dbInfo.dialect.system, dbName: dbInfo.dbName}, nil
+}
+
+func (dbInfo *MyDB) isValidDBConnection() bool {
 	return dbInfo.connection != nil
 }
 
+// connectionPool - the sql.DB, for its stats; see metrics.go.
+func (dbInfo *MyDB) connectionPool() (*sql.DB, string) {
+	return dbInfo.connection, dbInfo.dbName
+}
+
 func (dbInfo *MyDB) openDBConnection() bool {
 	var err error
-	dbInfo.connection, err = sql.Open("mysql", "root:@Bubba1111@tcp(127.0.0.1:3306)/"+dbInfo.dbName)
+	dbInfo.connection, err = sql.Open(dbInfo.dialect.driverName, dbInfo.dsn)
 	if err != nil {
-		log.Printf("openDBConnection(): ERROR: failed to open db %v: %v", dbInfo.dbName, err)
+		slog.Error("openDBConnection(): failed to open db", "db", dbInfo.dbName, "err", err)
 		return false
 	}
+	dbInfo.connection.SetMaxOpenConns(dbInfo.dialect.maxOpenConns)
+	return true
+}
+
+// hasValidTableNames checks our configured table names before they go anywhere near SQL.
+func (dbInfo *MyDB) hasValidTableNames() bool {
+	for _, tableName := range []string{dbInfo.tableName, dbInfo.sessionTableName, dbInfo.refreshTableName, dbInfo.migrationsTableName()} {
+		if isValidTableName(tableName) == false {
+			slog.Error("MyDB: invalid table name", "table", tableName)
+			return false
+		}
+	}
 	return true
 }
 
-var myDB = MyDB{dbName: "entrypoint", tableName: "usersTest"}
+func (dbInfo *MyDB) migrationsTableName() string {
+	if dbInfo.migrationsTable == "" {
+		return defaultMigrationsTable
+	}
+	return dbInfo.migrationsTable
+}
 
-// User - basic user definition
-//
-// The UserName is the key. The id would usually be the primary key and the UserName a secondary key.
-type User struct {
-	ID       int    `json:"ID"`
-	UserName string `json:"UserName"`
-	Email    string `json:"Email"`
-	Password string `json:"Password"`
+// migrator returns the schema migrator for our tables - see migrate.go and migrations/<driver>.
+func (dbInfo *MyDB) migrator() *Migrator {
+	return newMigrator(dbInfo.connection, dbInfo.dialect.migrations, dbInfo.migrationsTableName(), map[string]string{
+		"users":          dbInfo.tableName,
+		"sessions":       dbInfo.sessionTableName,
+		"refresh_tokens": dbInfo.refreshTableName,
+	})
 }
 
-// Simply determine if the requisite table exists, and if not, create it
-func checkAndCreateTable() bool {
-	if myDB.isValidDBConnection() == false {
-		log.Printf("    no db connection")
+// Migrate - applies or reverts schema migrations.
+func (dbInfo *MyDB) Migrate(direction string, steps int) bool {
+	if dbInfo.hasValidTableNames() == false {
 		return false
 	}
-	query := fmt.Sprintf("Show tables like '%v'", myDB.tableName)
-	tableResp, err := myDB.connection.Query(query)
-	if err != nil {
-		log.Printf("    error looking up table information for table %v", myDB.tableName)
+	if dbInfo.isValidDBConnection() == false && dbInfo.openDBConnection() == false {
+		slog.Error("MyDB.Migrate(): no db connection")
 		return false
 	}
-	count := 0
-	for tableResp.Next() {
-		count++
-	}
-	if count > 0 {
-		return true
+	var err error
+	if direction == migrateDown {
+		err = dbInfo.migrator().Down(context.Background(), steps)
+	} else {
+		err = dbInfo.migrator().Up(context.Background(), steps)
 	}
-	log.Printf("    table '%v' not found, will create", myDB.tableName)
-	// I know, I know, I should data drive this from the User struct , ,gain, not that ambitious.
-	createTableQuery := "create table " + myDB.tableName + " (ID int NOT NULL AUTO_INCREMENT, UserName varchar(255) NOT NULL UNIQUE, email varchar(255), password varchar(255), PRIMARY KEY (ID));"
-	stmt, err := myDB.connection.Prepare(createTableQuery)
 	if err != nil {
-		log.Printf("    command to prepare statement to create table '%v' failed: %v", myDB.tableName, err)
-	}
-	if _, err = stmt.Exec(); err != nil {
-		log.Printf("    command to create table '%v' failed: %v", myDB.tableName, err)
+		slog.Error("MyDB.Migrate(): failed", "err", err)
 		return false
 	}
-
-	log.Printf("    table '%v' created successfully..", myDB.tableName)
 	return true
 }
 
-func initDB() bool {
+// MigrationStatus - lists the schema migrations and which have been applied.
+func (dbInfo *MyDB) MigrationStatus() ([]MigrationState, bool) {
+	if dbInfo.hasValidTableNames() == false {
+		return nil, false
+	}
+	if dbInfo.isValidDBConnection() == false && dbInfo.openDBConnection() == false {
+		slog.Error("MyDB.MigrationStatus(): no db connection")
+		return nil, false
+	}
+	states, err := dbInfo.migrator().Status(context.Background())
+	if err != nil {
+		slog.Error("MyDB.MigrationStatus(): failed", "err", err)
+		return nil, false
+	}
+	return states, true
+}
+
+// InitDB - opens the connection and migrates our tables to the current schema.
+func (dbInfo *MyDB) InitDB() bool {
+	if dbInfo.hasValidTableNames() == false {
+		return false
+	}
 	// open our db
-	log.Printf("initDB(): opening db %v", myDB.dbName)
-	if myDB.openDBConnection() == false {
+	slog.Info("MyDB.InitDB(): opening db", "db", dbInfo.dbName)
+	if dbInfo.openDBConnection() == false {
+		return false
+	}
+	// bring the schema up to date. Another instance may be doing the same; the migrator serializes us.
+	if dbInfo.Migrate(migrateUp, 0) == false {
 		return false
 	}
-	// check for existence of our table, attempt to create if not found
-	if checkAndCreateTable() == false {
+	if dbInfo.syncEmailKeys() == false {
 		return false
 	}
 
-	log.Println("initDB(): OK")
+	slog.Info("MyDB.InitDB(): OK")
 	return true
 }
 
-func releaseDB() {
-	log.Println("releaseDB()")
-	if myDB.connection != nil {
-		myDB.connection.Close()
+// syncEmailKeys brings the EmailKey column into line with uniqueEmails: filled in for every user
+// while it is set, so existing users are held to it too, and cleared while it isn't.
+func (dbInfo *MyDB) syncEmailKeys() bool {
+	var err error
+	if uniqueEmails {
+		err = dbInfo.setEmailKeys(context.Background())
+	} else {
+		var stmt *tracedStmt
+		if stmt, err = dbInfo.statement(context.Background(), clearEmailKeysSQL); err == nil {
+			_, err = stmt.Exec()
+		}
 	}
-	log.Println("releaseDB(): OK")
+	if _, isDuplicate := dbInfo.dialect.duplicateStatus(err); isDuplicate {
+		slog.Error("MyDB.InitDB(): cannot require unique emails, some users already share one", "err", err)
+		return false
+	} else if err != nil {
+		slog.Error("MyDB.InitDB(): failed to update email keys", "err", err)
+		return false
+	}
+	return true
 }
 
-func isValidUser(user User) (bool, string) {
-	var ret bool // false by default
-	var reason string
+// setEmailKeys fills in EmailKey for every user without one, all or nothing. The keys are made here
+// by emailKey, as they are for new writes, rather than in SQL: LOWER and TRIM fold and strip less
+// (SQLite's LOWER only folds ASCII), and a key that differs from a later write's would let the
+// same email in twice.
+func (dbInfo *MyDB) setEmailKeys(ctx context.Context) error {
+	tx, err := dbInfo.connection.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-	// I know, I know, it only returns the first failure, but we get the idea.
-	if len(user.UserName) < 1 {
-		reason = "empty user name"
-	} else if len(user.Email) < 1 {
-		reason = "invalid email"
-	} else if len(user.Password) < 1 {
-		reason = "invalid password"
-	} else {
-		ret = true // ok, now is acceptable
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf(missingEmailKeySQL, dbInfo.tableName))
+	if err != nil {
+		return err
+	}
+	var ids []int
+	var keys []interface{}
+	for rows.Next() {
+		var id int
+		var email sql.NullString
+		if err = rows.Scan(&id, &email); err != nil {
+			rows.Close()
+			return err
+		}
+		if email.Valid {
+			ids, keys = append(ids, id), append(keys, emailKey(email.String))
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf(setEmailKeySQL, dbInfo.tableName)
+	if dbInfo.dialect.rebind != nil {
+		query = dbInfo.dialect.rebind(query)
+	}
+	stmt, err := tx.PrepareContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for i, id := range ids {
+		if _, err = stmt.ExecContext(ctx, keys[i], id); err != nil {
+			return err
+		}
 	}
-	return ret, reason
+	return tx.Commit()
 }
 
-func modelCreateUser(newUser User) (User, ModelStatusCode, string) {
-	if myDB.isValidDBConnection() == false && myDB.openDBConnection() == false {
-		log.Printf("isValidDBConnection(): no db connection")
+// Ping - checks the database is reachable.
+func (dbInfo *MyDB) Ping(ctx context.Context) error {
+	if dbInfo.isValidDBConnection() == false {
+		return fmt.Errorf("no db connection")
+	}
+	return dbInfo.connection.PingContext(ctx)
+}
+
+// ReleaseDB - closes the connection.
+func (dbInfo *MyDB) ReleaseDB() {
+	slog.Info("MyDB.ReleaseDB()")
+	dbInfo.closeDBConnection()
+	slog.Info("MyDB.ReleaseDB(): OK")
+}
+
+// CreateUser - inserts a new user and returns them as stored, with the ID and version the database gave them.
+func (dbInfo *MyDB) CreateUser(ctx context.Context, newUser User) (User, ModelStatusCode, string) {
+	if dbInfo.isValidDBConnection() == false && dbInfo.openDBConnection() == false {
+		loggerFor(ctx).Error("MyDB.CreateUser(): no db connection")
 		return newUser, ModelDBCreateFailure, "no db connection"
 	}
 
-	var retCode ModelStatusCode
-	var reason string
 	// test for valid record
 	if isValid, errorStr := isValidUser(newUser); isValid == false {
-		return newUser, ModelDBCreateFailure, errorStr
+		return newUser, ModelInvalidUser, errorStr
 	}
 
 	// ID is autoincremented
-	query := fmt.Sprintf("INSERT into %v VALUES ( NULL, '%v', '%v', '%v' )", myDB.tableName, newUser.UserName, newUser.Email, newUser.Password)
-
-	log.Println("    modelCreateUser(): using", query)
-	insert, err := myDB.connection.Query(query)
+	stmt, err := dbInfo.statement(ctx, insertUserSQL+dbInfo.dialect.returning)
 	if err != nil {
-		retCode = ModelDBCreateFailure
-		reason = fmt.Sprintf("failed to insert newUser %v: %v", newUser, err)
-		return newUser, retCode, reason
+		return newUser, ModelDBCreateFailure, fmt.Sprintf("failed to prepare insert: %v", err)
+	}
+	loggerFor(ctx).Debug("MyDB.CreateUser(): inserting user", "userName", newUser.UserName)
+	args := []interface{}{newUser.UserName, newUser.Email, emailKey(newUser.Email), newUser.Password}
+	var created User
+	var id int64
+	if dbInfo.dialect.returning != "" {
+		err = stmt.QueryRow(args...).Scan(&created.ID, &created.UserName, &created.Email, &created.Password, &created.Version)
+	} else {
+		var res sql.Result
+		if res, err = stmt.Exec(args...); err == nil {
+			id, err = res.LastInsertId()
+		}
+	}
+	if err != nil {
+		if retCode, isDuplicate := dbInfo.dialect.duplicateStatus(err); isDuplicate {
+			return newUser, retCode, fmt.Sprintf("user '%v' or their email already exists", newUser.UserName)
+		}
+		return newUser, ModelDBCreateFailure, fmt.Sprintf("failed to insert user '%v': %v", newUser.UserName, err)
+	}
+	if dbInfo.dialect.returning != "" {
+		return created, ModelSuccess, ""
 	}
-	defer insert.Close()
 
-	// todo - pyll newUser here from insert.
-	return newUser, ModelSuccess, ""
+	// read back by ID rather than name, so it is this insert we see whatever has happened since.
+	if stmt, err = dbInfo.statement(ctx, selectUserByIDSQL); err == nil {
+		err = stmt.QueryRow(id).Scan(&created.ID, &created.UserName, &created.Email, &created.Password, &created.Version)
+	}
+	if err != nil {
+		// the user is in; don't fail a create that happened, report what we know of it.
+		loggerFor(ctx).Warn("MyDB.CreateUser(): failed to read back new user", "userName", newUser.UserName, "err", err)
+		newUser.ID, newUser.Version = int(id), 1
+		return newUser, ModelSuccess, ""
+	}
+	return created, ModelSuccess, ""
 }
 
-func modelUpdateUser(user User) (User, ModelStatusCode, string) {
+// UpdateUser - overwrites the email and password of an existing user, then reads back the result.
+func (dbInfo *MyDB) UpdateUser(ctx context.Context, user User, ifVersion int) (User, ModelStatusCode, string) {
 	// test for valid record
 	if isValid, errorStr := isValidUser(user); isValid == false {
-		return user, ModelDBUpdateFailure, errorStr
+		return user, ModelInvalidUser, errorStr
 	}
-	if myDB.isValidDBConnection() == false && myDB.openDBConnection() == false {
-		log.Printf("modelUpdateUser(): no db connection")
+	if dbInfo.isValidDBConnection() == false && dbInfo.openDBConnection() == false {
+		loggerFor(ctx).Error("MyDB.UpdateUser(): no db connection")
 		return user, ModelDBUpdateFailure, "no db connection"
 	}
 
-	query := fmt.Sprintf("UPDATE %v SET Email = '%v', Password = '%v' where UserName = '%v';",
-		myDB.tableName, user.Email, user.Password, user.UserName)
-	log.Printf("modelUpdateUser(): query: %v", query)
-	res, err := myDB.connection.Exec(query)
+	stmt, err := dbInfo.statement(ctx, updateUserSQL)
 	if err != nil {
+		return user, ModelDBUpdateFailure, fmt.Sprintf("failed to prepare update: %v", err)
+	}
+	loggerFor(ctx).Debug("MyDB.UpdateUser(): updating user", "userName", user.UserName)
+	res, err := stmt.Exec(user.Email, emailKey(user.Email), user.Password, user.UserName, ifVersion, ifVersion)
+	if err != nil {
+		if retCode, isDuplicate := dbInfo.dialect.duplicateStatus(err); isDuplicate {
+			return user, retCode, fmt.Sprintf("email '%v' is already in use", user.Email)
+		}
 		return user, ModelDBUpdateFailure, fmt.Sprintf("failed to update record for user '%v': %v", user.UserName, err)
 	}
 
-	numUpdated, err := res.RowsAffected() // we expect one row affected. If 0 we did not find the user.
+	numUpdated, err := res.RowsAffected() // we expect one row affected. If 0 we did not find the user, or it moved on.
 	if err != nil {
-		panic(err)
+		return user, ModelDBUpdateFailure, fmt.Sprintf("failed to count updated records for user '%v': %v", user.UserName, err)
 	}
 	if numUpdated == 0 {
-		return user, ModelDBUpdateFailure, fmt.Sprintf("user %v not found to update'", user.UserName)
+		if current, retCode, _ := dbInfo.GetUser(ctx, user.UserName); retCode == ModelSuccess {
+			return current, ModelVersionConflict, fmt.Sprintf("user '%v' has been modified, cannot update", user.UserName)
+		}
+		return user, ModelDBUserNotFound, fmt.Sprintf("user '%v' not found, cannot update", user.UserName)
 	}
 	if numUpdated != 1 {
 		return user, ModelDBUpdateFailure,
 			fmt.Sprintf("key error updating user '%v', %v instanced updated", user.UserName, numUpdated)
 	}
 
-	return user, ModelSuccess, ""
+	return dbInfo.GetUser(ctx, user.UserName)
+}
+
+// PatchUser - writes only the changed columns of an existing user, then reads back the result.
+func (dbInfo *MyDB) PatchUser(ctx context.Context, userName string, changes UserChanges, ifVersion int) (User, ModelStatusCode, string) {
+	if dbInfo.isValidDBConnection() == false && dbInfo.openDBConnection() == false {
+		loggerFor(ctx).Error("MyDB.PatchUser(): no db connection")
+		return User{}, ModelDBUpdateFailure, "no db connection"
+	}
+
+	var columns []string
+	var args []interface{}
+	if changes.Email != nil {
+		columns = append(columns, "Email = ?", "EmailKey = ?")
+		args = append(args, *changes.Email, emailKey(*changes.Email))
+	}
+	if changes.Password != nil {
+		columns = append(columns, "Password = ?")
+		args = append(args, *changes.Password)
+	}
+	if len(columns) > 0 {
+		columns = append(columns, "Version = Version + 1")
+		stmt, err := dbInfo.statement(ctx, "UPDATE %v SET "+strings.Join(columns, ", ")+" where UserName = ? AND (? = 0 OR Version = ?)")
+		if err != nil {
+			return User{}, ModelDBUpdateFailure, fmt.Sprintf("failed to prepare update: %v", err)
+		}
+		loggerFor(ctx).Debug("MyDB.PatchUser(): updating user", "userName", userName, "columns", len(columns))
+		res, err := stmt.Exec(append(args, userName, ifVersion, ifVersion)...)
+		if err != nil {
+			if retCode, isDuplicate := dbInfo.dialect.duplicateStatus(err); isDuplicate {
+				return User{}, retCode, fmt.Sprintf("email '%v' is already in use", *changes.Email)
+			}
+			return User{}, ModelDBUpdateFailure, fmt.Sprintf("failed to update record for user '%v': %v", userName, err)
+		}
+		// the version always changes, so 0 rows means the user is missing or has moved on.
+		numUpdated, err := res.RowsAffected()
+		if err == nil && numUpdated > 1 {
+			return User{}, ModelDBUpdateFailure,
+				fmt.Sprintf("key error updating user '%v', %v instanced updated", userName, numUpdated)
+		}
+		if err == nil && numUpdated == 0 {
+			current, retCode, reason := dbInfo.GetUser(ctx, userName)
+			if retCode == ModelSuccess {
+				return current, ModelVersionConflict, fmt.Sprintf("user '%v' has been modified, cannot update", userName)
+			}
+			return current, retCode, reason
+		}
+	}
+	return dbInfo.GetUser(ctx, userName)
 }
 
-func modelGetUser(userName string) (User, ModelStatusCode, string) {
+// GetUser - looks up a single user by user name.
+func (dbInfo *MyDB) GetUser(ctx context.Context, userName string) (User, ModelStatusCode, string) {
 	var user User
 
 	if len(userName) < 1 {
 		return user, ModelDBGetFailure, "User name not supplied"
 	}
 
-	if myDB.isValidDBConnection() == false && myDB.openDBConnection() == false {
-		log.Printf("modelGetUser(): no db connection")
+	if dbInfo.isValidDBConnection() == false && dbInfo.openDBConnection() == false {
+		loggerFor(ctx).Error("MyDB.GetUser(): no db connection")
 		return user, ModelDBGetFailure, "no db connection"
 	}
-	query := fmt.Sprintf("SELECT ID, UserName, Email, Password from %v where UserName = '%v'", myDB.tableName, userName)
-	log.Printf("modelGetUser(): query: %v", query)
-	results, err := myDB.connection.Query(query)
+	stmt, err := dbInfo.statement(ctx, selectUserSQL)
+	if err != nil {
+		return user, ModelDBGetFailure, fmt.Sprintf("failed to prepare select: %v", err)
+	}
+	loggerFor(ctx).Debug("MyDB.GetUser(): retrieving user", "userName", userName)
+	results, err := stmt.Query(userName)
 	if err != nil {
 		return user, ModelDBGetFailure, fmt.Sprintf("error retrieving record for user '%v': %v", userName, err)
 	}
 	defer results.Close()
 	var cnt = 0
 	for results.Next() {
-		err = results.Scan(&user.ID, &user.UserName, &user.Email, &user.Password)
+		err = results.Scan(&user.ID, &user.UserName, &user.Email, &user.Password, &user.Version)
 		if err != nil {
 			return user, ModelDBGetFailure, fmt.Sprintf("failed to pull values from record for user '%v': %v", userName, err)
 		}
@@ -223,80 +564,342 @@ func modelGetUser(userName string) (User, ModelStatusCode, string) {
 	return user, ModelSuccess, ""
 }
 
-func modelGetAllUsers() ([]User, ModelStatusCode, string) {
-	var users []User
+// userQueryFilters builds the WHERE conditions and arguments for the filters in query.
+func (dialect sqlDialect) userQueryFilters(query UserQuery) ([]string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	if query.UserNamePrefix != "" {
+		conditions = append(conditions, "UserName LIKE ?"+dialect.likeEscape)
+		args = append(args, escapeLike(query.UserNamePrefix)+"%")
+	}
+	if query.EmailDomain != "" {
+		conditions = append(conditions, "Email LIKE ?"+dialect.likeEscape)
+		args = append(args, "%@"+escapeLike(query.EmailDomain))
+	}
+	return conditions, args
+}
+
+// escapeLike escapes the LIKE wildcards in value, so user supplied filters only ever match literally.
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(value)
+}
+
+func whereClause(conditions []string) string {
+	if len(conditions) == 0 {
+		return ""
+	}
+	return " where " + strings.Join(conditions, " AND ")
+}
+
+// GetAllUsers - returns a page of the users matching query, using keyset paging on (sort column, ID).
+func (dbInfo *MyDB) GetAllUsers(ctx context.Context, query UserQuery) (UserPage, ModelStatusCode, string) {
+	var page UserPage
+
+	isValid, reason, cursor := isValidUserQuery(query)
+	if isValid == false {
+		return page, ModelInvalidQuery, reason
+	}
+	if dbInfo.isValidDBConnection() == false && dbInfo.openDBConnection() == false {
+		loggerFor(ctx).Error("MyDB.GetAllUsers(): no db connection")
+		return page, ModelDBGetFailure, "no db connection"
+	}
+
+	// total across all pages, ignoring the cursor.
+	conditions, args := dbInfo.dialect.userQueryFilters(query)
+	stmt, err := dbInfo.statement(ctx, "SELECT COUNT(*) from %v"+whereClause(conditions))
+	if err != nil {
+		return page, ModelDBGetFailure, fmt.Sprintf("failed to prepare count: %v", err)
+	}
+	if err = stmt.QueryRow(args...).Scan(&page.Total); err != nil {
+		return page, ModelDBGetFailure, fmt.Sprintf("failed to count records: %v", err)
+	}
+
+	// the column name comes from isValidUserQuery's whitelist, never from the request as such.
+	column := query.sortBy()
+	direction, compare := "ASC", ">"
+	if query.Descending {
+		direction, compare = "DESC", "<"
+	}
+	if cursor != nil {
+		if column == sortByID {
+			conditions = append(conditions, "ID "+compare+" ?")
+			args = append(args, cursor.ID)
+		} else {
+			conditions = append(conditions, fmt.Sprintf("(%[1]v %[2]v ? OR (%[1]v = ? AND ID %[2]v ?))", column, compare))
+			args = append(args, cursor.Key, cursor.Key, cursor.ID)
+		}
+	}
+	orderBy := " ORDER BY ID " + direction
+	if column != sortByID {
+		orderBy = fmt.Sprintf(" ORDER BY %[1]v %[2]v, ID %[2]v", column, direction)
+	}
+	// one extra row tells us whether there is another page.
+	args = append(args, query.pageSize()+1)
 
-	if myDB.isValidDBConnection() == false && myDB.openDBConnection() == false {
-		log.Printf("modelGetAllUsers(): no db connection")
-		return users, ModelDBGetFailure, "no db connection"
+	if stmt, err = dbInfo.statement(ctx, selectAllUsersSQL+whereClause(conditions)+orderBy+" LIMIT ?"); err != nil {
+		return page, ModelDBGetFailure, fmt.Sprintf("failed to prepare select: %v", err)
 	}
-	query := fmt.Sprintf("SELECT ID, UserName, Email, Password from %v", myDB.tableName)
-	log.Printf("modelGetAllUsers(): query: %v", query)
-	results, err := myDB.connection.Query(query)
+	loggerFor(ctx).Debug("MyDB.GetAllUsers(): retrieving users")
+	results, err := stmt.Query(args...)
 	if err != nil {
-		return users, ModelDBGetFailure, fmt.Sprintf("failed to retrieve records: %v", err)
+		return page, ModelDBGetFailure, fmt.Sprintf("failed to retrieve records: %v", err)
 	}
 	defer results.Close()
+	page.Users = []User{}
 	for results.Next() {
 		var user User
-		err = results.Scan(&user.ID, &user.UserName, &user.Email, &user.Password)
+		err = results.Scan(&user.ID, &user.UserName, &user.Email, &user.Password, &user.Version)
 		if err != nil {
-			return users, ModelDBGetFailure, fmt.Sprintf("failed to pull values from record: %v", err)
+			return page, ModelDBGetFailure, fmt.Sprintf("failed to pull values from record: %v", err)
 		}
-		users = append(users, user)
+		page.Users = append(page.Users, user)
 	}
-	return users, ModelSuccess, ""
+	if pageSize := query.pageSize(); len(page.Users) > pageSize {
+		page.Users = page.Users[:pageSize]
+		page.NextCursor = query.nextCursor(page.Users[pageSize-1])
+	}
+	return page, ModelSuccess, ""
 }
 
-func modelDeleteUser(userName string) (User, ModelStatusCode, string) {
+// DeleteUser - removes a single user, returning the removed record.
+func (dbInfo *MyDB) DeleteUser(ctx context.Context, userName string, ifVersion int) (User, ModelStatusCode, string) {
 	var user User
 
 	if len(userName) < 1 {
 		return user, ModelDBDeleteFailure, "User name not supplied"
 	}
 
-	if myDB.isValidDBConnection() == false && myDB.openDBConnection() == false {
-		log.Printf("modelGetAllUsers(): no db connection")
+	if dbInfo.isValidDBConnection() == false && dbInfo.openDBConnection() == false {
+		loggerFor(ctx).Error("MyDB.DeleteUser(): no db connection")
 		return user, ModelDBGetFailure, "no db connection"
 	}
 
 	// pull out old record. Ignore the errors, we'll try to delete it anyways if not found
-	oldUser, ret, reason := modelGetUser(userName)
+	oldUser, ret, reason := dbInfo.GetUser(ctx, userName)
 	if ret == ModelDBUserNotFound {
 		return oldUser, ret, reason
 	}
 
-	query := fmt.Sprintf("DELETE from %v where UserName = '%v'", myDB.tableName, userName)
-	log.Printf("modelDeleteUser(): query: %v", query)
-	results, err := myDB.connection.Query(query)
+	stmt, err := dbInfo.statement(ctx, deleteUserSQL)
+	if err != nil {
+		return user, ModelDBDeleteFailure, fmt.Sprintf("failed to prepare delete: %v", err)
+	}
+	loggerFor(ctx).Debug("MyDB.DeleteUser(): deleting user", "userName", userName)
+	res, err := stmt.Exec(userName, ifVersion, ifVersion)
 	if err != nil {
 		return user, ModelDBDeleteFailure, fmt.Sprintf("failed to delete record for user '%v': %v", userName, err)
 	}
-	defer results.Close()
+	if numDeleted, err := res.RowsAffected(); err == nil && numDeleted == 0 && ifVersion != 0 {
+		return oldUser, ModelVersionConflict, fmt.Sprintf("user '%v' has been modified, cannot delete", userName)
+	}
 	return oldUser, ModelSuccess, ""
 }
 
-func modelDeleteAllUsers() (ModelStatusCode, string) {
-	var users []User
-
-	if myDB.isValidDBConnection() == false && myDB.openDBConnection() == false {
-		log.Printf("modelDeleteAllUsers(): no db connection")
+// DeleteAllUsers - truncates the user table, and with it the session and refresh token tables.
+func (dbInfo *MyDB) DeleteAllUsers(ctx context.Context) (ModelStatusCode, string) {
+	if dbInfo.isValidDBConnection() == false && dbInfo.openDBConnection() == false {
+		loggerFor(ctx).Error("MyDB.DeleteAllUsers(): no db connection")
 		return ModelDBGetFailure, "no db connection"
 	}
-	query := fmt.Sprintf("TRUNCATE table %v;", myDB.tableName)
-	log.Printf("modelDeleteAllUsers(): query: %v", query)
-	results, err := myDB.connection.Query(query)
-	if err != nil {
+	loggerFor(ctx).Debug("MyDB.DeleteAllUsers(): truncating table")
+	if err := dbInfo.truncate(ctx, dbInfo.tableName); err != nil {
 		return ModelDBGetFailure, fmt.Sprintf("failed to delete all records: %v", err)
 	}
-	defer results.Close()
-	for results.Next() {
-		var user User
-		err = results.Scan(&user.ID, &user.UserName, &user.Email, &user.Password)
+	if err := dbInfo.truncate(ctx, dbInfo.sessionTableName); err != nil {
+		return ModelDBGetFailure, fmt.Sprintf("failed to delete all sessions: %v", err)
+	}
+	if err := dbInfo.truncate(ctx, dbInfo.refreshTableName); err != nil {
+		return ModelDBGetFailure, fmt.Sprintf("failed to delete all refresh tokens: %v", err)
+	}
+	return ModelSuccess, ""
+}
+
+// truncate empties tableName the dialect's way.
+func (dbInfo *MyDB) truncate(ctx context.Context, tableName string) error {
+	for _, queryFmt := range dbInfo.dialect.truncate {
+		stmt, err := dbInfo.prepared(ctx, fmt.Sprintf(queryFmt, tableName))
 		if err != nil {
-			return ModelDBGetFailure, fmt.Sprintf("failed to delete all records: %v", err)
+			return fmt.Errorf("failed to prepare truncate: %v", err)
+		}
+		if _, err = stmt.Exec(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//// SESSIONS
+
+// CreateSession - stores a new session, clearing out any that have expired while we are at it.
+func (dbInfo *MyDB) CreateSession(ctx context.Context, session Session) (ModelStatusCode, string) {
+	if dbInfo.isValidDBConnection() == false && dbInfo.openDBConnection() == false {
+		loggerFor(ctx).Error("MyDB.CreateSession(): no db connection")
+		return ModelDBSessionFailure, "no db connection"
+	}
+	if stmt, err := dbInfo.sessionStatement(ctx, deleteExpiredSessionsSQL); err == nil {
+		if _, err = stmt.Exec(time.Now().Unix()); err != nil {
+			loggerFor(ctx).Warn("MyDB.CreateSession(): failed to clear expired sessions", "err", err)
 		}
-		users = append(users, user)
+	}
+
+	stmt, err := dbInfo.sessionStatement(ctx, insertSessionSQL)
+	if err != nil {
+		return ModelDBSessionFailure, fmt.Sprintf("failed to prepare insert: %v", err)
+	}
+	if _, err = stmt.Exec(session.TokenHash, session.UserName, session.Expires.Unix()); err != nil {
+		return ModelDBSessionFailure, fmt.Sprintf("failed to insert session for user '%v': %v", session.UserName, err)
+	}
+	return ModelSuccess, ""
+}
+
+// GetSession - looks up a session by token hash. Expired sessions are reported as not found.
+func (dbInfo *MyDB) GetSession(ctx context.Context, tokenHash string) (Session, ModelStatusCode, string) {
+	var session Session
+
+	if dbInfo.isValidDBConnection() == false && dbInfo.openDBConnection() == false {
+		loggerFor(ctx).Error("MyDB.GetSession(): no db connection")
+		return session, ModelDBSessionFailure, "no db connection"
+	}
+	stmt, err := dbInfo.sessionStatement(ctx, selectSessionSQL)
+	if err != nil {
+		return session, ModelDBSessionFailure, fmt.Sprintf("failed to prepare select: %v", err)
+	}
+	var expires int64
+	err = stmt.QueryRow(tokenHash).Scan(&session.TokenHash, &session.UserName, &expires)
+	if err == sql.ErrNoRows {
+		return session, ModelSessionNotFound, "session not found"
+	} else if err != nil {
+		return session, ModelDBSessionFailure, fmt.Sprintf("failed to retrieve session: %v", err)
+	}
+	session.Expires = time.Unix(expires, 0)
+	if session.isExpired() {
+		return Session{}, ModelSessionNotFound, "session expired"
+	}
+	return session, ModelSuccess, ""
+}
+
+// DeleteSession - removes a single session.
+func (dbInfo *MyDB) DeleteSession(ctx context.Context, tokenHash string) (ModelStatusCode, string) {
+	if dbInfo.isValidDBConnection() == false && dbInfo.openDBConnection() == false {
+		loggerFor(ctx).Error("MyDB.DeleteSession(): no db connection")
+		return ModelDBSessionFailure, "no db connection"
+	}
+	stmt, err := dbInfo.sessionStatement(ctx, deleteSessionSQL)
+	if err != nil {
+		return ModelDBSessionFailure, fmt.Sprintf("failed to prepare delete: %v", err)
+	}
+	if _, err = stmt.Exec(tokenHash); err != nil {
+		return ModelDBSessionFailure, fmt.Sprintf("failed to delete session: %v", err)
+	}
+	return ModelSuccess, ""
+}
+
+// DeleteUserSessions - removes every session belonging to userName.
+func (dbInfo *MyDB) DeleteUserSessions(ctx context.Context, userName string) (ModelStatusCode, string) {
+	if dbInfo.isValidDBConnection() == false && dbInfo.openDBConnection() == false {
+		loggerFor(ctx).Error("MyDB.DeleteUserSessions(): no db connection")
+		return ModelDBSessionFailure, "no db connection"
+	}
+	stmt, err := dbInfo.sessionStatement(ctx, deleteUserSessionsSQL)
+	if err != nil {
+		return ModelDBSessionFailure, fmt.Sprintf("failed to prepare delete: %v", err)
+	}
+	if _, err = stmt.Exec(userName); err != nil {
+		return ModelDBSessionFailure, fmt.Sprintf("failed to delete sessions for user '%v': %v", userName, err)
+	}
+	return ModelSuccess, ""
+}
+
+//// REFRESH TOKENS
+
+// CreateRefreshToken - stores a new refresh token, clearing out any that have expired while we are at it.
+func (dbInfo *MyDB) CreateRefreshToken(ctx context.Context, token RefreshToken) (ModelStatusCode, string) {
+	if dbInfo.isValidDBConnection() == false && dbInfo.openDBConnection() == false {
+		loggerFor(ctx).Error("MyDB.CreateRefreshToken(): no db connection")
+		return ModelDBTokenFailure, "no db connection"
+	}
+	if stmt, err := dbInfo.refreshStatement(ctx, deleteExpiredRefreshTokensSQL); err == nil {
+		if _, err = stmt.Exec(time.Now().Unix()); err != nil {
+			loggerFor(ctx).Warn("MyDB.CreateRefreshToken(): failed to clear expired refresh tokens", "err", err)
+		}
+	}
+
+	stmt, err := dbInfo.refreshStatement(ctx, insertRefreshTokenSQL)
+	if err != nil {
+		return ModelDBTokenFailure, fmt.Sprintf("failed to prepare insert: %v", err)
+	}
+	if _, err = stmt.Exec(token.TokenHash, token.UserName, token.Expires.Unix()); err != nil {
+		return ModelDBTokenFailure, fmt.Sprintf("failed to insert refresh token for user '%v': %v", token.UserName, err)
+	}
+	return ModelSuccess, ""
+}
+
+// ConsumeRefreshToken - looks up and deletes a refresh token in one go, so each can only be used once.
+// If two requests race with the same token only the one whose delete lands gets it.
+func (dbInfo *MyDB) ConsumeRefreshToken(ctx context.Context, tokenHash string) (RefreshToken, ModelStatusCode, string) {
+	var token RefreshToken
+
+	if dbInfo.isValidDBConnection() == false && dbInfo.openDBConnection() == false {
+		loggerFor(ctx).Error("MyDB.ConsumeRefreshToken(): no db connection")
+		return token, ModelDBTokenFailure, "no db connection"
+	}
+	stmt, err := dbInfo.refreshStatement(ctx, selectRefreshTokenSQL)
+	if err != nil {
+		return token, ModelDBTokenFailure, fmt.Sprintf("failed to prepare select: %v", err)
+	}
+	var expires int64
+	err = stmt.QueryRow(tokenHash).Scan(&token.TokenHash, &token.UserName, &expires)
+	if err == sql.ErrNoRows {
+		return token, ModelTokenNotFound, "refresh token not found"
+	} else if err != nil {
+		return token, ModelDBTokenFailure, fmt.Sprintf("failed to retrieve refresh token: %v", err)
+	}
+	token.Expires = time.Unix(expires, 0)
+
+	if stmt, err = dbInfo.refreshStatement(ctx, deleteRefreshTokenSQL); err != nil {
+		return RefreshToken{}, ModelDBTokenFailure, fmt.Sprintf("failed to prepare delete: %v", err)
+	}
+	res, err := stmt.Exec(tokenHash)
+	if err != nil {
+		return RefreshToken{}, ModelDBTokenFailure, fmt.Sprintf("failed to delete refresh token: %v", err)
+	}
+	if numDeleted, err := res.RowsAffected(); err != nil || numDeleted != 1 {
+		return RefreshToken{}, ModelTokenNotFound, "refresh token already used"
+	}
+	if token.isExpired() {
+		return RefreshToken{}, ModelTokenNotFound, "refresh token expired"
+	}
+	return token, ModelSuccess, ""
+}
+
+// DeleteRefreshToken - removes a single refresh token.
+func (dbInfo *MyDB) DeleteRefreshToken(ctx context.Context, tokenHash string) (ModelStatusCode, string) {
+	if dbInfo.isValidDBConnection() == false && dbInfo.openDBConnection() == false {
+		loggerFor(ctx).Error("MyDB.DeleteRefreshToken(): no db connection")
+		return ModelDBTokenFailure, "no db connection"
+	}
+	stmt, err := dbInfo.refreshStatement(ctx, deleteRefreshTokenSQL)
+	if err != nil {
+		return ModelDBTokenFailure, fmt.Sprintf("failed to prepare delete: %v", err)
+	}
+	if _, err = stmt.Exec(tokenHash); err != nil {
+		return ModelDBTokenFailure, fmt.Sprintf("failed to delete refresh token: %v", err)
+	}
+	return ModelSuccess, ""
+}
+
+// DeleteUserRefreshTokens - removes every refresh token belonging to userName.
+func (dbInfo *MyDB) DeleteUserRefreshTokens(ctx context.Context, userName string) (ModelStatusCode, string) {
+	if dbInfo.isValidDBConnection() == false && dbInfo.openDBConnection() == false {
+		loggerFor(ctx).Error("MyDB.DeleteUserRefreshTokens(): no db connection")
+		return ModelDBTokenFailure, "no db connection"
+	}
+	stmt, err := dbInfo.refreshStatement(ctx, deleteUserRefreshTokensSQL)
+	if err != nil {
+		return ModelDBTokenFailure, fmt.Sprintf("failed to prepare delete: %v", err)
+	}
+	if _, err = stmt.Exec(userName); err != nil {
+		return ModelDBTokenFailure, fmt.Sprintf("failed to delete refresh tokens for user '%v': %v", userName, err)
 	}
 	return ModelSuccess, ""
 }
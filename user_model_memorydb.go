@@ -0,0 +1,588 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// This is the user model - it roughly corresponds to the model part of MVP
+// This implementation is an in-memeory db for ease of implementation, selected with -store memory.
+// Given a data directory it keeps the users on disk too - see user_model_memorydb_journal.go.
+// Status codes are defined in user_model_status.go
+
+// MemoryDB - in memory user store. Handlers run concurrently, so the users are only touched under
+// userLock, and only copies ever leave the store.
+type MemoryDB struct {
+	// users keyed by userKey, indexed by ID and by normalized email, and kept in order for each sort
+	// field. The indexes are only ever changed along with users, by indexUser and unindexUser.
+	userLock   sync.RWMutex
+	userID     int
+	users      map[string]User
+	userIDs    map[int]string
+	userEmails map[string]map[string]bool // the user keys sharing each email
+	userOrders map[string]*userOrder      // by sortBy* field
+
+	// with a dataDir, changes to the users are journaled there, in the order userLock lets them
+	// through. Empty keeps nothing.
+	dataDir       string
+	snapshotEvery int
+	journal       *userJournal
+
+	// sessions keyed by token hash. A map must not be written concurrently, so it gets its own lock.
+	sessionLock sync.Mutex
+	sessions    map[string]Session
+
+	// refresh tokens keyed by token hash, under their own lock for the same reason.
+	refreshLock   sync.Mutex
+	refreshTokens map[string]RefreshToken
+}
+
+// userKey - what the users are keyed by. User names differing only in case are the same user, as
+// they are under mySQL's collation and Postgres' citext; the record keeps the spelling it was created
+// with.
+func userKey(userName string) string {
+	return strings.ToLower(userName)
+}
+
+// monotonically incrementing id, skipping any still held - a hand edited snapshot could bring
+// back a user beyond the last ID recorded.
+func (memDB *MemoryDB) getUserID() int {
+	for {
+		memDB.userID++
+		if _, taken := memDB.userIDs[memDB.userID]; taken == false {
+			return memDB.userID
+		}
+	}
+}
+
+// resetUsers empties the users and their indexes, and starts the IDs again from 1 as the SQL stores
+// do once truncated. The caller holds userLock.
+func (memDB *MemoryDB) resetUsers() {
+	memDB.userID = 0
+	memDB.users = make(map[string]User)
+	memDB.userIDs = make(map[int]string)
+	memDB.userEmails = make(map[string]map[string]bool)
+	memDB.userOrders = make(map[string]*userOrder)
+	for _, sortBy := range []string{sortByID, sortByUserName, sortByEmail} {
+		memDB.userOrders[sortBy] = &userOrder{users: memDB.users, ascending: UserQuery{SortBy: sortBy}}
+	}
+}
+
+// indexUser stores user, replacing any earlier record of theirs. The caller holds userLock.
+func (memDB *MemoryDB) indexUser(user User) {
+	key := userKey(user.UserName)
+	memDB.unindexUser(key)
+	memDB.users[key] = user
+	memDB.userIDs[user.ID] = key
+	for _, order := range memDB.userOrders {
+		order.insert(user)
+	}
+	email := normalizeEmail(user.Email)
+	if memDB.userEmails[email] == nil {
+		memDB.userEmails[email] = make(map[string]bool)
+	}
+	memDB.userEmails[email][key] = true
+}
+
+// unindexUser removes the user stored under key, if there is one. The caller holds userLock.
+func (memDB *MemoryDB) unindexUser(key string) {
+	user, exists := memDB.users[key]
+	if exists == false {
+		return
+	}
+	for _, order := range memDB.userOrders {
+		order.remove(user)
+	}
+	delete(memDB.users, key)
+	delete(memDB.userIDs, user.ID)
+	email := normalizeEmail(user.Email)
+	delete(memDB.userEmails[email], key)
+	if len(memDB.userEmails[email]) == 0 {
+		delete(memDB.userEmails, email)
+	}
+}
+
+// userOrder - the keys of the users in one sort order, kept sorted as they come and go so that
+// GetAllUsers can slice a page out of it rather than sort every user on every request.
+type userOrder struct {
+	users     map[string]User
+	ascending UserQuery // sorts by the field this order is for
+	names     []string
+}
+
+// search returns the position of the first user for whom isAfter is true. isAfter must be false
+// for every user before that position and true for every one from it on.
+func (order *userOrder) search(isAfter func(user User) bool) int {
+	return sort.Search(len(order.names), func(i int) bool { return isAfter(order.users[order.names[i]]) })
+}
+
+// insert adds user, who must already be in users, in their place.
+func (order *userOrder) insert(user User) {
+	at := order.search(func(other User) bool { return order.ascending.less(user, other) })
+	order.names = append(order.names, "")
+	copy(order.names[at+1:], order.names[at:])
+	order.names[at] = userKey(user.UserName)
+}
+
+// remove takes user out, while they are still in users.
+func (order *userOrder) remove(user User) {
+	at := order.search(func(other User) bool { return order.ascending.less(other, user) == false })
+	if at < len(order.names) && order.names[at] == userKey(user.UserName) {
+		order.names = append(order.names[:at], order.names[at+1:]...)
+	}
+}
+
+// InitDB - allows us to re-init our DB. With a data directory the users are recovered from it.
+func (memDB *MemoryDB) InitDB() bool {
+	memDB.userLock.Lock()
+	defer memDB.userLock.Unlock()
+	memDB.resetUsers()
+	if memDB.dataDir != "" {
+		if memDB.journal != nil {
+			memDB.journal.wait()
+			memDB.journal.close()
+			memDB.journal = nil
+		}
+		journal, users, lastID, err := openUserJournal(memDB.dataDir, memDB.snapshotEvery)
+		if err != nil {
+			slog.Error("MemoryDB.InitDB(): failed to recover users", "dir", memDB.dataDir, "err", err)
+			return false
+		}
+		memDB.journal, memDB.userID = journal, lastID
+		for _, user := range users {
+			memDB.indexUser(user)
+		}
+		slog.Info("MemoryDB.InitDB(): recovered users", "dir", memDB.dataDir, "users", len(users))
+	}
+	memDB.sessionLock.Lock()
+	memDB.sessions = make(map[string]Session)
+	memDB.sessionLock.Unlock()
+	memDB.refreshLock.Lock()
+	memDB.refreshTokens = make(map[string]RefreshToken)
+	memDB.refreshLock.Unlock()
+
+	slog.Info("MemoryDB.InitDB(): OK")
+	return true
+}
+
+// ReleaseDB - snapshots and closes the journal, if there is one, so the next start has no log to replay.
+func (memDB *MemoryDB) ReleaseDB() {
+	memDB.userLock.Lock()
+	defer memDB.userLock.Unlock()
+	if memDB.journal != nil {
+		memDB.journal.wait()
+		if err := memDB.journal.snapshot(memDB.users, memDB.userID, memDB.journal.position()); err != nil {
+			slog.Error("MemoryDB.ReleaseDB(): failed to snapshot users", "err", err)
+		}
+		memDB.journal.close()
+		memDB.journal = nil
+	}
+	slog.Info("MemoryDB.ReleaseDB(): OK")
+}
+
+// logChange journals entry ahead of the change being made. Without a journal there is nothing to do.
+func (memDB *MemoryDB) logChange(ctx context.Context, entry journalEntry) error {
+	if memDB.journal == nil {
+		return nil
+	}
+	err := memDB.journal.append(entry)
+	if err != nil {
+		loggerFor(ctx).Error("MemoryDB.logChange(): failed to journal change", "op", entry.Op, "err", err)
+	}
+	return err
+}
+
+// compact snapshots the users once enough changes have been journaled. The caller holds userLock,
+// so the copy taken here matches the log up to the position noted with it; the copy is written out
+// in the background, leaving the store free meanwhile. A failure only means a longer log to replay,
+// so it is logged rather than failing the change that has already been made.
+func (memDB *MemoryDB) compact(ctx context.Context) {
+	if memDB.journal == nil {
+		return
+	}
+	upTo, isDue := memDB.journal.beginSnapshot()
+	if isDue == false {
+		return
+	}
+	users := make(map[string]User, len(memDB.users))
+	for userName, user := range memDB.users {
+		users[userName] = user
+	}
+	journal, lastID, logger := memDB.journal, memDB.userID, loggerFor(ctx)
+	go func() {
+		defer journal.endSnapshot()
+		if err := journal.snapshot(users, lastID, upTo); err != nil {
+			logger.Warn("MemoryDB.compact(): failed to snapshot users", "err", err)
+		}
+	}()
+}
+
+// Ping - the in memory store is always ready.
+func (memDB *MemoryDB) Ping(ctx context.Context) error {
+	return nil
+}
+
+// emailTaken reports whether, with uniqueEmails set, a user other than userName has email. The
+// caller holds userLock.
+func (memDB *MemoryDB) emailTaken(email string, userName string) bool {
+	if uniqueEmails == false {
+		return false
+	}
+	for holder := range memDB.userEmails[normalizeEmail(email)] {
+		if holder != userKey(userName) {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateUser - adds a new user, rejecting duplicate user names, whatever their case.
+func (memDB *MemoryDB) CreateUser(ctx context.Context, newUser User) (User, ModelStatusCode, string) {
+	var retCode ModelStatusCode
+	var reason string
+
+	// test for valid record
+	if isValid, errorStr := isValidUser(newUser); isValid == false {
+		return newUser, ModelInvalidUser, errorStr
+	}
+
+	memDB.userLock.Lock()
+	defer memDB.userLock.Unlock()
+	// test for exists.....
+	if _, exists := memDB.users[userKey(newUser.UserName)]; exists == true {
+		retCode = ModelDuplicateUserName
+		reason = "User '" + newUser.UserName + "' already exists"
+		return newUser, retCode, reason
+	}
+	if memDB.emailTaken(newUser.Email, newUser.UserName) {
+		return newUser, ModelDuplicateEmail, "Email '" + newUser.Email + "' is already in use"
+	}
+
+	// increment user ID
+	newUser.ID = memDB.getUserID()
+	newUser.Version = 1
+	if err := memDB.logChange(ctx, journalEntry{Op: journalPut, User: newJournalUser(newUser)}); err != nil {
+		return newUser, ModelDBCreateFailure, fmt.Sprintf("failed to journal user '%v': %v", newUser.UserName, err)
+	}
+	memDB.indexUser(newUser)
+	memDB.compact(ctx)
+	retCode = ModelSuccess
+	// any errors will cause return code and reason to be modified
+
+	return newUser, retCode, reason
+}
+
+// versionConflict reports whether a conditional write against user should be refused.
+func versionConflict(user User, ifVersion int) bool {
+	return ifVersion != 0 && user.Version != ifVersion
+}
+
+// UpdateUser - replaces an existing user record. Does not create.
+func (memDB *MemoryDB) UpdateUser(ctx context.Context, user User, ifVersion int) (User, ModelStatusCode, string) {
+	var retCode ModelStatusCode
+	var reason string
+
+	// test for valid record
+	if isValid, errorStr := isValidUser(user); isValid == false {
+		return user, ModelInvalidUser, errorStr
+	}
+
+	memDB.userLock.Lock()
+	defer memDB.userLock.Unlock()
+	// test for exists.....
+	current, exists := memDB.users[userKey(user.UserName)]
+	if exists == false {
+		retCode = ModelDBUserNotFound
+		reason = "User '" + user.UserName + "' not found, cannot update"
+		return user, retCode, reason
+	}
+	if versionConflict(current, ifVersion) {
+		return current, ModelVersionConflict, "User '" + user.UserName + "' has been modified, cannot update"
+	}
+	if memDB.emailTaken(user.Email, user.UserName) {
+		return current, ModelDuplicateEmail, "Email '" + user.Email + "' is already in use"
+	}
+
+	// ensure latest id, in case we wanted to actually use it down the road, and keep the name as created.
+	user.ID = current.ID
+	user.UserName = current.UserName
+	user.Version = current.Version + 1
+	if err := memDB.logChange(ctx, journalEntry{Op: journalPut, User: newJournalUser(user)}); err != nil {
+		return current, ModelDBUpdateFailure, fmt.Sprintf("failed to journal user '%v': %v", user.UserName, err)
+	}
+	memDB.indexUser(user)
+	memDB.compact(ctx)
+	retCode = ModelSuccess
+	// any errors will cause return code and reason to be modified
+
+	return user, retCode, reason
+}
+
+// PatchUser - changes only the supplied fields of an existing user.
+func (memDB *MemoryDB) PatchUser(ctx context.Context, userName string, changes UserChanges, ifVersion int) (User, ModelStatusCode, string) {
+	memDB.userLock.Lock()
+	defer memDB.userLock.Unlock()
+	current, exists := memDB.users[userKey(userName)]
+	if exists == false {
+		return current, ModelDBUserNotFound, "User '" + userName + "' not found, cannot update"
+	}
+	if versionConflict(current, ifVersion) {
+		return current, ModelVersionConflict, "User '" + userName + "' has been modified, cannot update"
+	}
+	user := current
+	if changes.Email != nil {
+		if memDB.emailTaken(*changes.Email, userName) {
+			return current, ModelDuplicateEmail, "Email '" + *changes.Email + "' is already in use"
+		}
+		user.Email = *changes.Email
+	}
+	if changes.Password != nil {
+		user.Password = *changes.Password
+	}
+	user.Version++
+	if err := memDB.logChange(ctx, journalEntry{Op: journalPut, User: newJournalUser(user)}); err != nil {
+		return current, ModelDBUpdateFailure, fmt.Sprintf("failed to journal user '%v': %v", userName, err)
+	}
+	memDB.indexUser(user)
+	memDB.compact(ctx)
+	return user, ModelSuccess, ""
+}
+
+// GetUser - looks up a single user by user name.
+func (memDB *MemoryDB) GetUser(ctx context.Context, userName string) (User, ModelStatusCode, string) {
+	var retCode ModelStatusCode
+	var reason string
+	var user User
+
+	memDB.userLock.RLock()
+	defer memDB.userLock.RUnlock()
+	if len(userName) < 1 {
+		retCode = ModelDBGetFailure
+		reason = "User name not supplied"
+	} else if userTmp, exists := memDB.users[userKey(userName)]; exists == true {
+		retCode = ModelSuccess
+		user = userTmp
+	} else {
+		retCode = ModelDBUserNotFound
+		reason = "User '" + userName + "' not found"
+	}
+
+	return user, retCode, reason
+}
+
+// GetAllUsers - returns a page of the users matching query, sliced out of the order for its sort field.
+func (memDB *MemoryDB) GetAllUsers(ctx context.Context, query UserQuery) (UserPage, ModelStatusCode, string) {
+	var page UserPage
+	isValid, reason, cursor := isValidUserQuery(query)
+	if isValid == false {
+		return page, ModelInvalidQuery, reason
+	}
+
+	memDB.userLock.RLock()
+	defer memDB.userLock.RUnlock()
+	order := memDB.userOrders[query.sortBy()]
+	// the users that can match, ascending: all of them, or those starting with the prefix when that
+	// is what they are ordered by.
+	first, last := 0, len(order.names)
+	if prefix := strings.ToLower(query.UserNamePrefix); prefix != "" && query.sortBy() == sortByUserName {
+		first = order.search(func(user User) bool { return strings.ToLower(user.UserName) >= prefix })
+		last = order.search(func(user User) bool {
+			userName := strings.ToLower(user.UserName)
+			return userName >= prefix && strings.HasPrefix(userName, prefix) == false
+		})
+	}
+	filtered := query.EmailDomain != "" || (query.UserNamePrefix != "" && query.sortBy() != sortByUserName)
+
+	// where the page starts, walking the order forwards, or backwards for Descending.
+	start, step := first, 1
+	if query.Descending {
+		start, step = last-1, -1
+	}
+	if cursor != nil {
+		at := User{ID: cursor.ID, UserName: cursor.Key, Email: cursor.Key}
+		if query.Descending {
+			start = min(order.search(func(user User) bool { return order.ascending.less(user, at) == false })-1, last-1)
+		} else {
+			start = max(order.search(func(user User) bool { return order.ascending.less(at, user) }), first)
+		}
+	}
+
+	page.Users = []User{}
+	pageSize := query.pageSize()
+	for i := start; i >= first && i < last; i += step {
+		user := order.users[order.names[i]]
+		if filtered && query.matches(user) == false {
+			continue
+		}
+		if len(page.Users) == pageSize {
+			page.NextCursor = query.nextCursor(page.Users[pageSize-1])
+			break
+		}
+		page.Users = append(page.Users, user)
+	}
+
+	// the total across every page - without other filters, just the size of the range.
+	page.Total = last - first
+	if filtered {
+		page.Total = 0
+		for i := first; i < last; i++ {
+			if query.matches(order.users[order.names[i]]) {
+				page.Total++
+			}
+		}
+	}
+	return page, ModelSuccess, ""
+}
+
+// DeleteUser - removes a single user, returning the removed record.
+func (memDB *MemoryDB) DeleteUser(ctx context.Context, userName string, ifVersion int) (User, ModelStatusCode, string) {
+	var retCode ModelStatusCode
+	var reason string
+	var user User
+
+	memDB.userLock.Lock()
+	defer memDB.userLock.Unlock()
+	if len(userName) < 1 {
+		retCode = ModelDBDeleteFailure
+		reason = "User name not supplied"
+	} else if userTmp, exists := memDB.users[userKey(userName)]; exists == true && versionConflict(userTmp, ifVersion) {
+		retCode = ModelVersionConflict
+		user = userTmp
+		reason = "User '" + userName + "' has been modified, cannot delete"
+	} else if exists == true {
+		if err := memDB.logChange(ctx, journalEntry{Op: journalDelete, UserName: userName}); err != nil {
+			return userTmp, ModelDBDeleteFailure, fmt.Sprintf("failed to journal delete of user '%v': %v", userName, err)
+		}
+		retCode = ModelSuccess
+		user = userTmp // we still return the deleted user
+		memDB.unindexUser(userKey(userName))
+		memDB.compact(ctx)
+	} else {
+		retCode = ModelDBUserNotFound
+		reason = "User '" + userName + "' not found"
+	}
+
+	return user, retCode, reason
+}
+
+// DeleteAllUsers - empties the store, sessions and refresh tokens included.
+func (memDB *MemoryDB) DeleteAllUsers(ctx context.Context) (ModelStatusCode, string) {
+	memDB.userLock.Lock()
+	defer memDB.userLock.Unlock()
+	if err := memDB.logChange(ctx, journalEntry{Op: journalClear}); err != nil {
+		return ModelDBDeleteFailure, fmt.Sprintf("failed to journal delete of all users: %v", err)
+	}
+	memDB.resetUsers()
+	memDB.compact(ctx)
+	memDB.sessionLock.Lock()
+	memDB.sessions = make(map[string]Session)
+	memDB.sessionLock.Unlock()
+	memDB.refreshLock.Lock()
+	memDB.refreshTokens = make(map[string]RefreshToken)
+	memDB.refreshLock.Unlock()
+	return ModelSuccess, ""
+}
+
+//// SESSIONS
+
+// CreateSession - stores a new session, clearing out any that have expired while we are at it.
+func (memDB *MemoryDB) CreateSession(ctx context.Context, session Session) (ModelStatusCode, string) {
+	memDB.sessionLock.Lock()
+	defer memDB.sessionLock.Unlock()
+	for tokenHash, existing := range memDB.sessions {
+		if existing.isExpired() {
+			delete(memDB.sessions, tokenHash)
+		}
+	}
+	memDB.sessions[session.TokenHash] = session
+	return ModelSuccess, ""
+}
+
+// GetSession - looks up a session by token hash. Expired sessions are reported as not found.
+func (memDB *MemoryDB) GetSession(ctx context.Context, tokenHash string) (Session, ModelStatusCode, string) {
+	memDB.sessionLock.Lock()
+	defer memDB.sessionLock.Unlock()
+	session, exists := memDB.sessions[tokenHash]
+	if exists == false {
+		return Session{}, ModelSessionNotFound, "session not found"
+	}
+	if session.isExpired() {
+		delete(memDB.sessions, tokenHash)
+		return Session{}, ModelSessionNotFound, "session expired"
+	}
+	return session, ModelSuccess, ""
+}
+
+// DeleteSession - removes a single session.
+func (memDB *MemoryDB) DeleteSession(ctx context.Context, tokenHash string) (ModelStatusCode, string) {
+	memDB.sessionLock.Lock()
+	defer memDB.sessionLock.Unlock()
+	delete(memDB.sessions, tokenHash)
+	return ModelSuccess, ""
+}
+
+// DeleteUserSessions - removes every session belonging to userName.
+func (memDB *MemoryDB) DeleteUserSessions(ctx context.Context, userName string) (ModelStatusCode, string) {
+	memDB.sessionLock.Lock()
+	defer memDB.sessionLock.Unlock()
+	for tokenHash, session := range memDB.sessions {
+		if strings.EqualFold(session.UserName, userName) {
+			delete(memDB.sessions, tokenHash)
+		}
+	}
+	return ModelSuccess, ""
+}
+
+//// REFRESH TOKENS
+
+// CreateRefreshToken - stores a new refresh token, clearing out any that have expired while we are at it.
+func (memDB *MemoryDB) CreateRefreshToken(ctx context.Context, token RefreshToken) (ModelStatusCode, string) {
+	memDB.refreshLock.Lock()
+	defer memDB.refreshLock.Unlock()
+	for tokenHash, existing := range memDB.refreshTokens {
+		if existing.isExpired() {
+			delete(memDB.refreshTokens, tokenHash)
+		}
+	}
+	memDB.refreshTokens[token.TokenHash] = token
+	return ModelSuccess, ""
+}
+
+// ConsumeRefreshToken - looks up and deletes a refresh token in one go, so each can only be used once.
+func (memDB *MemoryDB) ConsumeRefreshToken(ctx context.Context, tokenHash string) (RefreshToken, ModelStatusCode, string) {
+	memDB.refreshLock.Lock()
+	defer memDB.refreshLock.Unlock()
+	token, exists := memDB.refreshTokens[tokenHash]
+	if exists == false {
+		return RefreshToken{}, ModelTokenNotFound, "refresh token not found"
+	}
+	delete(memDB.refreshTokens, tokenHash)
+	if token.isExpired() {
+		return RefreshToken{}, ModelTokenNotFound, "refresh token expired"
+	}
+	return token, ModelSuccess, ""
+}
+
+// DeleteRefreshToken - removes a single refresh token.
+func (memDB *MemoryDB) DeleteRefreshToken(ctx context.Context, tokenHash string) (ModelStatusCode, string) {
+	memDB.refreshLock.Lock()
+	defer memDB.refreshLock.Unlock()
+	delete(memDB.refreshTokens, tokenHash)
+	return ModelSuccess, ""
+}
+
+// DeleteUserRefreshTokens - removes every refresh token belonging to userName.
+func (memDB *MemoryDB) DeleteUserRefreshTokens(ctx context.Context, userName string) (ModelStatusCode, string) {
+	memDB.refreshLock.Lock()
+	defer memDB.refreshLock.Unlock()
+	for tokenHash, token := range memDB.refreshTokens {
+		if strings.EqualFold(token.UserName, userName) {
+			delete(memDB.refreshTokens, tokenHash)
+		}
+	}
+	return ModelSuccess, ""
+}
@@ -0,0 +1,340 @@
+package main
+
+// Durability for the in memory store, for small installs without a database. With a data directory
+// set (-memory-data-dir), every change to the users is appended to a write-ahead log, users.log,
+// and synced to disk before it is applied. Every so many changes, and on shutdown, the whole store
+// is written to users.snapshot and the entries it covers are dropped from the log. Between changes
+// that is done in the background, from a copy of the users taken along with how far into the log
+// they go, so entries appended meanwhile are kept. InitDB loads the snapshot and replays the log
+// over it.
+// Each log entry carries the user's complete record rather than what changed, so replaying one the
+// snapshot already has changes nothing; that is what makes a crash between writing a snapshot and
+// emptying the log harmless. A crash part way through an append leaves a torn last line, which is
+// dropped - its change was never acknowledged. Sessions and refresh tokens are not kept.
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const (
+	journalLogFile      = "users.log"
+	journalSnapshotFile = "users.snapshot"
+)
+
+// Journal operations.
+const (
+	journalPut    = "put"    // create or replace a user with the record given
+	journalDelete = "delete" // remove the named user
+	journalClear  = "clear"  // remove every user
+)
+
+// journalUser - a User as kept on disk. User's own JSON leaves the Version out.
+type journalUser struct {
+	ID       int    `json:"id"`
+	UserName string `json:"userName"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	Version  int    `json:"version"`
+}
+
+func newJournalUser(user User) *journalUser {
+	return &journalUser{ID: user.ID, UserName: user.UserName, Email: user.Email, Password: user.Password, Version: user.Version}
+}
+
+func (user journalUser) user() User {
+	return User{ID: user.ID, UserName: user.UserName, Email: user.Email, Password: user.Password, Version: user.Version}
+}
+
+// journalEntry - one line of the log.
+type journalEntry struct {
+	Op       string       `json:"op"`
+	User     *journalUser `json:"user,omitempty"`
+	UserName string       `json:"userName,omitempty"`
+}
+
+// journalSnapshot - the whole store. LastID is kept so IDs are not handed out again after the users
+// that had them are deleted.
+type journalSnapshot struct {
+	LastID int           `json:"lastId"`
+	Users  []journalUser `json:"users"`
+}
+
+// userJournal - the log and snapshot in one data directory.
+type userJournal struct {
+	dir           string
+	snapshotEvery int
+
+	lock      sync.Mutex
+	log       *os.File
+	size      int64 // bytes in the log
+	entries   int   // in the log, so appended since the last snapshot
+	isWriting bool  // a snapshot is being written in the background
+	written   sync.WaitGroup
+}
+
+// logPosition - how far into the log a copy of the users goes.
+type logPosition struct {
+	size    int64
+	entries int
+}
+
+// openUserJournal loads what is in dir - creating it if need be - and opens the log for appending.
+// It returns the users and last ID recovered.
+func openUserJournal(dir string, snapshotEvery int) (*userJournal, map[string]User, int, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, nil, 0, err
+	}
+	journal := &userJournal{dir: dir, snapshotEvery: snapshotEvery}
+	users, lastID, err := journal.loadSnapshot()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if journal.log, err = os.OpenFile(filepath.Join(dir, journalLogFile), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600); err != nil {
+		return nil, nil, 0, err
+	}
+	if users, lastID, err = journal.replay(users, lastID); err != nil {
+		journal.log.Close()
+		return nil, nil, 0, err
+	}
+	return journal, users, lastID, nil
+}
+
+func (journal *userJournal) loadSnapshot() (map[string]User, int, error) {
+	data, err := os.ReadFile(filepath.Join(journal.dir, journalSnapshotFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string]User{}, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+	var snapshot journalSnapshot
+	if err = json.Unmarshal(data, &snapshot); err != nil {
+		return nil, 0, fmt.Errorf("corrupt snapshot %v: %v", journalSnapshotFile, err)
+	}
+	users := make(map[string]User, len(snapshot.Users))
+	for _, user := range snapshot.Users {
+		users[userKey(user.UserName)] = user.user()
+	}
+	return users, snapshot.LastID, nil
+}
+
+// replay applies the log to users. A bad last line is a torn append and is cut off; a bad line with
+// more after it means the log has been damaged some other way, and we stop rather than guess.
+func (journal *userJournal) replay(users map[string]User, lastID int) (map[string]User, int, error) {
+	reader := bufio.NewReader(journal.log)
+	var offset int64
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(data) == 0 {
+			break
+		} else if err != nil && err != io.EOF {
+			return nil, 0, err
+		}
+		var entry journalEntry
+		isValid := err == nil && json.Unmarshal(data, &entry) == nil && entry.isValid()
+		if isValid == false {
+			if rest, _ := reader.Peek(1); len(rest) > 0 {
+				return nil, 0, fmt.Errorf("corrupt entry at line %v of %v", line, journalLogFile)
+			}
+			slog.Warn("userJournal.replay(): dropping torn last entry", "line", line, "bytes", len(data))
+			if err = journal.log.Truncate(offset); err != nil {
+				return nil, 0, err
+			}
+			break
+		}
+		entry.apply(users)
+		if entry.Op == journalClear {
+			lastID = 0 // the IDs start again, as they did when the store was cleared
+		} else if entry.User != nil && entry.User.ID > lastID {
+			lastID = entry.User.ID
+		}
+		offset += int64(len(data))
+		journal.entries++
+	}
+	journal.size = offset
+	return users, lastID, nil
+}
+
+func (entry journalEntry) isValid() bool {
+	switch entry.Op {
+	case journalPut:
+		return entry.User != nil && entry.User.UserName != ""
+	case journalDelete:
+		return entry.UserName != ""
+	case journalClear:
+		return true
+	}
+	return false
+}
+
+// apply makes entry's change to users, keyed as the store keys them.
+func (entry journalEntry) apply(users map[string]User) {
+	switch entry.Op {
+	case journalPut:
+		users[userKey(entry.User.UserName)] = entry.User.user()
+	case journalDelete:
+		delete(users, userKey(entry.UserName))
+	case journalClear:
+		for userName := range users {
+			delete(users, userName)
+		}
+	}
+}
+
+// append writes entry to the log and syncs it. Only once this returns may the change be applied.
+func (journal *userJournal) append(entry journalEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	journal.lock.Lock()
+	defer journal.lock.Unlock()
+	written, err := journal.log.Write(append(data, '\n'))
+	journal.size += int64(written)
+	if err != nil {
+		return err
+	}
+	if err = journal.log.Sync(); err != nil {
+		return err
+	}
+	journal.entries++
+	return nil
+}
+
+// position reports how far the log goes now.
+func (journal *userJournal) position() logPosition {
+	journal.lock.Lock()
+	defer journal.lock.Unlock()
+	return logPosition{size: journal.size, entries: journal.entries}
+}
+
+// beginSnapshot claims a background snapshot, if enough has been logged since the last one and no
+// other is being written, and reports how far the log goes. The caller copies the users before
+// anything more is appended, and calls endSnapshot once the copy has been written.
+func (journal *userJournal) beginSnapshot() (logPosition, bool) {
+	journal.lock.Lock()
+	defer journal.lock.Unlock()
+	if journal.isWriting || journal.entries < journal.snapshotEvery {
+		return logPosition{}, false
+	}
+	journal.isWriting = true
+	journal.written.Add(1)
+	return logPosition{size: journal.size, entries: journal.entries}, true
+}
+
+func (journal *userJournal) endSnapshot() {
+	journal.lock.Lock()
+	journal.isWriting = false
+	journal.lock.Unlock()
+	journal.written.Done()
+}
+
+// wait returns once any background snapshot has been written.
+func (journal *userJournal) wait() {
+	journal.written.Wait()
+}
+
+// snapshot writes users - the store as of upTo in the log - out in full, in ID order, and drops the
+// log up to there. The snapshot replaces the old one by rename, so a crash leaves one or the other
+// whole, and the log is only cut once it is safe. Only one snapshot is written at a time.
+func (journal *userJournal) snapshot(users map[string]User, lastID int, upTo logPosition) error {
+	snapshot := journalSnapshot{LastID: lastID, Users: make([]journalUser, 0, len(users))}
+	for _, user := range users {
+		snapshot.Users = append(snapshot.Users, *newJournalUser(user))
+	}
+	sort.Slice(snapshot.Users, func(i, j int) bool { return snapshot.Users[i].ID < snapshot.Users[j].ID })
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	fileName := filepath.Join(journal.dir, journalSnapshotFile)
+	if err = writeFileSynced(fileName+".tmp", data); err != nil {
+		return err
+	}
+	if err = os.Rename(fileName+".tmp", fileName); err != nil {
+		return err
+	}
+	if err = syncDir(journal.dir); err != nil {
+		return err
+	}
+
+	journal.lock.Lock()
+	defer journal.lock.Unlock()
+	return journal.dropLog(upTo)
+}
+
+// dropLog cuts the log up to upTo, keeping whatever was appended after it. Those later entries are
+// copied to a new log that replaces the old one by rename. The caller holds lock.
+func (journal *userJournal) dropLog(upTo logPosition) error {
+	if upTo.size == journal.size {
+		if err := journal.log.Truncate(0); err != nil {
+			return err
+		}
+		if err := journal.log.Sync(); err != nil {
+			return err
+		}
+		journal.size, journal.entries = 0, 0
+		return nil
+	}
+	later := make([]byte, journal.size-upTo.size)
+	if _, err := journal.log.ReadAt(later, upTo.size); err != nil {
+		return err
+	}
+	fileName := filepath.Join(journal.dir, journalLogFile)
+	if err := writeFileSynced(fileName+".tmp", later); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(fileName+".tmp", os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(fileName+".tmp", fileName); err != nil {
+		file.Close()
+		return err
+	}
+	if err = syncDir(journal.dir); err != nil {
+		file.Close()
+		return err
+	}
+	journal.log.Close()
+	journal.log = file
+	journal.size -= upTo.size
+	journal.entries -= upTo.entries
+	return nil
+}
+
+func (journal *userJournal) close() error {
+	return journal.log.Close()
+}
+
+func writeFileSynced(fileName string, data []byte) error {
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
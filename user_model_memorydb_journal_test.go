@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func newJournaledMemoryDB(t *testing.T, dir string, snapshotEvery int) *MemoryDB {
+	t.Helper()
+	memDB := &MemoryDB{dataDir: dir, snapshotEvery: snapshotEvery}
+	if memDB.InitDB() == false {
+		t.Fatal("failed to initialize the journaled memory store")
+	}
+	return memDB
+}
+
+// crash drops memDB the way a killed process would - no snapshot, only the log file let go. A
+// background snapshot already under way is let finish first, so the next open doesn't race it.
+func crash(memDB *MemoryDB) {
+	memDB.journal.wait()
+	memDB.journal.close()
+	memDB.journal = nil
+}
+
+func expectUsers(t *testing.T, memDB *MemoryDB, expected map[string]User) {
+	t.Helper()
+	if len(memDB.users) != len(expected) {
+		t.Errorf("expected %v users, got %v", len(expected), len(memDB.users))
+	}
+	for userName, want := range expected {
+		got, retCode, _ := memDB.GetUser(context.Background(), userName)
+		if retCode != ModelSuccess {
+			t.Errorf("expected user %v to be recovered, got %v", userName, ModelStatusText(retCode))
+		} else if got != want {
+			t.Errorf("expected user %v to be recovered as %+v, got %+v", userName, want, got)
+		}
+	}
+}
+
+func TestJournalRecovery(t *testing.T) {
+	ctx := context.Background()
+	for _, snapshotEvery := range []int{1000, 2} { // the log alone, then snapshots and the log
+		dir := t.TempDir()
+		memDB := newJournaledMemoryDB(t, dir, snapshotEvery)
+		memDB.CreateUser(ctx, User{UserName: "Alfie", Email: "alfie@example.com", Password: "hash"})
+		memDB.CreateUser(ctx, User{UserName: "Joan", Email: "joan@example.com", Password: "hash"})
+		memDB.CreateUser(ctx, User{UserName: "Tony", Email: "tony@example.com", Password: "hash"})
+		memDB.UpdateUser(ctx, User{UserName: "Joan", Email: "joan@example.org", Password: "hash2"}, 0)
+		email := "alfie@example.org"
+		memDB.PatchUser(ctx, "Alfie", UserChanges{Email: &email}, 0)
+		memDB.DeleteUser(ctx, "Tony", 0)
+		expected := map[string]User{
+			"Alfie": {ID: 1, UserName: "Alfie", Email: "alfie@example.org", Password: "hash", Version: 2},
+			"Joan":  {ID: 2, UserName: "Joan", Email: "joan@example.org", Password: "hash2", Version: 2},
+		}
+		crash(memDB)
+
+		memDB = newJournaledMemoryDB(t, dir, snapshotEvery)
+		expectUsers(t, memDB, expected)
+		// Tony's ID is not handed out again.
+		if user, _, _ := memDB.CreateUser(ctx, User{UserName: "Sam", Email: "sam@example.com", Password: "hash"}); user.ID != 4 {
+			t.Errorf("snapshot every %v: expected the next ID to be 4, got %v", snapshotEvery, user.ID)
+		}
+		expected["Sam"] = User{ID: 4, UserName: "Sam", Email: "sam@example.com", Password: "hash", Version: 1}
+
+		// a clean release leaves everything in the snapshot and nothing to replay.
+		memDB.ReleaseDB()
+		if info, err := os.Stat(filepath.Join(dir, journalLogFile)); err != nil || info.Size() != 0 {
+			t.Errorf("snapshot every %v: expected an empty log after release, got %v, %v", snapshotEvery, info, err)
+		}
+		memDB = newJournaledMemoryDB(t, dir, snapshotEvery)
+		expectUsers(t, memDB, expected)
+
+		// clearing the store starts the IDs again, as truncating a SQL table does.
+		memDB.DeleteAllUsers(ctx)
+		crash(memDB)
+		memDB = newJournaledMemoryDB(t, dir, snapshotEvery)
+		expectUsers(t, memDB, map[string]User{})
+		if user, _, _ := memDB.CreateUser(ctx, User{UserName: "Sam", Email: "sam@example.com", Password: "hash"}); user.ID != 1 {
+			t.Errorf("snapshot every %v: expected the IDs to start again after clearing, got %v", snapshotEvery, user.ID)
+		}
+		memDB.ReleaseDB()
+	}
+}
+
+// Test that IDs keep counting up across a restart even once every user that had them is gone.
+func TestJournalLastID(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	memDB := newJournaledMemoryDB(t, dir, 1000)
+	memDB.CreateUser(ctx, User{UserName: "Alfie", Email: "alfie@example.com", Password: "hash"})
+	memDB.DeleteUser(ctx, "Alfie", 0)
+	memDB.ReleaseDB()
+
+	memDB = newJournaledMemoryDB(t, dir, 1000)
+	defer memDB.ReleaseDB()
+	if user, _, _ := memDB.CreateUser(ctx, User{UserName: "Alfie", Email: "alfie@example.com", Password: "hash"}); user.ID != 2 {
+		t.Errorf("expected the next ID to be 2, got %v", user.ID)
+	}
+}
+
+// Test that replaying the log finds users ignoring case, as the store did when it was written.
+func TestJournalUserNameCase(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	memDB := newJournaledMemoryDB(t, dir, 1000)
+	memDB.CreateUser(ctx, User{UserName: "Alfie", Email: "alfie@example.com", Password: "hash"})
+	memDB.CreateUser(ctx, User{UserName: "Joan", Email: "joan@example.com", Password: "hash"})
+	memDB.UpdateUser(ctx, User{UserName: "JOAN", Email: "joan@example.org", Password: "hash"}, 0)
+	memDB.DeleteUser(ctx, "alfie", 0)
+	crash(memDB)
+
+	memDB = newJournaledMemoryDB(t, dir, 1000)
+	defer memDB.ReleaseDB()
+	expectUsers(t, memDB, map[string]User{
+		"joan": {ID: 2, UserName: "Joan", Email: "joan@example.org", Password: "hash", Version: 2},
+	})
+}
+
+// Test that a snapshot only drops the log up to the copy it was written from, keeping what was
+// appended while it was being written.
+func TestJournalSnapshotKeepsLaterEntries(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	memDB := newJournaledMemoryDB(t, dir, 1000)
+	memDB.CreateUser(ctx, User{UserName: "Alfie", Email: "alfie@example.com", Password: "hash"})
+	memDB.CreateUser(ctx, User{UserName: "Joan", Email: "joan@example.com", Password: "hash"})
+	upTo := memDB.journal.position()
+	users := map[string]User{"alfie": memDB.users["alfie"], "joan": memDB.users["joan"]}
+	memDB.CreateUser(ctx, User{UserName: "Tony", Email: "tony@example.com", Password: "hash"})
+	if err := memDB.journal.snapshot(users, 2, upTo); err != nil {
+		t.Fatal(err)
+	}
+	if position := memDB.journal.position(); position.entries != 1 {
+		t.Errorf("expected the one later entry to be left in the log, got %v", position.entries)
+	}
+	memDB.CreateUser(ctx, User{UserName: "Sam", Email: "sam@example.com", Password: "hash"})
+	crash(memDB)
+
+	memDB = newJournaledMemoryDB(t, dir, 1000)
+	defer memDB.ReleaseDB()
+	expectUsers(t, memDB, map[string]User{
+		"Alfie": {ID: 1, UserName: "Alfie", Email: "alfie@example.com", Password: "hash", Version: 1},
+		"Joan":  {ID: 2, UserName: "Joan", Email: "joan@example.com", Password: "hash", Version: 1},
+		"Tony":  {ID: 3, UserName: "Tony", Email: "tony@example.com", Password: "hash", Version: 1},
+		"Sam":   {ID: 4, UserName: "Sam", Email: "sam@example.com", Password: "hash", Version: 1},
+	})
+}
+
+// Test that background snapshots taken while users keep changing lose none of the changes.
+func TestJournalConcurrentSnapshots(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	memDB := newJournaledMemoryDB(t, dir, 3)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				userName := fmt.Sprintf("user%v-%v", i, j)
+				memDB.CreateUser(ctx, User{UserName: userName, Email: userName + "@example.com", Password: "hash"})
+				if j%5 == 0 {
+					memDB.DeleteUser(ctx, userName, 0)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	expected := make(map[string]User, len(memDB.users))
+	for userName, user := range memDB.users {
+		expected[userName] = user
+	}
+	crash(memDB)
+
+	memDB = newJournaledMemoryDB(t, dir, 3)
+	defer memDB.ReleaseDB()
+	expectUsers(t, memDB, expected)
+}
+
+func TestJournalTornEntry(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	memDB := newJournaledMemoryDB(t, dir, 1000)
+	memDB.CreateUser(ctx, User{UserName: "Alfie", Email: "alfie@example.com", Password: "hash"})
+	crash(memDB)
+
+	logFile := filepath.Join(dir, journalLogFile)
+	file, err := os.OpenFile(logFile, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"op":"put","user":{"id":2,"userName":"Jo`)
+	file.Close()
+
+	memDB = newJournaledMemoryDB(t, dir, 1000)
+	expectUsers(t, memDB, map[string]User{
+		"Alfie": {ID: 1, UserName: "Alfie", Email: "alfie@example.com", Password: "hash", Version: 1},
+	})
+	// the torn entry is cut off, so what follows it starts on a line of its own.
+	memDB.CreateUser(ctx, User{UserName: "Joan", Email: "joan@example.com", Password: "hash"})
+	crash(memDB)
+	memDB = newJournaledMemoryDB(t, dir, 1000)
+	defer memDB.ReleaseDB()
+	if len(memDB.users) != 2 {
+		t.Errorf("expected 2 users after the torn entry was replaced, got %v", len(memDB.users))
+	}
+}
+
+func TestJournalCorruptEntry(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	memDB := newJournaledMemoryDB(t, dir, 1000)
+	memDB.CreateUser(ctx, User{UserName: "Alfie", Email: "alfie@example.com", Password: "hash"})
+	crash(memDB)
+
+	logFile := filepath.Join(dir, journalLogFile)
+	data, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(logFile, append([]byte("{\"op\":\"bogus\"}\n"), data...), 0600)
+
+	memDB = &MemoryDB{dataDir: dir, snapshotEvery: 1000}
+	if memDB.InitDB() {
+		memDB.ReleaseDB()
+		t.Error("expected a corrupt entry mid log to fail recovery")
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestMemoryDBDuplicates(t *testing.T) {
+	defer func(saved bool) { uniqueEmails = saved }(uniqueEmails)
+	ctx := context.Background()
+	memDB := &MemoryDB{}
+	memDB.InitDB()
+	memDB.CreateUser(ctx, User{UserName: "Alfie", Email: "alfie@example.com", Password: "hash"})
+	memDB.CreateUser(ctx, User{UserName: "Joan", Email: "joan@example.com", Password: "hash"})
+
+	if _, retCode, _ := memDB.CreateUser(ctx, User{UserName: "Alfie", Email: "other@example.com", Password: "hash"}); retCode != ModelDuplicateUserName {
+		t.Errorf("expected a duplicate user name, got %v", ModelStatusText(retCode))
+	}
+
+	// emails only have to be unique when asked, and then regardless of case.
+	uniqueEmails = false
+	if _, retCode, _ := memDB.CreateUser(ctx, User{UserName: "Tony", Email: "alfie@example.com", Password: "hash"}); retCode != ModelSuccess {
+		t.Errorf("expected a shared email to be allowed, got %v", ModelStatusText(retCode))
+	}
+	memDB.DeleteUser(ctx, "Tony", 0)
+	uniqueEmails = true
+	if _, retCode, _ := memDB.CreateUser(ctx, User{UserName: "Tony", Email: " ALFIE@Example.com", Password: "hash"}); retCode != ModelDuplicateEmail {
+		t.Errorf("expected a duplicate email on create, got %v", ModelStatusText(retCode))
+	}
+	if _, retCode, _ := memDB.UpdateUser(ctx, User{UserName: "Joan", Email: "Alfie@example.com", Password: "hash"}, 0); retCode != ModelDuplicateEmail {
+		t.Errorf("expected a duplicate email on update, got %v", ModelStatusText(retCode))
+	}
+	email := "alfie@EXAMPLE.com"
+	if _, retCode, _ := memDB.PatchUser(ctx, "Joan", UserChanges{Email: &email}, 0); retCode != ModelDuplicateEmail {
+		t.Errorf("expected a duplicate email on patch, got %v", ModelStatusText(retCode))
+	}
+	// a user keeping their own email isn't a clash.
+	if _, retCode, _ := memDB.PatchUser(ctx, "Alfie", UserChanges{Email: &email}, 0); retCode != ModelSuccess {
+		t.Errorf("expected a user to keep their own email, got %v", ModelStatusText(retCode))
+	}
+}
+
+// Test that the memory store keys users by their name ignoring case, as the SQL stores do.
+func TestMemoryDBUserNameCase(t *testing.T) {
+	memDB := &MemoryDB{}
+	memDB.InitDB()
+	testUserNameCase(t, memDB)
+	checkIndexes(t, memDB)
+}
+
+// checkIndexes fails unless the ID and email indexes agree with the users exactly.
+func checkIndexes(t *testing.T, memDB *MemoryDB) {
+	t.Helper()
+	emails := 0
+	for _, userNames := range memDB.userEmails {
+		emails += len(userNames)
+	}
+	if len(memDB.userIDs) != len(memDB.users) || emails != len(memDB.users) {
+		t.Errorf("expected %v users in every index, got %v IDs and %v emails", len(memDB.users), len(memDB.userIDs), emails)
+	}
+	for userName, user := range memDB.users {
+		if memDB.userIDs[user.ID] != userName || memDB.userEmails[normalizeEmail(user.Email)][userName] == false {
+			t.Errorf("user %v is missing from the indexes", userName)
+		}
+	}
+	for sortBy, order := range memDB.userOrders {
+		if len(order.names) != len(memDB.users) {
+			t.Errorf("expected %v users in the %v order, got %v", len(memDB.users), sortBy, len(order.names))
+		}
+		for i := 1; i < len(order.names); i++ {
+			if order.ascending.less(memDB.users[order.names[i]], memDB.users[order.names[i-1]]) {
+				t.Errorf("the %v order is out of order at %v", sortBy, i)
+			}
+		}
+	}
+}
+
+// Test that pages sliced from the orders match sorting and filtering every user, as they change.
+func TestMemoryDBUserOrders(t *testing.T) {
+	ctx := context.Background()
+	memDB := &MemoryDB{}
+	memDB.InitDB()
+	for i := 0; i < 30; i++ {
+		memDB.CreateUser(ctx, User{UserName: fmt.Sprintf("%c%02d", "abAB"[i%4], (i*7)%30), Email: fmt.Sprintf("%c@%v.com", 'z'-i, "xyXY"[i%4:i%4+1]), Password: "hash"})
+	}
+	for i := 0; i < 30; i += 4 {
+		email := fmt.Sprintf("%v@moved.com", i)
+		memDB.PatchUser(ctx, memDB.userIDs[i+1], UserChanges{Email: &email}, 0)
+		memDB.DeleteUser(ctx, memDB.userIDs[i+2], 0)
+	}
+	checkIndexes(t, memDB)
+
+	for _, sortBy := range []string{sortByID, sortByUserName, sortByEmail} {
+		for _, descending := range []bool{false, true} {
+			for _, filter := range []UserQuery{{}, {UserNamePrefix: "a"}, {UserNamePrefix: "B0"}, {EmailDomain: "x.com"}, {UserNamePrefix: "zz"}} {
+				query := UserQuery{SortBy: sortBy, Descending: descending, UserNamePrefix: filter.UserNamePrefix, EmailDomain: filter.EmailDomain, Limit: 3}
+				expected := []User{}
+				for _, user := range memDB.users {
+					if query.matches(user) {
+						expected = append(expected, user)
+					}
+				}
+				sort.Slice(expected, func(i, j int) bool { return query.less(expected[i], expected[j]) })
+				if page, _, _ := memDB.GetAllUsers(ctx, query); page.Total != len(expected) {
+					t.Errorf("%+v: expected a total of %v, got %v", query, len(expected), page.Total)
+				}
+				if paged := collectPages(t, memDB, query); fmt.Sprint(paged) != fmt.Sprint(expected) {
+					t.Errorf("%+v: expected %v, got %v", query, expected, paged)
+				}
+			}
+		}
+	}
+}
+
+// Test the store under concurrent writers and readers. Run with -race to check the locking.
+func TestMemoryDBConcurrency(t *testing.T) {
+	ctx := context.Background()
+	memDB := &MemoryDB{}
+	memDB.InitDB()
+	const writers, usersEach = 8, 50
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < usersEach; i++ {
+				userName := fmt.Sprintf("user%v-%v", w, i)
+				if _, retCode, reason := memDB.CreateUser(ctx, User{UserName: userName, Email: userName + "@example.com", Password: "hash"}); retCode != ModelSuccess {
+					t.Errorf("create %v failed: %v", userName, reason)
+					continue
+				}
+				memDB.UpdateUser(ctx, User{UserName: userName, Email: userName + "@example.org", Password: "hash"}, 0)
+				password := "hash2"
+				memDB.PatchUser(ctx, userName, UserChanges{Password: &password}, 0)
+				if i%2 == 1 {
+					memDB.DeleteUser(ctx, userName, 0)
+				}
+			}
+		}(w)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < usersEach; i++ {
+				page, _, _ := memDB.GetAllUsers(ctx, UserQuery{SortBy: sortByEmail, Limit: 10})
+				for _, user := range page.Users {
+					memDB.GetUser(ctx, user.UserName)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	page, _, _ := memDB.GetAllUsers(ctx, UserQuery{})
+	if page.Total != writers*usersEach/2 {
+		t.Errorf("expected %v users, got %v", writers*usersEach/2, page.Total)
+	}
+	for _, user := range page.Users {
+		if user.Version != 3 || user.Password != "hash2" {
+			t.Errorf("expected %v to have had all its changes, got %+v", user.UserName, user)
+		}
+	}
+	checkIndexes(t, memDB)
+}
+
+// Test that concurrent conditional writes to one user each see a single winner per version.
+func TestMemoryDBConditionalPatches(t *testing.T) {
+	ctx := context.Background()
+	memDB := &MemoryDB{}
+	memDB.InitDB()
+	memDB.CreateUser(ctx, User{UserName: "Alfie", Email: "alfie@example.com", Password: "hash"})
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	wins := map[int]int{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			current, _, _ := memDB.GetUser(ctx, "Alfie")
+			email := fmt.Sprintf("alfie%v@example.com", i)
+			if _, retCode, _ := memDB.PatchUser(ctx, "Alfie", UserChanges{Email: &email}, current.Version); retCode == ModelSuccess {
+				lock.Lock()
+				wins[current.Version]++
+				lock.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	user, _, _ := memDB.GetUser(ctx, "Alfie")
+	for version, count := range wins {
+		if count != 1 {
+			t.Errorf("expected one write to win at version %v, got %v", version, count)
+		}
+	}
+	if user.Version != len(wins)+1 {
+		t.Errorf("expected version %v, got %v", len(wins)+1, user.Version)
+	}
+	checkIndexes(t, memDB)
+}
+
+// Test that what the store hands out is a copy - changing it changes nothing stored.
+func TestMemoryDBCopies(t *testing.T) {
+	ctx := context.Background()
+	memDB := &MemoryDB{}
+	memDB.InitDB()
+	memDB.CreateUser(ctx, User{UserName: "Alfie", Email: "alfie@example.com", Password: "hash"})
+
+	page, _, _ := memDB.GetAllUsers(ctx, UserQuery{})
+	page.Users[0].Email = "changed@example.com"
+	user, _, _ := memDB.GetUser(ctx, "Alfie")
+	user.Password = "changed"
+	if stored, _, _ := memDB.GetUser(ctx, "Alfie"); stored.Email != "alfie@example.com" || stored.Password != "hash" {
+		t.Errorf("expected the stored user to be untouched, got %+v", stored)
+	}
+}
+
+func newBenchmarkDB(b *testing.B, count int) *MemoryDB {
+	b.Helper()
+	memDB := &MemoryDB{}
+	memDB.InitDB()
+	for i := 0; i < count; i++ {
+		userName := fmt.Sprintf("user%06d", i)
+		memDB.CreateUser(context.Background(), User{UserName: userName, Email: userName + "@example.com", Password: "hash"})
+	}
+	return memDB
+}
+
+func BenchmarkMemoryDBCreateUser(b *testing.B) {
+	defer func(saved bool) { uniqueEmails = saved }(uniqueEmails)
+	uniqueEmails = true
+	ctx := context.Background()
+	memDB := newBenchmarkDB(b, 10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		userName := fmt.Sprintf("bench%v", i)
+		memDB.CreateUser(ctx, User{UserName: userName, Email: userName + "@example.com", Password: "hash"})
+	}
+}
+
+func BenchmarkMemoryDBGetUser(b *testing.B) {
+	ctx := context.Background()
+	memDB := newBenchmarkDB(b, 10000)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			memDB.GetUser(ctx, fmt.Sprintf("user%06d", i%10000))
+		}
+	})
+}
+
+func BenchmarkMemoryDBGetAllUsers(b *testing.B) {
+	ctx := context.Background()
+	memDB := newBenchmarkDB(b, 10000)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			memDB.GetAllUsers(ctx, UserQuery{UserNamePrefix: "user00", Limit: 20})
+		}
+	})
+}
+
+// as above, sorted by name, so the prefix narrows the order without a scan.
+func BenchmarkMemoryDBGetAllUsersByName(b *testing.B) {
+	ctx := context.Background()
+	memDB := newBenchmarkDB(b, 10000)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			memDB.GetAllUsers(ctx, UserQuery{UserNamePrefix: "user00", SortBy: sortByUserName, Limit: 20})
+		}
+	})
+}
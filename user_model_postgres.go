@@ -0,0 +1,59 @@
+package main
+
+// The PostgreSQL flavour of the SQL user model in user_model.go. The tables are in
+// migrations/postgres.
+// go get -u github.com/jackc/pgx/v5
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+var postgresDialect = sqlDialect{
+	driverName: "pgx",
+	system:     "postgresql",
+	migrations: postgresMigrationDialect,
+	truncate:   []string{"TRUNCATE table %v RESTART IDENTITY"},
+	// LIKE already escapes with a backslash.
+	rebind:       numberedPlaceholders,
+	returning:    " RETURNING ID, UserName, Email, Password, Version",
+	duplicateKey: postgresDuplicateKey,
+}
+
+// Postgres' SQLSTATE for a row that would break a UNIQUE constraint.
+const postgresUniqueViolation = "23505"
+
+// numberedPlaceholders turns each '?' in query into Postgres' $1, $2 and so on. A '?' inside a
+// quoted literal is left alone.
+func numberedPlaceholders(query string) string {
+	var rebound strings.Builder
+	count, isQuoted := 0, false
+	for _, char := range query {
+		switch {
+		case char == '\'':
+			isQuoted = !isQuoted
+		case char == '?' && isQuoted == false:
+			count++
+			rebound.WriteString("$" + strconv.Itoa(count))
+			continue
+		}
+		rebound.WriteRune(char)
+	}
+	return rebound.String()
+}
+
+// postgresDuplicateKey - the column a unique violation is on, from its detail, which reads
+// "Key (column)=(value) already exists.". The constraint's name would do too, but Postgres
+// truncates long ones.
+func postgresDuplicateKey(err error) (string, bool) {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) == false || pgErr.Code != postgresUniqueViolation {
+		return "", false
+	}
+	column, _, _ := strings.Cut(strings.TrimPrefix(pgErr.Detail, "Key ("), ")")
+	return column, true
+}
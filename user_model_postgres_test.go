@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestNumberedPlaceholders(t *testing.T) {
+	for query, expected := range map[string]string{
+		"SELECT ID from t where UserName = ?":                     "SELECT ID from t where UserName = $1",
+		"UPDATE t SET Email = ? where A = ? AND (? = 0 OR B = ?)": "UPDATE t SET Email = $1 where A = $2 AND ($3 = 0 OR B = $4)",
+		"SELECT '?' from t where A = ?":                           "SELECT '?' from t where A = $1",
+	} {
+		if rebound := numberedPlaceholders(query); rebound != expected {
+			t.Errorf("expected '%v', got '%v'", expected, rebound)
+		}
+	}
+}
+
+func TestPostgresDuplicateStatus(t *testing.T) {
+	for err, expected := range map[error]ModelStatusCode{
+		&pgconn.PgError{Code: "23505", Detail: "Key (username)=(Alfie) already exists."}:                             ModelDuplicateUserName,
+		fmt.Errorf("insert: %w", &pgconn.PgError{Code: "23505", Detail: "Key (emailkey)=(a@b.com) already exists."}): ModelDuplicateEmail,
+	} {
+		if retCode, isDuplicate := postgresDialect.duplicateStatus(err); isDuplicate == false || retCode != expected {
+			t.Errorf("%v: expected %v, got %v", err, ModelStatusText(expected), ModelStatusText(retCode))
+		}
+	}
+	if _, isDuplicate := postgresDialect.duplicateStatus(&pgconn.PgError{Code: "23502"}); isDuplicate {
+		t.Error("expected a not null violation not to be a duplicate")
+	}
+}
+
+// Runs against a Postgres of your own, e.g.
+//
+//	ENDPOINT_TEST_POSTGRES_DSN=postgres://postgres@127.0.0.1:5432/endpoint_test?sslmode=disable go test -run Postgres
+//
+// The tables are prefixed pgTest and are emptied.
+func TestPostgresStore(t *testing.T) {
+	dsn := os.Getenv("ENDPOINT_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("ENDPOINT_TEST_POSTGRES_DSN not set")
+	}
+	postgresDB := &MyDB{dialect: postgresDialect, dsn: dsn, dbName: PostgresConfig{DSN: dsn}.databaseName(), tableName: "pgTestUsers",
+		sessionTableName: "pgTestSessions", refreshTableName: "pgTestRefreshTokens"}
+	if postgresDB.InitDB() == false {
+		t.Fatal("failed to initialize the Postgres store")
+	}
+	defer postgresDB.ReleaseDB()
+	testSQLUsers(t, postgresDB)
+	testUserNameCase(t, postgresDB)
+	testSQLTokens(t, postgresDB)
+}
@@ -0,0 +1,39 @@
+package main
+
+// The SQLite flavour of the SQL user model in user_model.go, for single node installs and tests
+// that have no mySQL to hand. The database is a file, or :memory: for one that lasts as long as
+// the process. The tables are in migrations/sqlite and behave as the mySQL ones do.
+// go get -u modernc.org/sqlite
+
+import (
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+var sqliteDialect = sqlDialect{
+	driverName: "sqlite",
+	system:     "sqlite",
+	// a :memory: database belongs to the connection that opened it, and SQLite only has one writer
+	// at a time anyway, so every operation shares a single connection.
+	maxOpenConns: 1,
+	migrations:   sqliteMigrationDialect,
+	// no TRUNCATE, and AUTOINCREMENT remembers the last ID in sqlite_sequence.
+	truncate:     []string{"DELETE from %v", "DELETE from sqlite_sequence where name = '%v'"},
+	likeEscape:   ` ESCAPE '\'`,
+	duplicateKey: sqliteDuplicateKey,
+}
+
+// sqliteDuplicateKey - "UNIQUE constraint failed: table.column". Drivers wrap it in their own error
+// types, but all pass on SQLite's message.
+func sqliteDuplicateKey(err error) (string, bool) {
+	if err == nil {
+		return "", false
+	}
+	_, columns, isDuplicate := strings.Cut(err.Error(), "UNIQUE constraint failed: ")
+	if isDuplicate == false {
+		return "", false
+	}
+	column, _, _ := strings.Cut(columns, " ")
+	return strings.TrimSuffix(column, ","), true
+}
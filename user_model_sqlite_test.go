@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func newSQLiteTestDB(t *testing.T) *MyDB {
+	t.Helper()
+	sqliteDB := &MyDB{dialect: sqliteDialect, dsn: ":memory:", dbName: ":memory:", tableName: "usersTest",
+		sessionTableName: "userSessions", refreshTableName: "userRefreshTokens"}
+	if sqliteDB.InitDB() == false {
+		t.Fatal("failed to initialize the SQLite store")
+	}
+	t.Cleanup(sqliteDB.ReleaseDB)
+	return sqliteDB
+}
+
+// Test that the SQLite tables keep the mySQL rules, down to user names being unique ignoring case.
+func TestSQLiteUsers(t *testing.T) {
+	sqliteDB := newSQLiteTestDB(t)
+	testSQLUsers(t, sqliteDB)
+	testUserNameCase(t, sqliteDB)
+}
+
+func TestSQLiteDuplicateEmails(t *testing.T) {
+	defer func(saved bool) { uniqueEmails = saved }(uniqueEmails)
+	uniqueEmails = true
+	ctx := context.Background()
+	sqliteDB := newSQLiteTestDB(t)
+	sqliteDB.CreateUser(ctx, User{UserName: "Alfie", Email: "alfie@example.com", Password: "hash"})
+	if _, retCode, _ := sqliteDB.CreateUser(ctx, User{UserName: "Tony", Email: " ALFIE@Example.com", Password: "hash"}); retCode != ModelDuplicateEmail {
+		t.Errorf("expected a duplicate email, got %v", ModelStatusText(retCode))
+	}
+
+	for err, expected := range map[error]string{
+		fmt.Errorf("constraint failed: UNIQUE constraint failed: usersTest.EmailKey (2067)"): "usersTest.EmailKey",
+		fmt.Errorf("UNIQUE constraint failed: usersTest.UserName"):                           "usersTest.UserName",
+	} {
+		if key, isDuplicate := sqliteDuplicateKey(err); isDuplicate == false || key != expected {
+			t.Errorf("%v: expected key %v, got '%v'", err, expected, key)
+		}
+	}
+	if _, isDuplicate := sqliteDuplicateKey(fmt.Errorf("NOT NULL constraint failed: usersTest.UserName")); isDuplicate {
+		t.Error("expected a NOT NULL failure not to be a duplicate")
+	}
+}
+
+// Test that email keys filled in for existing users match those new writes make, beyond ASCII too.
+func TestSQLiteEmailKeyBackfill(t *testing.T) {
+	defer func(saved bool) { uniqueEmails = saved }(uniqueEmails)
+	uniqueEmails = false
+	ctx := context.Background()
+	sqliteDB := newSQLiteTestDB(t)
+	sqliteDB.CreateUser(ctx, User{UserName: "Zoe", Email: "\tZOË@Example.com\n", Password: "hash"})
+	sqliteDB.CreateUser(ctx, User{UserName: "Alfie", Email: "alfie@example.com", Password: "hash"})
+
+	uniqueEmails = true
+	if sqliteDB.syncEmailKeys() == false {
+		t.Fatal("failed to fill in the email keys")
+	}
+	if _, retCode, _ := sqliteDB.CreateUser(ctx, User{UserName: "Tony", Email: "zoë@example.com", Password: "hash"}); retCode != ModelDuplicateEmail {
+		t.Errorf("expected a duplicate of the backfilled email, got %v", ModelStatusText(retCode))
+	}
+
+	// all or nothing: a clash leaves no keys behind.
+	uniqueEmails = false
+	sqliteDB.syncEmailKeys()
+	sqliteDB.CreateUser(ctx, User{UserName: "Tony", Email: "ALFIE@example.com", Password: "hash"})
+	uniqueEmails = true
+	if sqliteDB.syncEmailKeys() {
+		t.Error("expected users sharing an email to stop the keys being filled in")
+	}
+	var keyed int
+	sqliteDB.connection.QueryRow("SELECT COUNT(*) from usersTest where EmailKey IS NOT NULL").Scan(&keyed)
+	if keyed != 0 {
+		t.Errorf("expected no email keys after a failed fill, got %v", keyed)
+	}
+}
+
+func TestSQLiteTokens(t *testing.T) {
+	testSQLTokens(t, newSQLiteTestDB(t))
+}
+
+// Test that two deployments sharing a database, each with its own tables, keep their own migration
+// history rather than one taking the other's for its own.
+func TestSQLiteMigrationsTable(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "shared.db")
+	for _, prefix := range []string{"a", "b"} {
+		sqliteDB := &MyDB{dialect: sqliteDialect, dsn: dsn, dbName: dsn, tableName: prefix + "Users", sessionTableName: prefix + "Sessions",
+			refreshTableName: prefix + "RefreshTokens", migrationsTable: prefix + "_migrations"}
+		if sqliteDB.InitDB() == false {
+			t.Fatalf("%v: failed to initialize the SQLite store", prefix)
+		}
+		defer sqliteDB.ReleaseDB()
+		if _, retCode, reason := sqliteDB.CreateUser(context.Background(), User{UserName: "Alfie", Email: "a@example.com", Password: "hash"}); retCode != ModelSuccess {
+			t.Errorf("%v: expected its own users table to be created, got %v", prefix, reason)
+		}
+		states, _ := sqliteDB.MigrationStatus()
+		for _, state := range states {
+			if state.Applied == false {
+				t.Errorf("%v: expected migration %v to be applied", prefix, state.Name)
+			}
+		}
+	}
+
+	badTable := &MyDB{tableName: "users", sessionTableName: "sessions", refreshTableName: "refreshTokens", migrationsTable: "bad name"}
+	if badTable.hasValidTableNames() {
+		t.Error("expected an invalid migrations table name to be refused")
+	}
+}
+
+// Test that concurrent first uses of a query share one cached statement, and that the prepare
+// honours its context.
+func TestSQLitePrepared(t *testing.T) {
+	sqliteDB := newSQLiteTestDB(t)
+	const query = "SELECT COUNT(*) FROM %v WHERE UserName = ?"
+	stmts := make(chan *sql.Stmt, 8)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(stmts); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stmt, err := sqliteDB.statement(context.Background(), query)
+			if err != nil {
+				t.Errorf("prepare failed: %v", err)
+				return
+			}
+			stmts <- stmt.stmt
+		}()
+	}
+	wg.Wait()
+	close(stmts)
+	cached := sqliteDB.statements[fmt.Sprintf(query, sqliteDB.tableName)]
+	for stmt := range stmts {
+		if stmt != cached {
+			t.Error("expected every caller to get the cached statement")
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := sqliteDB.statement(ctx, "SELECT ID FROM %v WHERE UserName = ?"); err == nil {
+		t.Error("expected a prepare on a canceled context to fail")
+	}
+}
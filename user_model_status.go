@@ -11,15 +11,51 @@ const (
 	ModelDBUserNotFound
 	ModelDBUpdateFailure
 	ModelDBDeleteFailure
+	ModelInvalidCredentials
+	ModelSessionNotFound
+	ModelDBSessionFailure
+	ModelTokenNotFound
+	ModelDBTokenFailure
+	ModelInvalidQuery
+	ModelInvalidPatch
+	ModelVersionConflict
+	ModelDBTimeout
+	ModelCanceled
+	ModelInvalidUser
+	ModelDuplicateUserName
+	ModelDuplicateEmail
 )
 
 var modelStatusText = map[ModelStatusCode]string{
-	ModelSuccess:         "Success",
-	ModelDBCreateFailure: "User create failure",
-	ModelDBGetFailure:    "User get failure",
-	ModelDBUserNotFound:  "User not found",
-	ModelDBUpdateFailure: "User update failure",
-	ModelDBDeleteFailure: "User delete failure",
+	ModelSuccess:            "Success",
+	ModelDBCreateFailure:    "User create failure",
+	ModelDBGetFailure:       "User get failure",
+	ModelDBUserNotFound:     "User not found",
+	ModelDBUpdateFailure:    "User update failure",
+	ModelDBDeleteFailure:    "User delete failure",
+	ModelInvalidCredentials: "Invalid credentials",
+	ModelSessionNotFound:    "Session not found",
+	ModelDBSessionFailure:   "Session failure",
+	ModelTokenNotFound:      "Token not found",
+	ModelDBTokenFailure:     "Token failure",
+	ModelInvalidQuery:       "Invalid query",
+	ModelInvalidPatch:       "Invalid patch",
+	ModelVersionConflict:    "Version conflict",
+	ModelDBTimeout:          "Store timeout",
+	ModelCanceled:           "Request canceled",
+	ModelInvalidUser:        "Invalid user",
+	ModelDuplicateUserName:  "User name taken",
+	ModelDuplicateEmail:     "Email taken",
+}
+
+// isStoreFailure reports whether code means the store could not do what was asked, rather than
+// answering it.
+func isStoreFailure(code ModelStatusCode) bool {
+	switch code {
+	case ModelDBCreateFailure, ModelDBGetFailure, ModelDBUpdateFailure, ModelDBDeleteFailure, ModelDBSessionFailure, ModelDBTokenFailure:
+		return true
+	}
+	return false
 }
 
 // ModelStatusText returns a text for the HTTP status code. It returns the empty
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestDuplicateStatus(t *testing.T) {
+	for err, expected := range map[error]ModelStatusCode{
+		&mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'Alfie' for key 'usersTest.UserName'"}:               ModelDuplicateUserName,
+		&mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'alfie@example.com' for key 'EmailKey'"}:             ModelDuplicateEmail,
+		fmt.Errorf("insert: %w", &mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'a' for key 't.EmailKey'"}): ModelDuplicateEmail,
+	} {
+		if retCode, isDuplicate := mysqlDialect.duplicateStatus(err); isDuplicate == false || retCode != expected {
+			t.Errorf("%v: expected %v, got %v", err, ModelStatusText(expected), ModelStatusText(retCode))
+		}
+	}
+	for _, err := range []error{nil, fmt.Errorf("connection refused"), &mysql.MySQLError{Number: 1146, Message: "Table doesn't exist"}} {
+		if _, isDuplicate := mysqlDialect.duplicateStatus(err); isDuplicate {
+			t.Errorf("%v: not a duplicate", err)
+		}
+	}
+}
+
+// testSQLUsers checks sqlDB keeps the rules of the mySQL tables: IDs counting up from 1, never
+// reused until the table is emptied, and unique user names. It empties the tables first.
+func testSQLUsers(t *testing.T, sqlDB *MyDB) {
+	t.Helper()
+	ctx := context.Background()
+	if retCode, reason := sqlDB.DeleteAllUsers(ctx); retCode != ModelSuccess {
+		t.Fatalf("failed to delete all users: %v", reason)
+	}
+	for i, user := range myUsers {
+		created, retCode, reason := sqlDB.CreateUser(ctx, User{UserName: user.UserName, Email: user.Email, Password: "hash"})
+		if retCode != ModelSuccess {
+			t.Fatalf("failed to create %v: %v", user.UserName, reason)
+		}
+		if created.ID != i+1 || created.Version != 1 || created.Password != "hash" {
+			t.Errorf("expected %v back as stored with ID %v, got %+v", user.UserName, i+1, created)
+		}
+	}
+	if _, retCode, _ := sqlDB.CreateUser(ctx, User{UserName: "Alfie", Email: "a@example.com", Password: "hash"}); retCode != ModelDuplicateUserName {
+		t.Errorf("expected a duplicate user name, got %v", ModelStatusText(retCode))
+	}
+
+	last := myUsers[len(myUsers)-1].UserName
+	if user, _, _ := sqlDB.GetUser(ctx, last); user.ID != len(myUsers) || user.Version != 1 {
+		t.Errorf("expected %v to have ID %v, got %+v", last, len(myUsers), user)
+	}
+	sqlDB.DeleteUser(ctx, last, 0)
+	if user, _, _ := sqlDB.CreateUser(ctx, User{UserName: "Zed", Email: "zed@example.com", Password: "hash"}); user.ID != len(myUsers)+1 {
+		t.Errorf("expected a deleted user's ID not to be reused, got %+v", user)
+	}
+
+	if user, retCode, _ := sqlDB.UpdateUser(ctx, User{UserName: "Alfie", Email: "alfie@new.org", Password: "hash2"}, 1); retCode != ModelSuccess || user.Version != 2 {
+		t.Errorf("expected the update to bump the version, got %v %+v", ModelStatusText(retCode), user)
+	}
+	if _, retCode, _ := sqlDB.UpdateUser(ctx, User{UserName: "Alfie", Email: "alfie@new.org", Password: "hash2"}, 1); retCode != ModelVersionConflict {
+		t.Errorf("expected a version conflict, got %v", ModelStatusText(retCode))
+	}
+	email := "alfie@patched.org"
+	if user, retCode, _ := sqlDB.PatchUser(ctx, "Alfie", UserChanges{Email: &email}, 2); retCode != ModelSuccess || user.Email != email || user.Version != 3 {
+		t.Errorf("expected the patch to apply, got %v %+v", ModelStatusText(retCode), user)
+	}
+
+	// LIKE wildcards in a filter only match themselves.
+	sqlDB.CreateUser(ctx, User{UserName: "under_score", Email: "u@example.com", Password: "hash"})
+	sqlDB.CreateUser(ctx, User{UserName: "underXscore", Email: "x@example.com", Password: "hash"})
+	if page, _, reason := sqlDB.GetAllUsers(ctx, UserQuery{UserNamePrefix: "under_"}); page.Total != 1 || len(page.Users) != 1 {
+		t.Errorf("expected just under_score, got %+v %v", page, reason)
+	}
+
+	if retCode, reason := sqlDB.DeleteAllUsers(ctx); retCode != ModelSuccess {
+		t.Fatalf("failed to delete all users: %v", reason)
+	}
+	sqlDB.CreateUser(ctx, User{UserName: "Alfie", Email: "alfie@example.com", Password: "hash"})
+	if user, _, _ := sqlDB.GetUser(ctx, "Alfie"); user.ID != 1 {
+		t.Errorf("expected IDs to start again once the table is emptied, got %+v", user)
+	}
+}
+
+// testUserNameCase checks store tells user names apart ignoring case, as the mySQL tables do: a
+// second "alfie" is a duplicate of "Alfie", and every lookup finds Alfie whatever the case asked
+// for. It empties the store first.
+func testUserNameCase(t *testing.T, store UserStore) {
+	t.Helper()
+	ctx := context.Background()
+	if retCode, reason := store.DeleteAllUsers(ctx); retCode != ModelSuccess {
+		t.Fatalf("failed to delete all users: %v", reason)
+	}
+	store.CreateUser(ctx, User{UserName: "Alfie", Email: "alfie@example.com", Password: "hash"})
+	if _, retCode, _ := store.CreateUser(ctx, User{UserName: "alfie", Email: "other@example.com", Password: "hash"}); retCode != ModelDuplicateUserName {
+		t.Errorf("expected a duplicate user name ignoring case, got %v", ModelStatusText(retCode))
+	}
+	if user, retCode, _ := store.GetUser(ctx, "alfie"); retCode != ModelSuccess || user.UserName != "Alfie" {
+		t.Errorf("expected to find Alfie ignoring case, got %+v %v", user, ModelStatusText(retCode))
+	}
+	if _, retCode, reason := store.UpdateUser(ctx, User{UserName: "ALFIE", Email: "alfie@example.org", Password: "hash"}, 0); retCode != ModelSuccess {
+		t.Errorf("expected to update Alfie ignoring case, got %v", reason)
+	}
+	email := "alfie@example.net"
+	if _, retCode, reason := store.PatchUser(ctx, "aLFIE", UserChanges{Email: &email}, 0); retCode != ModelSuccess {
+		t.Errorf("expected to patch Alfie ignoring case, got %v", reason)
+	}
+	if _, retCode, reason := store.DeleteUser(ctx, "alfie", 0); retCode != ModelSuccess {
+		t.Errorf("expected to delete Alfie ignoring case, got %v", reason)
+	}
+	if _, retCode, _ := store.GetUser(ctx, "Alfie"); retCode != ModelDBUserNotFound {
+		t.Errorf("expected Alfie to be gone, got %v", ModelStatusText(retCode))
+	}
+}
+
+// testSQLTokens checks sessions and refresh tokens round trip through sqlDB.
+func testSQLTokens(t *testing.T, sqlDB *MyDB) {
+	t.Helper()
+	ctx := context.Background()
+	sqlDB.CreateSession(ctx, Session{TokenHash: "session", UserName: "Alfie", Expires: time.Now().Add(time.Hour)})
+	if session, retCode, _ := sqlDB.GetSession(ctx, "session"); retCode != ModelSuccess || session.UserName != "Alfie" {
+		t.Errorf("expected to find the session, got %v %+v", ModelStatusText(retCode), session)
+	}
+	sqlDB.DeleteSession(ctx, "session")
+	sqlDB.CreateRefreshToken(ctx, RefreshToken{TokenHash: "refresh", UserName: "Alfie", Expires: time.Now().Add(time.Hour)})
+	if _, retCode, _ := sqlDB.ConsumeRefreshToken(ctx, "refresh"); retCode != ModelSuccess {
+		t.Errorf("expected to consume the refresh token, got %v", ModelStatusText(retCode))
+	}
+	if _, retCode, _ := sqlDB.ConsumeRefreshToken(ctx, "refresh"); retCode != ModelTokenNotFound {
+		t.Errorf("expected a refresh token to be used only once, got %v", ModelStatusText(retCode))
+	}
+}
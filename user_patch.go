@@ -0,0 +1,150 @@
+package main
+
+// Partial updates for PATCH /users/{userName}. The request body is either a JSON Merge Patch
+// (RFC 7386) or a JSON Patch (RFC 6902), picked by Content-Type. Either way the patch is applied to
+// the user's current record, the result is validated as a whole, and only the columns that actually
+// changed are written back.
+// go get -u github.com/evanphx/json-patch/v5
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+)
+
+// Patch document types, by Content-Type.
+const (
+	mergePatchContentType = "application/merge-patch+json"
+	jsonPatchContentType  = "application/json-patch+json"
+)
+
+// UserChanges - the columns a patch changed. Nil means leave alone. Password is the new hash.
+type UserChanges struct {
+	Email    *string
+	Password *string
+}
+
+func (changes UserChanges) isEmpty() bool {
+	return changes.Email == nil && changes.Password == nil
+}
+
+// patchableUser - the document a patch is applied to. The stored password hash is never exposed,
+// so Password is empty going in and only set coming out if the patch supplied a new one.
+type patchableUser struct {
+	ID       int    `json:"ID"`
+	UserName string `json:"UserName"`
+	Email    string `json:"Email"`
+	Password string `json:"Password"`
+}
+
+// patchDocumentType maps a request Content-Type onto the patch format. Plain JSON is treated as a
+// merge patch, which is what a client sending a partial user object means anyway.
+func patchDocumentType(contentType string) (string, bool) {
+	if contentType == "" {
+		return mergePatchContentType, true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", false
+	}
+	switch mediaType {
+	case mergePatchContentType, "application/json":
+		return mergePatchContentType, true
+	case jsonPatchContentType:
+		return jsonPatchContentType, true
+	}
+	return "", false
+}
+
+// applyUserPatch applies patch to user, returning the changed columns. ID and UserName may not change.
+func applyUserPatch(user User, patchType string, patch []byte) (UserChanges, User, error) {
+	var changes UserChanges
+	original, err := json.Marshal(patchableUser{ID: user.ID, UserName: user.UserName, Email: user.Email})
+	if err != nil {
+		return changes, user, err
+	}
+
+	var patched []byte
+	switch patchType {
+	case jsonPatchContentType:
+		var ops jsonpatch.Patch
+		if ops, err = jsonpatch.DecodePatch(patch); err != nil {
+			return changes, user, fmt.Errorf("invalid JSON patch: %v", err)
+		}
+		if patched, err = ops.Apply(original); err != nil {
+			return changes, user, fmt.Errorf("failed to apply JSON patch: %v", err)
+		}
+	default:
+		if json.Valid(patch) == false || bytes.HasPrefix(bytes.TrimSpace(patch), []byte("{")) == false {
+			return changes, user, fmt.Errorf("invalid merge patch: expected a JSON object")
+		}
+		if patched, err = jsonpatch.MergePatch(original, patch); err != nil {
+			return changes, user, fmt.Errorf("failed to apply merge patch: %v", err)
+		}
+	}
+
+	// strict decode, so a patch that adds a field we don't have is an error rather than ignored.
+	var result patchableUser
+	decoder := json.NewDecoder(bytes.NewReader(patched))
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(&result); err != nil {
+		return changes, user, fmt.Errorf("patched user is not valid: %v", err)
+	}
+	if result.ID != user.ID || result.UserName != user.UserName {
+		return changes, user, fmt.Errorf("ID and UserName cannot be patched")
+	}
+
+	if result.Email != user.Email {
+		user.Email = result.Email
+		changes.Email = &user.Email
+	}
+	if result.Password != "" {
+		user.Password = result.Password
+		changes.Password = &user.Password
+	}
+	return changes, user, nil
+}
+
+// modelPatchUser applies a patch document to a user. The patched user is validated as a whole; only
+// changed columns are handed to the store, and a new password is hashed first. The write is
+// conditional on the version the patch was applied to, so a concurrent update is never lost.
+func modelPatchUser(ctx context.Context, userName string, patchType string, patch []byte, preconditions Preconditions) (User, ModelStatusCode, string) {
+	user, retCode, reason := userStore.GetUser(ctx, userName)
+	if retCode == ModelDBUserNotFound && len(preconditions.IfMatch) > 0 {
+		return user, ModelVersionConflict, reason
+	} else if retCode != ModelSuccess {
+		return user, retCode, reason
+	}
+	if preconditions.allows(user, true) == false {
+		return user, ModelVersionConflict, fmt.Sprintf("precondition failed for user '%v', current version is %v", userName, userETag(user))
+	}
+
+	changes, patchedUser, err := applyUserPatch(user, patchType, patch)
+	if err != nil {
+		return user, ModelInvalidPatch, err.Error()
+	}
+	if changes.isEmpty() {
+		return user, ModelSuccess, ""
+	}
+	// only what the patch changed is held to the rules; the user name can't change, and the stored
+	// password is a hash.
+	fields := []string{"Email"}
+	if changes.Password != nil {
+		fields = append(fields, "Password")
+	}
+	if fieldErrors := validateUserFields(patchedUser, fields...); len(fieldErrors) > 0 {
+		return user, ModelInvalidPatch, fieldErrorsReason(fieldErrors)
+	}
+	if changes.Password != nil {
+		hash, err := hashPassword(*changes.Password)
+		if err != nil {
+			return user, ModelDBUpdateFailure, fmt.Sprintf("failed to hash password: %v", err)
+		}
+		changes.Password = &hash
+	}
+	return userStore.PatchUser(ctx, userName, changes, user.Version)
+}
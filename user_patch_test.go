@@ -0,0 +1,66 @@
+package main
+
+import "testing"
+
+// Apply merge patches and JSON patches to a user and check which columns they report as changed.
+func TestApplyUserPatch(t *testing.T) {
+	user := User{ID: 7, UserName: "Alfie", Email: "alfie@some_office.org", Password: "$2a$10$storedhash"}
+
+	tests := []struct {
+		name          string
+		patchType     string
+		patch         string
+		expectError   bool
+		emailChanged  bool
+		passwdChanged bool
+	}{
+		{"merge email", mergePatchContentType, `{"Email":"new@example.com"}`, false, true, false},
+		{"merge password", mergePatchContentType, `{"Password":"secret"}`, false, false, true},
+		{"merge same email", mergePatchContentType, `{"Email":"alfie@some_office.org"}`, false, false, false},
+		{"merge null password", mergePatchContentType, `{"Password":null}`, false, false, false},
+		{"merge user name", mergePatchContentType, `{"UserName":"Bob"}`, true, false, false},
+		{"merge unknown field", mergePatchContentType, `{"Admin":true}`, true, false, false},
+		{"merge not an object", mergePatchContentType, `["Email"]`, true, false, false},
+		{"json patch replace", jsonPatchContentType, `[{"op":"replace","path":"/Email","value":"new@example.com"}]`, false, true, false},
+		{"json patch test then replace", jsonPatchContentType,
+			`[{"op":"test","path":"/Email","value":"alfie@some_office.org"},{"op":"replace","path":"/Password","value":"secret"}]`, false, false, true},
+		{"json patch failed test", jsonPatchContentType,
+			`[{"op":"test","path":"/Email","value":"someone@else.org"},{"op":"replace","path":"/Email","value":"new@example.com"}]`, true, false, false},
+		{"json patch id", jsonPatchContentType, `[{"op":"replace","path":"/ID","value":8}]`, true, false, false},
+		{"json patch remove user name", jsonPatchContentType, `[{"op":"remove","path":"/UserName"}]`, true, false, false},
+		{"json patch garbage", jsonPatchContentType, `{"op":"replace"}`, true, false, false},
+	}
+	for _, test := range tests {
+		changes, patched, err := applyUserPatch(user, test.patchType, []byte(test.patch))
+		if (err != nil) != test.expectError {
+			t.Errorf("    %v: expected error %v, got %v", test.name, test.expectError, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if (changes.Email != nil) != test.emailChanged || (changes.Password != nil) != test.passwdChanged {
+			t.Errorf("    %v: unexpected changes %+v", test.name, changes)
+		}
+		if changes.Password == nil && patched.Password != user.Password {
+			t.Errorf("    %v: stored hash was touched", test.name)
+		}
+	}
+}
+
+// Content types map onto the two patch formats, anything else is refused.
+func TestPatchDocumentType(t *testing.T) {
+	for contentType, expected := range map[string]string{
+		"":                                  mergePatchContentType,
+		"application/json":                  mergePatchContentType,
+		"application/merge-patch+json":      mergePatchContentType,
+		"application/json-patch+json":       jsonPatchContentType,
+		"application/json; charset=utf-8":   mergePatchContentType,
+		"text/plain":                        "",
+		"application/x-www-form-urlencoded": "",
+	} {
+		if patchType, _ := patchDocumentType(contentType); patchType != expected {
+			t.Errorf("    %q: expected %q, got %q", contentType, expected, patchType)
+		}
+	}
+}
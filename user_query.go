@@ -0,0 +1,154 @@
+package main
+
+// Filtering, sorting and keyset paging for GetAllUsers. The backends each apply a UserQuery in their
+// own way (WHERE/ORDER BY/LIMIT for mySQL, a slice of an order kept sorted for memory) but share the
+// cursor format below, so a cursor is just "the sort key and ID of the last user on the previous page".
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Sort fields accepted in UserQuery.SortBy.
+const (
+	sortByID       = "ID"
+	sortByUserName = "UserName"
+	sortByEmail    = "Email"
+)
+
+// the page size when none is asked for, and the largest page we will return in one go. Every
+// query is paged, so no request can read the whole table.
+const (
+	defaultUserPageSize = 100
+	maxUserPageSize     = 1000
+)
+
+// UserQuery - which users GetAllUsers should return. The zero value returns the first page of users in
+// ID order. User names and emails are matched and sorted ignoring case, as mySQL's collation does.
+type UserQuery struct {
+	UserNamePrefix string
+	EmailDomain    string // matches the part of the email after the '@', case insensitive
+	SortBy         string // one of the sortBy* constants, defaults to ID
+	Descending     bool
+	Limit          int    // page size, 0 for defaultUserPageSize
+	Cursor         string // NextCursor from the previous page
+}
+
+// UserPage - one page of GetAllUsers results.
+type UserPage struct {
+	Users      []User
+	Total      int    // users matching the filters, across all pages
+	NextCursor string // empty on the last page
+}
+
+// userCursor - decoded form of a paging cursor. The sort order is included so a cursor cannot be
+// replayed against a differently sorted query.
+type userCursor struct {
+	SortBy     string `json:"s"`
+	Descending bool   `json:"d,omitempty"`
+	Key        string `json:"k,omitempty"`
+	ID         int    `json:"i"`
+}
+
+func (query UserQuery) sortBy() string {
+	if query.SortBy == "" {
+		return sortByID
+	}
+	return query.SortBy
+}
+
+// pageSize - the number of users a page of query holds at most.
+func (query UserQuery) pageSize() int {
+	if query.Limit == 0 {
+		return defaultUserPageSize
+	}
+	return query.Limit
+}
+
+// isValidUserQuery checks the query and decodes its cursor, if any.
+func isValidUserQuery(query UserQuery) (bool, string, *userCursor) {
+	switch query.sortBy() {
+	case sortByID, sortByUserName, sortByEmail:
+	default:
+		return false, fmt.Sprintf("cannot sort by '%v'", query.SortBy), nil
+	}
+	if query.Limit < 0 || query.Limit > maxUserPageSize {
+		return false, fmt.Sprintf("limit must be between 0 and %v", maxUserPageSize), nil
+	}
+	if query.Cursor == "" {
+		return true, "", nil
+	}
+
+	var cursor userCursor
+	raw, err := base64.RawURLEncoding.DecodeString(query.Cursor)
+	if err == nil {
+		err = json.Unmarshal(raw, &cursor)
+	}
+	if err != nil || cursor.SortBy != query.sortBy() || cursor.Descending != query.Descending {
+		return false, "invalid cursor", nil
+	}
+	return true, "", &cursor
+}
+
+// sortKey returns the value of user's sort field. ID sorting has no key beyond the ID itself.
+func (query UserQuery) sortKey(user User) string {
+	switch query.sortBy() {
+	case sortByUserName:
+		return user.UserName
+	case sortByEmail:
+		return user.Email
+	}
+	return ""
+}
+
+// nextCursor builds the cursor that continues after user.
+func (query UserQuery) nextCursor(user User) string {
+	raw, _ := json.Marshal(userCursor{SortBy: query.sortBy(), Descending: query.Descending, Key: query.sortKey(user), ID: user.ID})
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// emailDomain returns the part of email after the last '@'.
+func emailDomain(email string) string {
+	if at := strings.LastIndex(email, "@"); at >= 0 {
+		return email[at+1:]
+	}
+	return ""
+}
+
+// matches applies the query filters to a single user, for backends that filter in Go.
+func (query UserQuery) matches(user User) bool {
+	if strings.HasPrefix(strings.ToLower(user.UserName), strings.ToLower(query.UserNamePrefix)) == false {
+		return false
+	}
+	if query.EmailDomain != "" && strings.EqualFold(emailDomain(user.Email), query.EmailDomain) == false {
+		return false
+	}
+	return true
+}
+
+// less orders two users by the query's sort field ignoring case, then ID, honouring Descending.
+func (query UserQuery) less(a User, b User) bool {
+	keyA, keyB := strings.ToLower(query.sortKey(a)), strings.ToLower(query.sortKey(b))
+	if keyA != keyB {
+		return (keyA < keyB) != query.Descending
+	}
+	if a.ID == b.ID {
+		return false
+	}
+	return (a.ID < b.ID) != query.Descending
+}
+
+// afterCursor reports whether user sorts after the cursor position.
+func (query UserQuery) afterCursor(user User, cursor *userCursor) bool {
+	return query.less(User{ID: cursor.ID, UserName: cursor.Key, Email: cursor.Key}, user)
+}
+
+// parseSort turns a "sort" request parameter into a field and direction. A leading '-' means descending.
+func parseSort(sort string) (string, bool) {
+	if strings.HasPrefix(sort, "-") {
+		return sort[1:], true
+	}
+	return sort, false
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+// fill a memory store with users whose names and emails sort differently from their IDs.
+func newQueryTestDB(t *testing.T) *MemoryDB {
+	memDB := &MemoryDB{}
+	memDB.InitDB()
+	for i := 0; i < 25; i++ {
+		domain := "example.com"
+		if i%3 == 0 {
+			domain = "Other.org"
+		}
+		user := User{UserName: fmt.Sprintf("user%02d", (i*7)%25), Email: fmt.Sprintf("%c@%v", 'z'-i, domain), Password: "x"}
+		if _, retCode, reason := memDB.CreateUser(context.Background(), user); retCode != ModelSuccess {
+			t.Fatalf("    create failed: %v", reason)
+		}
+	}
+	return memDB
+}
+
+// walk every page of query, returning all the users seen.
+func collectPages(t *testing.T, memDB *MemoryDB, query UserQuery) []User {
+	var users []User
+	for pages := 0; ; pages++ {
+		page, retCode, reason := memDB.GetAllUsers(context.Background(), query)
+		if retCode != ModelSuccess {
+			t.Fatalf("    query %+v failed: %v", query, reason)
+		}
+		if query.Limit > 0 && len(page.Users) > query.Limit {
+			t.Fatalf("    page of %v exceeds limit %v", len(page.Users), query.Limit)
+		}
+		users = append(users, page.Users...)
+		if page.NextCursor == "" || pages > 100 {
+			return users
+		}
+		query.Cursor = page.NextCursor
+	}
+}
+
+// Test that paging through any sort order visits every matching user exactly once, in order.
+func TestUserQueryPaging(t *testing.T) {
+	memDB := newQueryTestDB(t)
+
+	for _, sortBy := range []string{"", sortByUserName, sortByEmail} {
+		for _, descending := range []bool{false, true} {
+			all := collectPages(t, memDB, UserQuery{SortBy: sortBy, Descending: descending})
+			paged := collectPages(t, memDB, UserQuery{SortBy: sortBy, Descending: descending, Limit: 4})
+			if len(all) != 25 || len(paged) != len(all) {
+				t.Fatalf("    sort %v/%v: expected 25 users, got %v and %v", sortBy, descending, len(all), len(paged))
+			}
+			query := UserQuery{SortBy: sortBy, Descending: descending}
+			for i := range paged {
+				if paged[i].ID != all[i].ID {
+					t.Errorf("    sort %v/%v: page order differs at %v", sortBy, descending, i)
+				}
+				if i > 0 && query.less(paged[i], paged[i-1]) {
+					t.Errorf("    sort %v/%v: out of order at %v", sortBy, descending, i)
+				}
+			}
+		}
+	}
+}
+
+// Test the filters, and that Total counts every match while the page is limited.
+func TestUserQueryFilters(t *testing.T) {
+	memDB := newQueryTestDB(t)
+
+	page, _, _ := memDB.GetAllUsers(context.Background(), UserQuery{EmailDomain: "other.ORG", Limit: 2})
+	if page.Total != 9 || len(page.Users) != 2 || page.NextCursor == "" {
+		t.Errorf("    email domain: expected 9 total in pages of 2, got %v/%v", page.Total, len(page.Users))
+	}
+	page, _, _ = memDB.GetAllUsers(context.Background(), UserQuery{UserNamePrefix: "user1"})
+	if page.Total != 10 {
+		t.Errorf("    user name prefix: expected 10, got %v", page.Total)
+	}
+
+	// bad queries are rejected, including a cursor from a different sort order.
+	page, _, _ = memDB.GetAllUsers(context.Background(), UserQuery{SortBy: sortByEmail, Limit: 2})
+	for _, query := range []UserQuery{
+		{SortBy: "Password"},
+		{Limit: -1},
+		{Limit: maxUserPageSize + 1},
+		{Cursor: "not a cursor"},
+		{SortBy: sortByUserName, Cursor: page.NextCursor},
+	} {
+		if _, retCode, _ := memDB.GetAllUsers(context.Background(), query); retCode != ModelInvalidQuery {
+			t.Errorf("    query %+v: expected invalid query, got %v", query, ModelStatusText(retCode))
+		}
+	}
+}
+
+// Test that a query without a limit is still paged.
+func TestUserQueryDefaultPageSize(t *testing.T) {
+	memDB := &MemoryDB{}
+	memDB.InitDB()
+	for i := 0; i < defaultUserPageSize+20; i++ {
+		memDB.CreateUser(context.Background(), User{UserName: fmt.Sprintf("user%03d", i), Email: "x@example.com", Password: "x"})
+	}
+
+	page, _, _ := memDB.GetAllUsers(context.Background(), UserQuery{})
+	if page.Total != defaultUserPageSize+20 || len(page.Users) != defaultUserPageSize || page.NextCursor == "" {
+		t.Errorf("    expected %v of %v users and a cursor, got %v of %v", defaultUserPageSize, defaultUserPageSize+20, len(page.Users), page.Total)
+	}
+	if all := collectPages(t, memDB, UserQuery{}); len(all) != defaultUserPageSize+20 {
+		t.Errorf("    expected to page through %v users, got %v", defaultUserPageSize+20, len(all))
+	}
+}
+
+// Test that user names and emails match and sort ignoring case, as they do in mySQL.
+func TestUserQueryIgnoresCase(t *testing.T) {
+	memDB := &MemoryDB{}
+	memDB.InitDB()
+	for _, userName := range []string{"carol", "Bob", "alice", "bert"} {
+		memDB.CreateUser(context.Background(), User{UserName: userName, Email: userName + "@example.com", Password: "x"})
+	}
+
+	for _, sortBy := range []string{sortByUserName, sortByEmail} {
+		page, _, _ := memDB.GetAllUsers(context.Background(), UserQuery{SortBy: sortBy})
+		var userNames []string
+		for _, user := range page.Users {
+			userNames = append(userNames, user.UserName)
+		}
+		if fmt.Sprint(userNames) != "[alice bert Bob carol]" {
+			t.Errorf("    sort by %v: expected alice bert Bob carol, got %v", sortBy, userNames)
+		}
+	}
+	if page, _, _ := memDB.GetAllUsers(context.Background(), UserQuery{UserNamePrefix: "B"}); page.Total != 2 {
+		t.Errorf("    user name prefix: expected Bob and bert, got %v", page.Total)
+	}
+}
+
+// Test the LIKE escaping used by the mySQL backend.
+func TestEscapeLike(t *testing.T) {
+	if escaped := escapeLike(`50%_off\`); escaped != `50\%\_off\\` {
+		t.Errorf("    got %v", escaped)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+// This is the user store - the seam between the user manager and the model implementations.
+// The handlers in user_manager.go call the model* functions below, which forward to whichever
+// backend was selected at startup. Backends live in user_model.go (mySQL, and SQLite and
+// PostgreSQL with user_model_sqlite.go and user_model_postgres.go) and user_model_memorydb.go
+// (in memory).
+// Status codes are defined in user_model_status.go
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Supported store types, as passed to selectUserStore.
+const (
+	storeMySQL    = "mysql"
+	storePostgres = "postgres"
+	storeSQLite   = "sqlite"
+	storeMemory   = "memory"
+)
+
+// UserStore - the operations every user model backend must provide.
+type UserStore interface {
+	InitDB() bool
+	ReleaseDB()
+	Ping(ctx context.Context) error // for readiness checks
+	CreateUser(ctx context.Context, newUser User) (User, ModelStatusCode, string)
+	GetUser(ctx context.Context, userName string) (User, ModelStatusCode, string)
+	GetAllUsers(ctx context.Context, query UserQuery) (UserPage, ModelStatusCode, string)
+	// ifVersion makes a write conditional on the stored Version (see user_version.go), 0 for unconditional.
+	UpdateUser(ctx context.Context, user User, ifVersion int) (User, ModelStatusCode, string)
+	PatchUser(ctx context.Context, userName string, changes UserChanges, ifVersion int) (User, ModelStatusCode, string)
+	DeleteUser(ctx context.Context, userName string, ifVersion int) (User, ModelStatusCode, string)
+	DeleteAllUsers(ctx context.Context) (ModelStatusCode, string)
+	SessionStore
+	RefreshTokenStore
+}
+
+// User - basic user definition
+//
+// The UserName is the key. The id would usually be the primary key and the UserName a secondary key.
+// Password is plain text on the way in from a request, and an encoded hash (see password.go) once it
+// has been through the model. Responses carry a UserInfo instead, so it is never sent back out.
+// Version is owned by the store - it starts at 1 and is bumped on every write - so clients cannot set it.
+type User struct {
+	ID       int    `json:"ID"`
+	UserName string `json:"UserName"`
+	Email    string `json:"Email"`
+	Password string `json:"Password"`
+	Version  int    `json:"-"`
+}
+
+// UserInfo - the public view of a User, as returned in responses.
+type UserInfo struct {
+	ID       int    `json:"ID"`
+	UserName string `json:"UserName"`
+	Email    string `json:"Email"`
+	Version  int    `json:"Version"`
+}
+
+func (user User) info() UserInfo {
+	return UserInfo{ID: user.ID, UserName: user.UserName, Email: user.Email, Version: user.Version}
+}
+
+func usersInfo(users []User) []UserInfo {
+	infos := make([]UserInfo, 0, len(users))
+	for _, user := range users {
+		infos = append(infos, user.info())
+	}
+	return infos
+}
+
+// the active backend, set once at startup by selectUserStore.
+var userStore UserStore
+
+// selectUserStore picks the backend named in config.Store. Returns false for an unknown store type.
+func selectUserStore(config Config) bool {
+	switch config.Store {
+	case storeMySQL:
+		userStore = &MyDB{dialect: mysqlDialect, dsn: config.MySQL.dsn(), dbName: config.MySQL.databaseName(), tableName: config.MySQL.UsersTable,
+			sessionTableName: config.MySQL.SessionsTable, refreshTableName: config.MySQL.RefreshTokensTable,
+			migrationsTable: config.MySQL.MigrationsTable}
+	case storePostgres:
+		userStore = &MyDB{dialect: postgresDialect, dsn: config.Postgres.DSN, dbName: config.Postgres.databaseName(), tableName: config.Postgres.UsersTable,
+			sessionTableName: config.Postgres.SessionsTable, refreshTableName: config.Postgres.RefreshTokensTable,
+			migrationsTable: config.Postgres.MigrationsTable}
+	case storeSQLite:
+		userStore = &MyDB{dialect: sqliteDialect, dsn: config.SQLite.DSN, dbName: config.SQLite.databaseName(), tableName: config.SQLite.UsersTable,
+			sessionTableName: config.SQLite.SessionsTable, refreshTableName: config.SQLite.RefreshTokensTable,
+			migrationsTable: config.SQLite.MigrationsTable}
+	case storeMemory:
+		userStore = &MemoryDB{dataDir: config.Memory.DataDir, snapshotEvery: config.Memory.SnapshotEvery}
+	default:
+		log.Printf("selectUserStore(): unknown store type '%v'", config.Store)
+		return false
+	}
+	log.Printf("selectUserStore(): using %v store", config.Store)
+	return true
+}
+
+// uniqueEmails - when set, the stores refuse a user whose email another user already has, compared
+// as normalizeEmail leaves them. Set from -unique-emails.
+var uniqueEmails = false
+
+// normalizeEmail returns the form emails are compared in: trimmed and lower cased. Strictly the
+// local part is case sensitive, but no mail provider anyone uses treats it so.
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// isValidUser - the stores' own sanity check, that a record has a name, email and password.
+// Requests have been through the rules in validation.go before they get here; those don't apply to
+// what is stored, where the password is a hash.
+func isValidUser(user User) (bool, string) {
+	var reasons []string
+	if len(user.UserName) < 1 {
+		reasons = append(reasons, "empty user name")
+	}
+	if len(user.Email) < 1 {
+		reasons = append(reasons, "invalid email")
+	}
+	if len(user.Password) < 1 {
+		reasons = append(reasons, "invalid password")
+	}
+	return len(reasons) == 0, strings.Join(reasons, "; ")
+}
+
+func initDB() bool {
+	if userStore == nil {
+		log.Println("initDB(): no user store selected")
+		return false
+	}
+	return userStore.InitDB()
+}
+
+func releaseDB() {
+	if userStore != nil {
+		userStore.ReleaseDB()
+	}
+}
+
+// modelCreateUser validates the plain text user against userRules, then hands the store a copy with the password hashed.
+func modelCreateUser(ctx context.Context, newUser User) (User, ModelStatusCode, string) {
+	if fieldErrors := validateUser(newUser); len(fieldErrors) > 0 {
+		return newUser, ModelInvalidUser, fieldErrorsReason(fieldErrors)
+	}
+	hash, err := hashPassword(newUser.Password)
+	if err != nil {
+		return newUser, ModelDBCreateFailure, fmt.Sprintf("failed to hash password: %v", err)
+	}
+	newUser.Password = hash
+	return userStore.CreateUser(ctx, newUser)
+}
+
+// modelUpdateUser - as modelCreateUser, the new password is hashed before it reaches the store.
+// The update only goes ahead if the preconditions hold against the current record.
+func modelUpdateUser(ctx context.Context, user User, preconditions Preconditions) (User, ModelStatusCode, string) {
+	if fieldErrors := validateUser(user); len(fieldErrors) > 0 {
+		return user, ModelInvalidUser, fieldErrorsReason(fieldErrors)
+	}
+	hash, err := hashPassword(user.Password)
+	if err != nil {
+		return user, ModelDBUpdateFailure, fmt.Sprintf("failed to hash password: %v", err)
+	}
+	user.Password = hash
+	ifVersion, retCode, reason := modelCheckPreconditions(ctx, user.UserName, preconditions)
+	if retCode != ModelSuccess {
+		return user, retCode, reason
+	}
+	return userStore.UpdateUser(ctx, user, ifVersion)
+}
+
+// modelVerifyUserPassword checks a user's credentials. On success, a stored hash that is not in the
+// currently configured algorithm (or is legacy plain text) is transparently replaced.
+func modelVerifyUserPassword(ctx context.Context, userName string, password string) (User, ModelStatusCode, string) {
+	user, retCode, reason := userStore.GetUser(ctx, userName)
+	if retCode == ModelDBUserNotFound {
+		return User{}, ModelInvalidCredentials, "invalid user name or password"
+	} else if retCode != ModelSuccess {
+		return User{}, retCode, reason
+	}
+
+	matched, needsRehash := checkPassword(user.Password, password)
+	if matched == false || len(password) < 1 {
+		return User{}, ModelInvalidCredentials, "invalid user name or password"
+	}
+	if needsRehash {
+		if hash, err := hashPassword(password); err != nil {
+			loggerFor(ctx).Error("modelVerifyUserPassword(): failed to rehash password", "userName", userName, "err", err)
+		} else {
+			user.Password = hash
+			if _, retCode, reason = userStore.PatchUser(ctx, userName, UserChanges{Password: &hash}, 0); retCode != ModelSuccess {
+				loggerFor(ctx).Error("modelVerifyUserPassword(): failed to store rehashed password", "userName", userName, "reason", reason)
+			} else {
+				loggerFor(ctx).Info("modelVerifyUserPassword(): upgraded password hash", "userName", userName)
+			}
+		}
+	}
+	return user, ModelSuccess, ""
+}
+
+func modelGetUser(ctx context.Context, userName string) (User, ModelStatusCode, string) {
+	return userStore.GetUser(ctx, userName)
+}
+
+func modelGetAllUsers(ctx context.Context, query UserQuery) (UserPage, ModelStatusCode, string) {
+	return userStore.GetAllUsers(ctx, query)
+}
+
+// modelDeleteUser also drops any sessions and refresh tokens the deleted user still had open.
+func modelDeleteUser(ctx context.Context, userName string, preconditions Preconditions) (User, ModelStatusCode, string) {
+	ifVersion, retCode, reason := modelCheckPreconditions(ctx, userName, preconditions)
+	if retCode != ModelSuccess {
+		return User{}, retCode, reason
+	}
+	user, retCode, reason := userStore.DeleteUser(ctx, userName, ifVersion)
+	if retCode == ModelSuccess {
+		if sessionCode, sessionReason := userStore.DeleteUserSessions(ctx, userName); sessionCode != ModelSuccess {
+			loggerFor(ctx).Error("modelDeleteUser(): failed to delete sessions", "userName", userName, "reason", sessionReason)
+		}
+		if tokenCode, tokenReason := userStore.DeleteUserRefreshTokens(ctx, userName); tokenCode != ModelSuccess {
+			loggerFor(ctx).Error("modelDeleteUser(): failed to delete refresh tokens", "userName", userName, "reason", tokenReason)
+		}
+	}
+	return user, retCode, reason
+}
+
+func modelDeleteAllUsers(ctx context.Context) (ModelStatusCode, string) {
+	return userStore.DeleteAllUsers(ctx)
+}
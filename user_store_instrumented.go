@@ -0,0 +1,241 @@
+package main
+
+// The configured store, instrumented: every operation is counted by the ModelStatusCode it returns
+// and timed (see metrics.go), and runs in its own span (see tracing.go). It also runs under a
+// deadline - -store-timeout, or its entry in -store-operation-timeouts - on top of the request's
+// own context. An operation that fails because the deadline passed returns ModelDBTimeout, and one
+// that fails, or is never started, because the client went away returns ModelCanceled.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// storeOperations - the operations that can be given their own timeout.
+var storeOperations = []string{"CreateUser", "GetUser", "GetAllUsers", "UpdateUser", "PatchUser", "DeleteUser",
+	"DeleteAllUsers", "CreateSession", "GetSession", "DeleteSession", "DeleteUserSessions", "CreateRefreshToken",
+	"ConsumeRefreshToken", "DeleteRefreshToken", "DeleteUserRefreshTokens"}
+
+func isStoreOperation(operation string) bool {
+	for _, known := range storeOperations {
+		if operation == known {
+			return true
+		}
+	}
+	return false
+}
+
+// OperationTimeouts - store operation deadlines, by operation. As a flag, a comma separated list of
+// operation=duration, e.g. GetAllUsers=10s,CreateUser=2s.
+type OperationTimeouts map[string]time.Duration
+
+func (timeouts *OperationTimeouts) String() string {
+	if timeouts == nil {
+		return ""
+	}
+	var settings []string
+	for operation, timeout := range *timeouts {
+		settings = append(settings, operation+"="+timeout.String())
+	}
+	sort.Strings(settings)
+	return strings.Join(settings, ",")
+}
+
+// Set replaces the timeouts with those in value.
+func (timeouts *OperationTimeouts) Set(value string) error {
+	parsed := OperationTimeouts{}
+	for _, setting := range strings.Split(value, ",") {
+		if setting = strings.TrimSpace(setting); setting == "" {
+			continue
+		}
+		operation, duration, found := strings.Cut(setting, "=")
+		if found == false {
+			return fmt.Errorf("expected operation=duration, got '%v'", setting)
+		}
+		timeout, err := time.ParseDuration(duration)
+		if err != nil {
+			return fmt.Errorf("invalid timeout for %v: %v", operation, err)
+		}
+		parsed[operation] = timeout
+	}
+	*timeouts = parsed
+	return nil
+}
+
+// storeTimeout is the deadline for store operations without one of their own in storeOperationTimeouts.
+// 0 means none.
+var storeTimeout = 5 * time.Second
+var storeOperationTimeouts = OperationTimeouts{}
+
+func operationTimeout(operation string) time.Duration {
+	if timeout, found := storeOperationTimeouts[operation]; found {
+		return timeout
+	}
+	return storeTimeout
+}
+
+// contextStatus returns the status for an operation on ctx that failed with retCode: ModelDBTimeout
+// or ModelCanceled if that is why the store failed, otherwise retCode as is. An answer the store did
+// give - not found, a conflict, a duplicate - stands, even if the deadline passed on its way back.
+func contextStatus(ctx context.Context, retCode ModelStatusCode, reason string) (ModelStatusCode, string) {
+	switch err := ctx.Err(); {
+	case isStoreFailure(retCode) == false || err == nil:
+		return retCode, reason
+	case errors.Is(err, context.DeadlineExceeded):
+		return ModelDBTimeout, fmt.Sprintf("store did not answer in time: %v", reason)
+	default:
+		return ModelCanceled, fmt.Sprintf("request canceled: %v", reason)
+	}
+}
+
+// instrumentedStore - wraps a UserStore, measuring and tracing each operation.
+type instrumentedStore struct {
+	UserStore
+}
+
+func instrumentStore(store UserStore) UserStore {
+	return &instrumentedStore{UserStore: store}
+}
+
+// observe runs operation, calling fn with its context, under the deadline and measured and traced.
+// fn returns the store's status; it returns that, or ModelDBTimeout or ModelCanceled if the context
+// is why the operation failed.
+func observe(ctx context.Context, operation string, fn func(ctx context.Context) (ModelStatusCode, string)) (ModelStatusCode, string) {
+	start := time.Now()
+	ctx, span := startModelSpan(ctx, operation)
+	if timeout := operationTimeout(operation); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	retCode, reason := fn(ctx)
+	retCode, reason = contextStatus(ctx, retCode, reason)
+	observeModel(operation, start, retCode)
+	endModelSpan(span, retCode, reason)
+	return retCode, reason
+}
+
+// CreateUser - instrumented.
+func (store *instrumentedStore) CreateUser(ctx context.Context, newUser User) (user User, retCode ModelStatusCode, reason string) {
+	retCode, reason = observe(ctx, "CreateUser", func(ctx context.Context) (ModelStatusCode, string) {
+		user, retCode, reason = store.UserStore.CreateUser(ctx, newUser)
+		return retCode, reason
+	})
+	return user, retCode, reason
+}
+
+// GetUser - instrumented.
+func (store *instrumentedStore) GetUser(ctx context.Context, userName string) (user User, retCode ModelStatusCode, reason string) {
+	retCode, reason = observe(ctx, "GetUser", func(ctx context.Context) (ModelStatusCode, string) {
+		user, retCode, reason = store.UserStore.GetUser(ctx, userName)
+		return retCode, reason
+	})
+	return user, retCode, reason
+}
+
+// GetAllUsers - instrumented.
+func (store *instrumentedStore) GetAllUsers(ctx context.Context, query UserQuery) (page UserPage, retCode ModelStatusCode, reason string) {
+	retCode, reason = observe(ctx, "GetAllUsers", func(ctx context.Context) (ModelStatusCode, string) {
+		page, retCode, reason = store.UserStore.GetAllUsers(ctx, query)
+		return retCode, reason
+	})
+	return page, retCode, reason
+}
+
+// UpdateUser - instrumented.
+func (store *instrumentedStore) UpdateUser(ctx context.Context, user User, ifVersion int) (updated User, retCode ModelStatusCode, reason string) {
+	retCode, reason = observe(ctx, "UpdateUser", func(ctx context.Context) (ModelStatusCode, string) {
+		updated, retCode, reason = store.UserStore.UpdateUser(ctx, user, ifVersion)
+		return retCode, reason
+	})
+	return updated, retCode, reason
+}
+
+// PatchUser - instrumented.
+func (store *instrumentedStore) PatchUser(ctx context.Context, userName string, changes UserChanges, ifVersion int) (user User, retCode ModelStatusCode, reason string) {
+	retCode, reason = observe(ctx, "PatchUser", func(ctx context.Context) (ModelStatusCode, string) {
+		user, retCode, reason = store.UserStore.PatchUser(ctx, userName, changes, ifVersion)
+		return retCode, reason
+	})
+	return user, retCode, reason
+}
+
+// DeleteUser - instrumented.
+func (store *instrumentedStore) DeleteUser(ctx context.Context, userName string, ifVersion int) (user User, retCode ModelStatusCode, reason string) {
+	retCode, reason = observe(ctx, "DeleteUser", func(ctx context.Context) (ModelStatusCode, string) {
+		user, retCode, reason = store.UserStore.DeleteUser(ctx, userName, ifVersion)
+		return retCode, reason
+	})
+	return user, retCode, reason
+}
+
+// DeleteAllUsers - instrumented.
+func (store *instrumentedStore) DeleteAllUsers(ctx context.Context) (ModelStatusCode, string) {
+	return observe(ctx, "DeleteAllUsers", func(ctx context.Context) (ModelStatusCode, string) {
+		return store.UserStore.DeleteAllUsers(ctx)
+	})
+}
+
+// CreateSession - instrumented.
+func (store *instrumentedStore) CreateSession(ctx context.Context, session Session) (ModelStatusCode, string) {
+	return observe(ctx, "CreateSession", func(ctx context.Context) (ModelStatusCode, string) {
+		return store.UserStore.CreateSession(ctx, session)
+	})
+}
+
+// GetSession - instrumented.
+func (store *instrumentedStore) GetSession(ctx context.Context, tokenHash string) (session Session, retCode ModelStatusCode, reason string) {
+	retCode, reason = observe(ctx, "GetSession", func(ctx context.Context) (ModelStatusCode, string) {
+		session, retCode, reason = store.UserStore.GetSession(ctx, tokenHash)
+		return retCode, reason
+	})
+	return session, retCode, reason
+}
+
+// DeleteSession - instrumented.
+func (store *instrumentedStore) DeleteSession(ctx context.Context, tokenHash string) (ModelStatusCode, string) {
+	return observe(ctx, "DeleteSession", func(ctx context.Context) (ModelStatusCode, string) {
+		return store.UserStore.DeleteSession(ctx, tokenHash)
+	})
+}
+
+// DeleteUserSessions - instrumented.
+func (store *instrumentedStore) DeleteUserSessions(ctx context.Context, userName string) (ModelStatusCode, string) {
+	return observe(ctx, "DeleteUserSessions", func(ctx context.Context) (ModelStatusCode, string) {
+		return store.UserStore.DeleteUserSessions(ctx, userName)
+	})
+}
+
+// CreateRefreshToken - instrumented.
+func (store *instrumentedStore) CreateRefreshToken(ctx context.Context, token RefreshToken) (ModelStatusCode, string) {
+	return observe(ctx, "CreateRefreshToken", func(ctx context.Context) (ModelStatusCode, string) {
+		return store.UserStore.CreateRefreshToken(ctx, token)
+	})
+}
+
+// ConsumeRefreshToken - instrumented.
+func (store *instrumentedStore) ConsumeRefreshToken(ctx context.Context, tokenHash string) (token RefreshToken, retCode ModelStatusCode, reason string) {
+	retCode, reason = observe(ctx, "ConsumeRefreshToken", func(ctx context.Context) (ModelStatusCode, string) {
+		token, retCode, reason = store.UserStore.ConsumeRefreshToken(ctx, tokenHash)
+		return retCode, reason
+	})
+	return token, retCode, reason
+}
+
+// DeleteRefreshToken - instrumented.
+func (store *instrumentedStore) DeleteRefreshToken(ctx context.Context, tokenHash string) (ModelStatusCode, string) {
+	return observe(ctx, "DeleteRefreshToken", func(ctx context.Context) (ModelStatusCode, string) {
+		return store.UserStore.DeleteRefreshToken(ctx, tokenHash)
+	})
+}
+
+// DeleteUserRefreshTokens - instrumented.
+func (store *instrumentedStore) DeleteUserRefreshTokens(ctx context.Context, userName string) (ModelStatusCode, string) {
+	return observe(ctx, "DeleteUserRefreshTokens", func(ctx context.Context) (ModelStatusCode, string) {
+		return store.UserStore.DeleteUserRefreshTokens(ctx, userName)
+	})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// slowStore - a memory store whose GetUser hangs until its context is done, as a stuck query would.
+type slowStore struct {
+	*MemoryDB
+}
+
+func (store *slowStore) GetUser(ctx context.Context, userName string) (User, ModelStatusCode, string) {
+	<-ctx.Done()
+	return User{}, ModelDBGetFailure, ctx.Err().Error()
+}
+
+// as does its DeleteUser, which then answers that the user was not found.
+func (store *slowStore) DeleteUser(ctx context.Context, userName string, ifVersion int) (User, ModelStatusCode, string) {
+	<-ctx.Done()
+	return User{}, ModelDBUserNotFound, "User '" + userName + "' not found"
+}
+
+func setStoreTimeouts(t *testing.T, timeout time.Duration, operationTimeouts OperationTimeouts) {
+	savedTimeout, savedOperationTimeouts := storeTimeout, storeOperationTimeouts
+	t.Cleanup(func() { storeTimeout, storeOperationTimeouts = savedTimeout, savedOperationTimeouts })
+	storeTimeout, storeOperationTimeouts = timeout, operationTimeouts
+}
+
+// Test that store operations run under their deadline, and that running out of time and the caller
+// giving up are told apart from other failures.
+func TestStoreDeadlines(t *testing.T) {
+	setStoreTimeouts(t, 20*time.Millisecond, OperationTimeouts{"GetAllUsers": time.Minute})
+	store := instrumentStore(&slowStore{&MemoryDB{}})
+	store.InitDB()
+
+	start := time.Now()
+	if _, retCode, reason := store.GetUser(context.Background(), "anyone"); retCode != ModelDBTimeout {
+		t.Errorf("expected a timeout, got %v: %v", ModelStatusText(retCode), reason)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the deadline to cut the operation short, took %v", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, retCode, reason := store.GetUser(ctx, "anyone"); retCode != ModelCanceled {
+		t.Errorf("expected a cancellation, got %v: %v", ModelStatusText(retCode), reason)
+	}
+
+	// an answer rather than a failure stands, however late it is.
+	if _, retCode, reason := store.DeleteUser(context.Background(), "anyone", 0); retCode != ModelDBUserNotFound {
+		t.Errorf("expected not found, got %v: %v", ModelStatusText(retCode), reason)
+	}
+
+	// an operation that finishes in time is untouched, and a per operation timeout wins.
+	if _, retCode, reason := store.GetAllUsers(context.Background(), UserQuery{}); retCode != ModelSuccess {
+		t.Errorf("expected success, got %v: %v", ModelStatusText(retCode), reason)
+	}
+	if timeout := operationTimeout("GetAllUsers"); timeout != time.Minute {
+		t.Errorf("expected the GetAllUsers timeout, got %v", timeout)
+	}
+}
+
+// Test that handlers answer 504 for a store timeout and 499 when the client has gone.
+func TestStoreDeadlineStatus(t *testing.T) {
+	setStoreTimeouts(t, 20*time.Millisecond, nil)
+	savedStore := userStore
+	defer func() { userStore = savedStore }()
+	userStore = instrumentStore(&slowStore{&MemoryDB{}})
+	userStore.InitDB()
+
+	recorder := httptest.NewRecorder()
+	getUser(recorder, newJSONRequest("GET", "/user/get", `{"UserName":"anyone"}`))
+	if recorder.Code != http.StatusGatewayTimeout {
+		t.Errorf("expected 504, got %v", recorder.Code)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	recorder = httptest.NewRecorder()
+	getUser(recorder, newJSONRequest("GET", "/user/get", `{"UserName":"anyone"}`).WithContext(ctx))
+	if recorder.Code != statusClientClosedRequest {
+		t.Errorf("expected 499, got %v", recorder.Code)
+	}
+}
+
+func TestOperationTimeoutsFlag(t *testing.T) {
+	var timeouts OperationTimeouts
+	if err := timeouts.Set("GetAllUsers=10s, CreateUser=1.5s"); err != nil {
+		t.Fatal(err)
+	}
+	if timeouts.String() != "CreateUser=1.5s,GetAllUsers=10s" {
+		t.Errorf("unexpected timeouts %v", timeouts.String())
+	}
+	for _, bad := range []string{"GetUser", "GetUser=soon"} {
+		if err := timeouts.Set(bad); err == nil {
+			t.Errorf("expected '%v' to be rejected", bad)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+// Optimistic concurrency. Every user record carries a version that the store bumps on each write,
+// exposed to clients as an ETag of the form "<ID>-<Version>". Update, patch and delete honour
+// If-Match / If-None-Match: the preconditions are checked against the current record, and the write
+// itself is then made conditional on the version we checked, so a concurrent write in between is
+// still caught as a ModelVersionConflict.
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Preconditions - the If-Match and If-None-Match headers of a request.
+type Preconditions struct {
+	IfMatch     []string // entity tags, or "*"
+	IfNoneMatch []string
+}
+
+// userETag returns the strong entity tag for a user record.
+func userETag(user User) string {
+	return fmt.Sprintf(`"%d-%d"`, user.ID, user.Version)
+}
+
+// parseETagList splits an If-Match / If-None-Match header value. Weak tags (W/"...") keep their
+// prefix; whether they can match is up to the comparison.
+func parseETagList(header string) []string {
+	var tags []string
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+func requestPreconditions(r *http.Request) Preconditions {
+	return Preconditions{IfMatch: parseETagList(r.Header.Get("If-Match")), IfNoneMatch: parseETagList(r.Header.Get("If-None-Match"))}
+}
+
+func (preconditions Preconditions) isEmpty() bool {
+	return len(preconditions.IfMatch) == 0 && len(preconditions.IfNoneMatch) == 0
+}
+
+// etagListMatches reports whether any of tags matches the strong etag. If-Match uses strong
+// comparison (RFC 7232 section 2.3.2), where a weak tag never matches; If-None-Match uses weak
+// comparison, which ignores the W/.
+func etagListMatches(tags []string, etag string, exists bool, isWeak bool) bool {
+	for _, tag := range tags {
+		if isWeak {
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if (tag == "*" && exists) || (exists && tag == etag) {
+			return true
+		}
+	}
+	return false
+}
+
+// allows evaluates the preconditions against the current record, per RFC 7232 section 6.
+func (preconditions Preconditions) allows(user User, exists bool) bool {
+	etag := userETag(user)
+	if len(preconditions.IfMatch) > 0 && etagListMatches(preconditions.IfMatch, etag, exists, false) == false {
+		return false
+	}
+	if len(preconditions.IfNoneMatch) > 0 && etagListMatches(preconditions.IfNoneMatch, etag, exists, true) {
+		return false
+	}
+	return true
+}
+
+// modelCheckPreconditions evaluates preconditions for a write to userName. It returns the version the
+// write should be conditional on - 0, for unconditional, when there are no preconditions.
+func modelCheckPreconditions(ctx context.Context, userName string, preconditions Preconditions) (int, ModelStatusCode, string) {
+	if preconditions.isEmpty() {
+		return 0, ModelSuccess, ""
+	}
+	user, retCode, reason := userStore.GetUser(ctx, userName)
+	if retCode != ModelSuccess && retCode != ModelDBUserNotFound {
+		return 0, retCode, reason
+	}
+	if preconditions.allows(user, retCode == ModelSuccess) == false {
+		return 0, ModelVersionConflict, fmt.Sprintf("precondition failed for user '%v', current version is %v", userName, userETag(user))
+	}
+	if retCode == ModelDBUserNotFound {
+		return 0, retCode, reason
+	}
+	return user.Version, ModelSuccess, ""
+}
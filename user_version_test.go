@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+// Test that If-Match compares strongly and If-None-Match weakly.
+func TestPreconditions(t *testing.T) {
+	user := User{ID: 7, Version: 3}
+	etag := userETag(user)
+	for _, test := range []struct {
+		ifMatch, ifNoneMatch string
+		exists, allowed      bool
+	}{
+		{ifMatch: etag, exists: true, allowed: true},
+		{ifMatch: `"1-1", ` + etag, exists: true, allowed: true},
+		{ifMatch: "W/" + etag, exists: true, allowed: false},
+		{ifMatch: `"7-2"`, exists: true, allowed: false},
+		{ifMatch: "*", exists: true, allowed: true},
+		{ifMatch: "*", exists: false, allowed: false},
+		{ifNoneMatch: etag, exists: true, allowed: false},
+		{ifNoneMatch: "W/" + etag, exists: true, allowed: false},
+		{ifNoneMatch: `W/"7-2"`, exists: true, allowed: true},
+		{ifNoneMatch: "*", exists: false, allowed: true},
+	} {
+		preconditions := Preconditions{IfMatch: parseETagList(test.ifMatch), IfNoneMatch: parseETagList(test.ifNoneMatch)}
+		if allowed := preconditions.allows(user, test.exists); allowed != test.allowed {
+			t.Errorf("If-Match '%v', If-None-Match '%v', exists %v: expected allowed %v", test.ifMatch, test.ifNoneMatch, test.exists, test.allowed)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+// Validation of what clients send us. Each field has a list of rules, checked in order; a field
+// reports the first rule it breaks, and every field is checked, so a client hears about all of its
+// mistakes at once rather than one per round trip.
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// fieldRule - one check a field's value must pass. Code names the rule in a FieldError.
+type fieldRule struct {
+	code    string
+	message string
+	isValid func(value string) bool
+}
+
+func required() fieldRule {
+	return fieldRule{"required", "must not be empty", func(value string) bool { return value != "" }}
+}
+
+// maxLength counts characters, not bytes.
+func maxLength(length int) fieldRule {
+	return fieldRule{"max-length", fmt.Sprintf("must be at most %v characters", length),
+		func(value string) bool { return utf8.RuneCountInString(value) <= length }}
+}
+
+func maxBytes(length int) fieldRule {
+	return fieldRule{"max-bytes", fmt.Sprintf("must be at most %v bytes", length),
+		func(value string) bool { return len(value) <= length }}
+}
+
+// printable - valid UTF-8 without control characters. Quotes, slashes and the like are all fine.
+func printable() fieldRule {
+	return fieldRule{"charset", "must be printable UTF-8 text", func(value string) bool {
+		return utf8.ValidString(value) && strings.IndexFunc(value, unicode.IsControl) < 0
+	}}
+}
+
+func trimmed() fieldRule {
+	return fieldRule{"whitespace", "must not start or end with white space",
+		func(value string) bool { return strings.TrimSpace(value) == value }}
+}
+
+func emailAddress() fieldRule {
+	return fieldRule{"email", "must be an email address", isEmailAddress}
+}
+
+// isEmailAddress is deliberately forgiving about the local part, which only the receiving mail
+// server really understands, and checks the domain is made of at least two labels.
+func isEmailAddress(value string) bool {
+	at := strings.LastIndex(value, "@")
+	if at < 1 || at > 64 || strings.ContainsAny(value[:at], "\r\n") {
+		return false
+	}
+	labels := strings.Split(value[at+1:], ".")
+	if len(labels) < 2 {
+		return false
+	}
+	for _, label := range labels {
+		if label == "" || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return false
+		}
+		for _, char := range label {
+			if unicode.IsLetter(char) == false && unicode.IsDigit(char) == false && char != '-' && char != '_' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// userFieldRules - the rules for one field of a user.
+type userFieldRules struct {
+	field string
+	value func(User) string
+	rules []fieldRule
+}
+
+// userRules - what a user sent to us must look like. The lengths are those of the users table's
+// columns, and bcrypt's limit on passwords.
+var userRules = []userFieldRules{
+	{"UserName", func(user User) string { return user.UserName }, []fieldRule{required(), maxLength(255), printable(), trimmed()}},
+	{"Email", func(user User) string { return user.Email }, []fieldRule{required(), maxLength(254), printable(), emailAddress()}},
+	{"Password", func(user User) string { return user.Password }, []fieldRule{required(), maxBytes(72)}},
+}
+
+// validateUser checks every field of a plain text user.
+func validateUser(user User) []FieldError {
+	return validateUserFields(user, "UserName", "Email", "Password")
+}
+
+// validateUserFields - as validateUser, for just the named fields.
+func validateUserFields(user User, fields ...string) []FieldError {
+	var fieldErrors []FieldError
+	for _, fieldRules := range userRules {
+		if slices.Contains(fields, fieldRules.field) == false {
+			continue
+		}
+		value := fieldRules.value(user)
+		for _, rule := range fieldRules.rules {
+			if rule.isValid(value) == false {
+				fieldErrors = append(fieldErrors, FieldError{Field: fieldRules.field, Code: rule.code, Message: rule.message})
+				break
+			}
+		}
+	}
+	return fieldErrors
+}
+
+// fieldErrorsReason sums up field errors as a model reason.
+func fieldErrorsReason(fieldErrors []FieldError) string {
+	reasons := make([]string, len(fieldErrors))
+	for i, fieldError := range fieldErrors {
+		reasons[i] = fieldError.Field + " " + fieldError.Message
+	}
+	return strings.Join(reasons, "; ")
+}
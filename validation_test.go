@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// Test that every broken rule is reported, one per field, and that the awkward but legitimate
+// values the other tests use still pass.
+func TestValidateUser(t *testing.T) {
+	for _, user := range append(append(testUsers{}, myUsers...), awkwardUsers...) {
+		if fieldErrors := validateUser(user); len(fieldErrors) > 0 {
+			t.Errorf("expected %v to be valid, got %+v", user.UserName, fieldErrors)
+		}
+	}
+
+	user := User{UserName: " Alfie", Email: "alfie@localhost", Password: strings.Repeat("p", 73)}
+	fieldErrors := validateUser(user)
+	expected := map[string]string{"UserName": "whitespace", "Email": "email", "Password": "max-bytes"}
+	if len(fieldErrors) != len(expected) {
+		t.Fatalf("expected %v errors, got %+v", len(expected), fieldErrors)
+	}
+	for _, fieldError := range fieldErrors {
+		if expected[fieldError.Field] != fieldError.Code {
+			t.Errorf("unexpected error %+v", fieldError)
+		}
+	}
+
+	fieldErrors = validateUser(User{UserName: "tab\there", Email: strings.Repeat("a", 250) + "@b.com"})
+	if reason := fieldErrorsReason(fieldErrors); reason != "UserName must be printable UTF-8 text; Email must be at most 254 characters; Password must not be empty" {
+		t.Errorf("unexpected reason '%v'", reason)
+	}
+	if fieldErrors = validateUserFields(User{Email: "alfie@example.com"}, "Email"); len(fieldErrors) > 0 {
+		t.Errorf("expected only Email to be checked, got %+v", fieldErrors)
+	}
+}
+
+func TestIsEmailAddress(t *testing.T) {
+	for email, expected := range map[string]bool{
+		"alfie@example.com": true, "o'brien@quote.org": true, "zoë@ünicode.example": true, "a@sub.some_office.org": true,
+		"": false, "alfie": false, "@example.com": false, "alfie@": false, "alfie@localhost": false,
+		"alfie@example..com": false, "alfie@-example.com": false, "alfie@exa mple.com": false,
+		strings.Repeat("a", 65) + "@example.com": false,
+	} {
+		if isEmailAddress(email) != expected {
+			t.Errorf("isEmailAddress(%q) should be %v", email, expected)
+		}
+	}
+}